@@ -0,0 +1,118 @@
+package client
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 信任分: 校验通过的piece加分, 失败的piece扣分, 低于banTrust时封禁
+// 唯一提供分片的peer承担全部责任, 扣分更多
+const (
+	maxTrust           = 8
+	hashFailurePenalty = 2
+	soleFailurePenalty = 4
+	banTrust           = -7
+)
+
+// banList 按IP记录peer的信任分, 被封禁的IP持久化到文件, 重启后仍然有效
+type banList struct {
+	mu     sync.Mutex
+	path   string // 为空时不持久化
+	trust  map[string]int
+	banned map[string]bool
+}
+
+func newBanList(path string) *banList {
+	bans := &banList{
+		path:   path,
+		trust:  make(map[string]int),
+		banned: make(map[string]bool),
+	}
+	if path == "" {
+		return bans
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("warning: read ban list failed, error: ", err)
+		}
+		return bans
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if ip := strings.TrimSpace(line); ip != "" {
+			bans.banned[ip] = true
+		}
+	}
+	return bans
+}
+
+func (bans *banList) Banned(ip string) bool {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	return bans.banned[ip]
+}
+
+func (bans *banList) Trust(ip string) int {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	return bans.trust[ip]
+}
+
+// PieceVerified 记录piece的校验结果, contributors为提供过分片的peer
+// 返回新封禁的IP
+func (bans *banList) PieceVerified(contributors []string, ok bool) []string {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	unique := make(map[string]bool)
+	for _, ip := range contributors {
+		unique[ip] = true
+	}
+	newlyBanned := make([]string, 0)
+	for ip := range unique {
+		if ok {
+			if bans.trust[ip] < maxTrust {
+				bans.trust[ip]++
+			}
+			continue
+		}
+		if len(unique) == 1 {
+			bans.trust[ip] -= soleFailurePenalty
+		} else {
+			bans.trust[ip] -= hashFailurePenalty
+		}
+		if bans.trust[ip] <= banTrust && !bans.banned[ip] {
+			bans.banned[ip] = true
+			newlyBanned = append(newlyBanned, ip)
+		}
+	}
+	if len(newlyBanned) > 0 {
+		if err := bans.saveLocked(); err != nil {
+			log.Println("warning: save ban list failed, error: ", err)
+		}
+	}
+	return newlyBanned
+}
+
+// saveLocked 调用方需持有锁
+func (bans *banList) saveLocked() error {
+	if bans.path == "" {
+		return nil
+	}
+	ips := make([]string, 0, len(bans.banned))
+	for ip := range bans.banned {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	if err := os.MkdirAll(filepath.Dir(bans.path), 0777); err != nil {
+		return err
+	}
+	tmpPath := bans.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(ips, "\n")+"\n"), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, bans.path)
+}
@@ -0,0 +1,48 @@
+package client
+
+import "testing"
+
+func TestBanList(t *testing.T) {
+	path := t.TempDir() + "/banned.list"
+	bans := newBanList(path)
+	if banned := bans.PieceVerified([]string{"1.1.1.1", "2.2.2.2", "1.1.1.1"}, true); len(banned) != 0 {
+		t.Error("Expected no ban for verified piece, got ", banned)
+	}
+	if bans.Trust("1.1.1.1") != 1 {
+		t.Error("Expected trust to increase once per piece, got ", bans.Trust("1.1.1.1"))
+	}
+	bans.PieceVerified([]string{"1.1.1.1"}, true)
+	bans.PieceVerified([]string{"1.1.1.1"}, true)
+	// 多个peer提供的piece校验失败时扣分, 多次失败后封禁
+	for i := 0; i < 3; i++ {
+		if banned := bans.PieceVerified([]string{"1.1.1.1", "3.3.3.3"}, false); len(banned) != 0 {
+			t.Fatal("Expected shared failures not to ban immediately, got ", banned)
+		}
+	}
+	banned := bans.PieceVerified([]string{"1.1.1.1", "3.3.3.3"}, false)
+	if len(banned) != 1 || banned[0] != "3.3.3.3" {
+		t.Error("Expected repeat offender to be banned, got ", banned)
+	}
+	// 唯一提供分片的peer扣分更多, 再次失败后封禁
+	if banned := bans.PieceVerified([]string{"2.2.2.2", "2.2.2.2"}, false); len(banned) != 0 {
+		t.Error("Expected one bad piece not to ban the sole contributor, got ", banned)
+	}
+	if banned := bans.PieceVerified([]string{"2.2.2.2"}, false); len(banned) != 1 {
+		t.Error("Expected sole contributor to be banned, got ", banned)
+	}
+
+	restored := newBanList(path)
+	if !restored.Banned("2.2.2.2") || !restored.Banned("3.3.3.3") || restored.Banned("1.1.1.1") {
+		t.Error("Expected ban list to survive restart")
+	}
+}
+
+func TestBanListSingleFailure(t *testing.T) {
+	bans := newBanList("")
+	if banned := bans.PieceVerified([]string{"4.4.4.4"}, false); len(banned) != 0 || bans.Banned("4.4.4.4") {
+		t.Error("Expected a single bad piece not to ban a new peer, got ", banned)
+	}
+	if bans.Trust("4.4.4.4") != -soleFailurePenalty {
+		t.Error("Expected sole contributor to lose trust, got ", bans.Trust("4.4.4.4"))
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Bencode 编码任意支持的值: string, []byte, 整数, 列表与字典(键按字节序排序)
+func Bencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeBencode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeBencode(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.WriteString(val)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.Write(val)
+	case int:
+		writeBencodeInt(buf, int64(val))
+	case int64:
+		writeBencodeInt(buf, val)
+	case uint16:
+		writeBencodeInt(buf, int64(val))
+	case uint32:
+		writeBencodeInt(buf, int64(val))
+	case bool:
+		if val {
+			writeBencodeInt(buf, 1)
+		} else {
+			writeBencodeInt(buf, 0)
+		}
+	case []string:
+		buf.WriteByte('l')
+		for _, elem := range val {
+			if err := writeBencode(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, elem := range val {
+			if err := writeBencode(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case []map[string]interface{}:
+		buf.WriteByte('l')
+		for _, elem := range val {
+			if err := writeBencode(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			if err := writeBencode(buf, key); err != nil {
+				return err
+			}
+			if err := writeBencode(buf, val[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeBencodeInt(buf *bytes.Buffer, i int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte('e')
+}
+
+// DecodeBencode 解码一个完整的bencode值, 返回 string, int, []interface{} 或 map[string]interface{}
+func DecodeBencode(data []byte) (interface{}, error) {
+	value, readLen, err := readValue(data)
+	if err != nil {
+		return nil, err
+	}
+	if readLen != len(data) {
+		return nil, errors.New("bencode: trailing data")
+	}
+	return value, nil
+}
+
+// readValue 与 readUnknown 类似, 但会保留解码出的值并检查越界
+func readValue(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errors.New("bencode: unexpected end of data")
+	}
+	switch data[0] {
+	case 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 2 {
+			return nil, 0, errors.New("invalid integer")
+		}
+		intVal, err := strconv.Atoi(string(data[1:end]))
+		if err != nil {
+			return nil, 0, errors.New("invalid integer")
+		}
+		return intVal, end + 1, nil
+	case 'l':
+		readLen := 1
+		list := make([]interface{}, 0)
+		for {
+			if readLen >= len(data) {
+				return nil, 0, errors.New("bencode: unterminated list")
+			}
+			if data[readLen] == 'e' {
+				readLen++
+				break
+			}
+			elem, elemLen, err := readValue(data[readLen:])
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, elem)
+			readLen += elemLen
+		}
+		return list, readLen, nil
+	case 'd':
+		readLen := 1
+		dict := make(map[string]interface{})
+		for {
+			if readLen >= len(data) {
+				return nil, 0, errors.New("bencode: unterminated dictionary")
+			}
+			if data[readLen] == 'e' {
+				readLen++
+				break
+			}
+			key, keyLen, err := readValue(data[readLen:])
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("bencode: dictionary key is not a string")
+			}
+			readLen += keyLen
+			value, valueLen, err := readValue(data[readLen:])
+			if err != nil {
+				return nil, 0, err
+			}
+			dict[keyStr] = value
+			readLen += valueLen
+		}
+		return dict, readLen, nil
+	default:
+		colon := bytes.IndexByte(data, ':')
+		if colon < 1 {
+			return nil, 0, errors.New("invalid length-prefix")
+		}
+		length, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || length < 0 {
+			return nil, 0, errors.New("invalid length-prefix")
+		}
+		if colon+1+length > len(data) {
+			return nil, 0, errors.New("bencode: string exceeds data")
+		}
+		return string(data[colon+1 : colon+1+length]), colon + 1 + length, nil
+	}
+}
+
+func dictString(dict map[string]interface{}, key string) (string, bool) {
+	val, ok := dict[key].(string)
+	return val, ok
+}
+
+func dictInt(dict map[string]interface{}, key string) (int, bool) {
+	val, ok := dict[key].(int)
+	return val, ok
+}
+
+func dictDict(dict map[string]interface{}, key string) (map[string]interface{}, bool) {
+	val, ok := dict[key].(map[string]interface{})
+	return val, ok
+}
+
+func dictList(dict map[string]interface{}, key string) ([]interface{}, bool) {
+	val, ok := dict[key].([]interface{})
+	return val, ok
+}
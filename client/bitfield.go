@@ -0,0 +1,178 @@
+package client
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Bitfield piece的集合, 按线路格式存储: 第0个piece是第一个字节的最高位, 末尾多余的位为0
+type Bitfield struct {
+	bits   []byte
+	length int
+}
+
+func NewBitfield(length int) *Bitfield {
+	return &Bitfield{bits: make([]byte, (length+7)/8), length: length}
+}
+
+// FullBitfield 拥有所有piece的bitfield, 用于Have All
+func FullBitfield(length int) *Bitfield {
+	bitfield := NewBitfield(length)
+	for i := range bitfield.bits {
+		bitfield.bits[i] = 0xff
+	}
+	bitfield.clearSpare()
+	return bitfield
+}
+
+// DecodeBitfield 解析Bitfield消息, 长度必须与piece数一致, 末尾多余的位必须为0
+func DecodeBitfield(data []byte, length int) (*Bitfield, error) {
+	if len(data) != (length+7)/8 {
+		return nil, protocolErrorf(BitfieldMessage, "length %d for %d pieces", len(data), length)
+	}
+	bitfield := &Bitfield{bits: append([]byte(nil), data...), length: length}
+	if length%8 != 0 && data[len(data)-1]&(0xff>>uint(length%8)) != 0 {
+		return nil, protocolErrorf(BitfieldMessage, "spare bits set")
+	}
+	return bitfield, nil
+}
+
+// loadBitfield 读取保存的bitfield, 长度不一致时截断或补0
+func loadBitfield(data []byte, length int) *Bitfield {
+	bitfield := NewBitfield(length)
+	copy(bitfield.bits, data)
+	bitfield.clearSpare()
+	return bitfield
+}
+
+func (bitfield *Bitfield) clearSpare() {
+	if bitfield.length%8 != 0 {
+		bitfield.bits[len(bitfield.bits)-1] &^= 0xff >> uint(bitfield.length%8)
+	}
+}
+
+// Len piece数
+func (bitfield *Bitfield) Len() int {
+	return bitfield.length
+}
+
+// Has 超出范围的piece视为没有
+func (bitfield *Bitfield) Has(index int) bool {
+	return index >= 0 && index < bitfield.length && bitfield.bits[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+func (bitfield *Bitfield) Set(index int) {
+	if index >= 0 && index < bitfield.length {
+		bitfield.bits[index/8] |= 0x80 >> uint(index%8)
+	}
+}
+
+func (bitfield *Bitfield) Clear(index int) {
+	if index >= 0 && index < bitfield.length {
+		bitfield.bits[index/8] &^= 0x80 >> uint(index%8)
+	}
+}
+
+// Count 拥有的piece数
+func (bitfield *Bitfield) Count() int {
+	count := 0
+	for _, b := range bitfield.bits {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
+
+func (bitfield *Bitfield) Complete() bool {
+	return bitfield.Count() == bitfield.length
+}
+
+// ForEach 按顺序遍历拥有的piece
+func (bitfield *Bitfield) ForEach(fn func(index int)) {
+	for i, b := range bitfield.bits {
+		for b != 0 {
+			offset := bits.LeadingZeros8(b)
+			fn(i*8 + offset)
+			b &^= 0x80 >> uint(offset)
+		}
+	}
+}
+
+// Bytes 线路格式的副本
+func (bitfield *Bitfield) Bytes() []byte {
+	return append([]byte(nil), bitfield.bits...)
+}
+
+func (bitfield *Bitfield) Clone() *Bitfield {
+	return &Bitfield{bits: bitfield.Bytes(), length: bitfield.length}
+}
+
+// Union, Intersect和Difference返回新的bitfield, 长度与bitfield相同
+func (bitfield *Bitfield) Union(other *Bitfield) *Bitfield {
+	return bitfield.combine(other, func(a, b byte) byte { return a | b })
+}
+
+func (bitfield *Bitfield) Intersect(other *Bitfield) *Bitfield {
+	return bitfield.combine(other, func(a, b byte) byte { return a & b })
+}
+
+func (bitfield *Bitfield) Difference(other *Bitfield) *Bitfield {
+	return bitfield.combine(other, func(a, b byte) byte { return a &^ b })
+}
+
+func (bitfield *Bitfield) combine(other *Bitfield, op func(a, b byte) byte) *Bitfield {
+	result := NewBitfield(bitfield.length)
+	for i := range result.bits {
+		var b byte
+		if i < len(other.bits) {
+			b = other.bits[i]
+		}
+		result.bits[i] = op(bitfield.bits[i], b)
+	}
+	result.clearSpare()
+	return result
+}
+
+// SyncBitfield 可以被多个goroutine同时访问的Bitfield
+type SyncBitfield struct {
+	mu       sync.RWMutex
+	bitfield *Bitfield
+}
+
+func NewSyncBitfield(bitfield *Bitfield) *SyncBitfield {
+	return &SyncBitfield{bitfield: bitfield}
+}
+
+func (s *SyncBitfield) Len() int {
+	return s.bitfield.Len()
+}
+
+func (s *SyncBitfield) Has(index int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bitfield.Has(index)
+}
+
+func (s *SyncBitfield) Set(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bitfield.Set(index)
+}
+
+func (s *SyncBitfield) Clear(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bitfield.Clear(index)
+}
+
+func (s *SyncBitfield) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bitfield.Count()
+}
+
+// Snapshot 返回当前内容的副本
+func (s *SyncBitfield) Snapshot() *Bitfield {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bitfield.Clone()
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// bitfieldOf 由线路格式的字节构造bitfield, piece数为字节数*8
+func bitfieldOf(data ...byte) *Bitfield {
+	return loadBitfield(data, len(data)*8)
+}
+
+func TestBitfield(t *testing.T) {
+	bitfield := NewBitfield(10)
+	if bitfield.Len() != 10 || bitfield.Count() != 0 || len(bitfield.Bytes()) != 2 {
+		t.Fatal("Unexpected empty bitfield: ", bitfield.Bytes())
+	}
+	bitfield.Set(0)
+	bitfield.Set(9)
+	bitfield.Set(10) // 超出范围的piece被忽略
+	if !bytes.Equal(bitfield.Bytes(), []byte{0x80, 0x40}) {
+		t.Error("Unexpected wire format: ", bitfield.Bytes())
+	}
+	if !bitfield.Has(0) || !bitfield.Has(9) || bitfield.Has(1) || bitfield.Has(10) || bitfield.Has(-1) {
+		t.Error("Unexpected pieces in bitfield")
+	}
+	if bitfield.Count() != 2 || bitfield.Complete() {
+		t.Error("Expected two pieces, got ", bitfield.Count())
+	}
+	bitfield.Clear(0)
+	if bitfield.Has(0) || bitfield.Count() != 1 {
+		t.Error("Expected piece 0 to be cleared")
+	}
+
+	var pieces []int
+	bitfieldOf(0x81, 0x20).ForEach(func(index int) { pieces = append(pieces, index) })
+	if !reflect.DeepEqual(pieces, []int{0, 7, 10}) {
+		t.Error("Unexpected pieces: ", pieces)
+	}
+
+	full := FullBitfield(10)
+	if !full.Complete() || !bytes.Equal(full.Bytes(), []byte{0xff, 0xc0}) {
+		t.Error("Unexpected full bitfield: ", full.Bytes())
+	}
+	clone := full.Clone()
+	clone.Clear(3)
+	if !full.Has(3) {
+		t.Error("Expected clone to be independent")
+	}
+}
+
+func TestBitfieldSetOperations(t *testing.T) {
+	a := bitfieldOf(0xf0)
+	b := bitfieldOf(0x3c)
+	if got := a.Union(b).Bytes(); !bytes.Equal(got, []byte{0xfc}) {
+		t.Error("Unexpected union: ", got)
+	}
+	if got := a.Intersect(b).Bytes(); !bytes.Equal(got, []byte{0x30}) {
+		t.Error("Unexpected intersection: ", got)
+	}
+	if got := a.Difference(b).Bytes(); !bytes.Equal(got, []byte{0xc0}) {
+		t.Error("Unexpected difference: ", got)
+	}
+	if !bytes.Equal(a.Bytes(), []byte{0xf0}) {
+		t.Error("Expected operands to be unchanged")
+	}
+}
+
+func TestDecodeBitfield(t *testing.T) {
+	if bitfield, err := DecodeBitfield([]byte{0xff, 0xc0}, 10); err != nil || !bitfield.Complete() {
+		t.Error("Expected valid bitfield, got ", err)
+	}
+	if _, err := DecodeBitfield([]byte{0xff}, 16); !isProtocolError(err) {
+		t.Error("Expected short bitfield to be rejected, got ", err)
+	}
+	if _, err := DecodeBitfield([]byte{0xff, 0, 0}, 16); !isProtocolError(err) {
+		t.Error("Expected long bitfield to be rejected, got ", err)
+	}
+	if _, err := DecodeBitfield([]byte{0xff, 0xe0}, 10); !isProtocolError(err) {
+		t.Error("Expected spare bits to be rejected, got ", err)
+	}
+	data := []byte{0x80}
+	bitfield, _ := DecodeBitfield(data, 8)
+	data[0] = 0
+	if !bitfield.Has(0) {
+		t.Error("Expected decoded bitfield not to share the message payload")
+	}
+
+	// 旧版本保存的文件在piece数为8的倍数时多一个字节
+	if loaded := loadBitfield([]byte{0xff, 0xff}, 8); !bytes.Equal(loaded.Bytes(), []byte{0xff}) {
+		t.Error("Expected saved bitfield to be truncated, got ", loaded.Bytes())
+	}
+	if loaded := loadBitfield([]byte{0xff}, 12); !bytes.Equal(loaded.Bytes(), []byte{0xff, 0}) {
+		t.Error("Expected short saved bitfield to be padded, got ", loaded.Bytes())
+	}
+}
+
+func TestSyncBitfield(t *testing.T) {
+	bitfield := NewSyncBitfield(NewBitfield(64))
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			bitfield.Set(index)
+			bitfield.Has(index)
+		}(i)
+	}
+	snapshot := bitfield.Snapshot()
+	wg.Wait()
+	if bitfield.Count() != 64 || !bitfield.Snapshot().Complete() {
+		t.Error("Expected all pieces, got ", bitfield.Count())
+	}
+	snapshot.Clear(0)
+	if !bitfield.Has(0) {
+		t.Error("Expected snapshot to be independent")
+	}
+}
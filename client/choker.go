@@ -0,0 +1,185 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// PeerStats 一个选择周期内peer的状态和速率, 单位为bytes/s
+type PeerStats struct {
+	Id           int
+	Interested   bool // 对方对我们感兴趣
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// ChokeAlgorithm 选出常规unchoke的peer, optimistic unchoke由Choker负责
+type ChokeAlgorithm interface {
+	SelectUnchoked(peers []PeerStats, slots int, seeding bool) []int
+}
+
+// TitForTat 下载时unchoke给我们上传最快的peer, 做种时unchoke从我们下载最快的peer
+type TitForTat struct{}
+
+func (TitForTat) SelectUnchoked(peers []PeerStats, slots int, seeding bool) []int {
+	candidates := make([]PeerStats, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Interested {
+			candidates = append(candidates, peer)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].UploadRate > candidates[j].UploadRate
+		}
+		return candidates[i].DownloadRate > candidates[j].DownloadRate
+	})
+	ids := make([]int, 0, slots)
+	for i := 0; i < len(candidates) && i < slots; i++ {
+		ids = append(ids, candidates[i].Id)
+	}
+	return ids
+}
+
+type peerCounters struct {
+	downloaded int64
+	uploaded   int64
+}
+
+// Choker 每10秒重新选择unchoke的peer, 每30秒轮换optimistic unchoke
+type Choker struct {
+	algorithm       ChokeAlgorithm
+	slots           int
+	optimisticSlots int
+
+	mu         sync.Mutex
+	counters   map[*Downloader]peerCounters
+	stats      map[*Downloader]PeerStats
+	optimistic map[*Downloader]bool
+	lastChoke  time.Time
+	lastRotate time.Time
+}
+
+func NewChoker(algorithm ChokeAlgorithm, slots int, optimisticSlots int) *Choker {
+	if algorithm == nil {
+		algorithm = TitForTat{}
+	}
+	return &Choker{
+		algorithm:       algorithm,
+		slots:           slots,
+		optimisticSlots: optimisticSlots,
+		counters:        make(map[*Downloader]peerCounters),
+		stats:           make(map[*Downloader]PeerStats),
+		optimistic:      make(map[*Downloader]bool),
+	}
+}
+
+func (choker *Choker) run(client *Client, cancelChan <-chan struct{}) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancelChan:
+			return
+		case <-ticker.C:
+			choker.rechoke(client.activeDownloaders(), client.seeding(), time.Now())
+		}
+	}
+}
+
+// rechoke 根据上一周期的速率决定每个peer是否choke
+func (choker *Choker) rechoke(downloaders []*Downloader, seeding bool, now time.Time) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	elapsed := now.Sub(choker.lastChoke).Seconds()
+	if choker.lastChoke.IsZero() || elapsed <= 0 {
+		elapsed = chokeInterval.Seconds()
+	}
+	choker.lastChoke = now
+	active := make(map[*Downloader]bool, len(downloaders))
+	byId := make(map[int]*Downloader, len(downloaders))
+	peers := make([]PeerStats, 0, len(downloaders))
+	for _, downloader := range downloaders {
+		active[downloader] = true
+		byId[downloader.Id] = downloader
+		current := peerCounters{downloaded: downloader.downloaded.Load(), uploaded: downloader.uploaded.Load()}
+		last := choker.counters[downloader]
+		choker.counters[downloader] = current
+		stats := PeerStats{
+			Id:           downloader.Id,
+			Interested:   downloader.State().peer_interested,
+			DownloadRate: float64(current.downloaded-last.downloaded) / elapsed,
+			UploadRate:   float64(current.uploaded-last.uploaded) / elapsed,
+		}
+		choker.stats[downloader] = stats
+		peers = append(peers, stats)
+	}
+	// 清理已断开的连接
+	for downloader := range choker.counters {
+		if !active[downloader] {
+			delete(choker.counters, downloader)
+			delete(choker.stats, downloader)
+			delete(choker.optimistic, downloader)
+		}
+	}
+
+	unchoked := make(map[*Downloader]bool)
+	for _, id := range choker.algorithm.SelectUnchoked(peers, choker.slots, seeding) {
+		if downloader, ok := byId[id]; ok {
+			unchoked[downloader] = true
+		}
+	}
+
+	// 常规unchoke的peer不再占用optimistic名额
+	for downloader := range choker.optimistic {
+		if unchoked[downloader] || !choker.stats[downloader].Interested {
+			delete(choker.optimistic, downloader)
+		}
+	}
+	if now.Sub(choker.lastRotate) >= optimisticInterval || len(choker.optimistic) < choker.optimisticSlots {
+		choker.rotateOptimistic(downloaders, unchoked, now)
+	}
+
+	for _, downloader := range downloaders {
+		downloader.SetChoking(!unchoked[downloader] && !choker.optimistic[downloader])
+	}
+}
+
+// rotateOptimistic 从剩余感兴趣的peer中随机选择optimistic unchoke
+func (choker *Choker) rotateOptimistic(downloaders []*Downloader, unchoked map[*Downloader]bool, now time.Time) {
+	rotate := now.Sub(choker.lastRotate) >= optimisticInterval
+	candidates := make([]*Downloader, 0)
+	for _, downloader := range downloaders {
+		if !unchoked[downloader] && choker.stats[downloader].Interested && (rotate || !choker.optimistic[downloader]) {
+			candidates = append(candidates, downloader)
+		}
+	}
+	if rotate {
+		choker.optimistic = make(map[*Downloader]bool)
+		choker.lastRotate = now
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, downloader := range candidates {
+		if len(choker.optimistic) >= choker.optimisticSlots {
+			break
+		}
+		choker.optimistic[downloader] = true
+	}
+}
+
+// Stats 返回downloader在上一周期的速率
+func (choker *Choker) Stats(downloader *Downloader) PeerStats {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	return choker.stats[downloader]
+}
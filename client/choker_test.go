@@ -0,0 +1,82 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func newChokeTestDownloader(id int, interested bool, downloaded, uploaded int64) *Downloader {
+	downloader := &Downloader{
+		Id:        id,
+		state:     &State{am_choking: true, peer_choking: true, peer_interested: interested},
+		peer:      &Peer{IP: "127.0.0.1", Port: 7000 + id},
+		chokeChan: make(chan bool, 1),
+	}
+	downloader.downloaded.Store(downloaded)
+	downloader.uploaded.Store(uploaded)
+	return downloader
+}
+
+func unchokedIds(downloaders []*Downloader) map[int]bool {
+	ids := make(map[int]bool)
+	for _, downloader := range downloaders {
+		select {
+		case choke := <-downloader.chokeChan:
+			if !choke {
+				ids[downloader.Id] = true
+			}
+		default:
+		}
+	}
+	return ids
+}
+
+func TestTitForTatSelectUnchoked(t *testing.T) {
+	peers := []PeerStats{
+		{Id: 1, Interested: true, DownloadRate: 10, UploadRate: 300},
+		{Id: 2, Interested: true, DownloadRate: 30, UploadRate: 100},
+		{Id: 3, Interested: false, DownloadRate: 50, UploadRate: 500},
+		{Id: 4, Interested: true, DownloadRate: 20, UploadRate: 200},
+	}
+	ids := TitForTat{}.SelectUnchoked(peers, 2, false)
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 4 {
+		t.Error("Expected fastest uploaders to us while downloading, got ", ids)
+	}
+	ids = TitForTat{}.SelectUnchoked(peers, 2, true)
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 4 {
+		t.Error("Expected fastest downloaders from us while seeding, got ", ids)
+	}
+}
+
+func TestChokerRechoke(t *testing.T) {
+	downloaders := []*Downloader{
+		newChokeTestDownloader(1, true, 1000, 0),
+		newChokeTestDownloader(2, true, 3000, 0),
+		newChokeTestDownloader(3, true, 2000, 0),
+		newChokeTestDownloader(4, false, 9000, 0),
+		newChokeTestDownloader(5, true, 0, 0),
+	}
+	choker := NewChoker(nil, 2, 1)
+	now := time.Now()
+	choker.rechoke(downloaders, false, now)
+	unchoked := unchokedIds(downloaders)
+	if len(unchoked) != 3 || !unchoked[2] || !unchoked[3] || unchoked[4] {
+		t.Fatal("Expected two regular and one optimistic unchoke, got ", unchoked)
+	}
+	optimistic := 0
+	for id := range unchoked {
+		if id != 2 && id != 3 {
+			optimistic = id
+		}
+	}
+	if stats := choker.Stats(downloaders[1]); stats.DownloadRate != 300 {
+		t.Error("Expected rate over the choke interval, got ", stats.DownloadRate)
+	}
+
+	// 10秒后optimistic unchoke保持不变
+	choker.rechoke(downloaders, false, now.Add(chokeInterval))
+	unchoked = unchokedIds(downloaders)
+	if len(unchoked) != 3 || !unchoked[optimistic] {
+		t.Error("Expected optimistic unchoke to be kept until rotation, got ", unchoked)
+	}
+}
@@ -1,9 +1,12 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,9 +17,14 @@ const (
 	pstrlen     = 19
 	pstr        = "BitTorrent protocol"
 	bitfieldDir = "bitfield"
+
+	peerRetryInterval  = 10 * time.Minute // 同一地址再次尝试连接的最短间隔
+	maxKnownPeers      = 5000
+	lazyBitfieldPieces = 8 // LazyBitfield时初始bitfield中隐藏的piece数
 )
 
-var reserved = [8]byte{0, 0, 0, 0, 0, 0, 0, 0}
+// 第20位(reserved[5]&0x10)表示支持扩展协议 (BEP 10), reserved[7]&0x04表示支持fast extension (BEP 6)
+var reserved = [8]byte{0, 0, 0, 0, 0, extensionReservedBit, 0, fastReservedBit}
 
 type DownloadPieceTask struct {
 	PieceIndex  int
@@ -29,16 +37,30 @@ type SavePieceTask struct {
 	Piece      []byte
 }
 
+type TrackerStatus struct {
+	Url          string
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	Failures     int
+	LastError    string
+	Warning      string
+	Peers        int
+}
+
 type Client struct {
-	bitField      []byte
+	mu            sync.Mutex
+	pieceCond     *sync.Cond // 保存piece和Stop时通知
+	bitField      *SyncBitfield
+	discarded     *Bitfield // 部分数据落在未创建的跳过文件中被丢弃的piece, 不上传也不通告
 	pieceNum      int
 	savedNum      int
-	wg            sync.WaitGroup
 	metaInfo      *MetaInfo
 	handShakeMsg  []byte
-	downloadChan  chan DownloadPieceTask
+	picker        PiecePicker
+	scheduler     *blockScheduler
+	priorities    []FilePriority // 每个文件的优先级
+	finishedChan  chan struct{}  // 所有piece下载完成后关闭
 	saveChan      chan SavePieceTask
-	fallbackChan  chan DownloadPieceTask
 	peerChan      chan *Peer
 	downloadDir   string
 	downloaderNum int
@@ -48,98 +70,217 @@ type Client struct {
 	paused        bool
 	speed         string
 	cancelChan    chan struct{}
+	trackers      map[string]*TrackerStatus
+	config        Config
+	dht           *DHT
+	extensions    *ExtensionRegistry
+	downloaders   map[int]*Downloader
+	knownPeers    map[string]time.Time // 已交给downloader的地址 -> 时间
+	pex           *pexExtension
+	choker        *Choker
+	bans          *banList
+	listener      *PeerListener
+	dialer        *PeerDialer
+	storage       *PieceSaver
+	// 因违反协议而断开的连接数
+	protocolErrors int
+	// 被动连接的downloader id从downloaderNum开始分配
+	nextDownloaderId int
 }
 
 func NewClient(metaInfo *MetaInfo, downloadDir string, downloaderNum int) (*Client, error) {
-	peerId := randomString(20)
-	// peerId := "-UT0001-123456789012"
-	peerPort := 6881
+	config := DefaultConfig()
+	config.DownloaderNum = downloaderNum
+	return NewClientWithConfig(metaInfo, downloadDir, config)
+}
+
+func NewClientWithConfig(metaInfo *MetaInfo, downloadDir string, config Config) (*Client, error) {
+	peerId := generatePeerId(config.PeerIdPrefix)
+	peerPort := config.PeerPort
+	downloaderNum := config.DownloaderNum
+	if err := checkFilePaths(&metaInfo.Info); err != nil {
+		return nil, err
+	}
+	// uTP在PeerPort上监听UDP, DHT不能使用相同的端口
+	if config.DHTEnabled && config.Transport != TransportTCP && config.PeerPort != 0 && config.DHTPort == config.PeerPort {
+		log.Printf("dht port %d is used by utp, use %d instead", config.DHTPort, config.DHTPort+1)
+		config.DHTPort++
+	}
 
 	bitfield := GetBitfield(metaInfo, downloadDir, bitfieldDir)
 
-	return &Client{
-		bitField:      bitfield,
+	client := &Client{
+		bitField:      NewSyncBitfield(bitfield),
+		discarded:     NewBitfield(len(metaInfo.Info.Pieces)),
 		pieceNum:      len(metaInfo.Info.Pieces),
 		metaInfo:      metaInfo,
 		handShakeMsg:  handShakeMsg(metaInfo, peerId),
-		downloadChan:  make(chan DownloadPieceTask, 100),
-		fallbackChan:  make(chan DownloadPieceTask, downloaderNum+1),
+		finishedChan:  make(chan struct{}),
 		saveChan:      make(chan SavePieceTask, 100),
 		peerChan:      make(chan *Peer, downloaderNum),
 		downloadDir:   downloadDir,
 		downloaderNum: downloaderNum,
-		savedNum:      calcSavedNum(bitfield, len(metaInfo.Info.Pieces)),
+		savedNum:      bitfield.Count(),
 		peerId:        peerId,
 		peerPort:      peerPort,
 		peers:         make(map[int]*Peer, downloaderNum),
 		paused:        true,
 		speed:         "0B/S",
 		cancelChan:    make(chan struct{}),
-	}, nil
+		trackers:      make(map[string]*TrackerStatus),
+		config:        config,
+		extensions:    NewExtensionRegistry(peerPort, len(metaInfo.InfoBytes)),
+		downloaders:   make(map[int]*Downloader, downloaderNum),
+		knownPeers:    make(map[string]time.Time),
+		choker:        NewChoker(config.ChokeAlgorithm, config.UploadSlots, config.OptimisticSlots),
+		bans:          newBanList(config.BanListFile),
+		dialer:        &PeerDialer{Transport: config.Transport, Encryption: config.Encryption},
+
+		nextDownloaderId: downloaderNum,
+	}
+	// 启用DHT时在握手中声明, 对方会发送Port消息
+	if config.DHTEnabled {
+		client.handShakeMsg[20+dhtReservedByte] |= dhtReservedBit
+	}
+	client.picker = config.PiecePicker
+	if client.picker == nil {
+		client.picker = NewRarestFirstPicker(client.pieceNum, defaultRandomFirstPieces)
+	}
+	bitfield.ForEach(client.picker.Done)
+	client.priorities = make([]FilePriority, len(client.files()))
+	for i := range client.priorities {
+		client.priorities[i] = PriorityNormal
+	}
+	client.pieceCond = sync.NewCond(&client.mu)
+	client.scheduler = newBlockScheduler(client.picker, client.pieceTask)
+	client.scheduler.onDuplicate = client.cancelDuplicate
+	client.scheduler.peerKey = client.peerIP
+	client.scheduler.onVerified = client.pieceVerified
+	if config.Sequential {
+		if err := client.Stream(); err != nil {
+			return nil, err
+		}
+	}
+	// 私有种子禁用PEX (BEP 27)
+	if config.PEXEnabled && !metaInfo.Info.Private {
+		client.pex = newPexExtension(client)
+		client.RegisterExtension(client.pex)
+	}
+	return client, nil
 }
 
 func (client *Client) StartDownload() {
 	client.paused = false
-	client.wg.Add(1)
-	go client.SendDownloadTask()
+	if err := client.listen(); err != nil {
+		log.Println("warning: listen on port ", client.peerPort, " failed, error: ", err)
+	}
+	storage, err := NewPieceSaver(client.metaInfo, client.downloadDir, bitfieldDir)
+	if err != nil {
+		log.Println("Error opening download file: ", err)
+		return
+	}
+	client.mu.Lock()
+	client.storage = storage
+	for i, priority := range client.priorities {
+		storage.SetFileWanted(i, priority != PrioritySkip)
+		client.resetMissingFileLocked(i)
+	}
+	client.mu.Unlock()
 
 	go client.FetchPeers(client.cancelChan)
+	go client.choker.run(client, client.cancelChan)
+	if client.pex != nil {
+		go client.pex.run(client.cancelChan)
+	}
 
 	for i := 0; i < client.downloaderNum; i++ {
 		go client.DownloadFromPeer(i)
 	}
 
-	client.wg.Add(1)
 	go client.SavePiece()
 
 	go client.calcSpeed()
-	client.wg.Wait()
-	//close(client.cancelChan)
+	// 需要的文件下载完成后返回, 之后继续做种
+	client.mu.Lock()
+	for !client.wantedCompleteLocked() && !client.stopped() {
+		client.pieceCond.Wait()
+	}
+	client.mu.Unlock()
 	client.paused = true
 }
 
+// SavePiece 保存下载的piece直到Stop, 文件优先级在下载中可能改变
 func (client *Client) SavePiece() {
-	defer client.wg.Done()
-	PieceSaver, err := NewPieceSaver(client.metaInfo, client.downloadDir, bitfieldDir)
-	if err != nil {
-		return
-	}
-	defer PieceSaver.Close()
-	var saveTask SavePieceTask
-	if client.savedNum != client.pieceNum {
-		for saveTask = range client.saveChan {
-			client.bitField[saveTask.PieceIndex/8] |= 1 << uint(7-saveTask.PieceIndex%8)
-			err := PieceSaver.SavePiece(saveTask, client.bitField)
-			if err != nil {
-				log.Println("saving piece error ", err)
-				panic(err)
-			} else {
-				client.savedNum++
-				if client.savedNum == client.pieceNum {
-					close(client.saveChan)
-				}
-			}
+	finished := false
+	for {
+		client.mu.Lock()
+		// 有跳过的文件时不关闭finishedChan, 之后可能重新选择
+		if !finished && client.savedNum == client.pieceNum && !client.hasSkippedLocked() {
+			finished = true
+			log.Println("download finished")
+			close(client.finishedChan)
+		}
+		client.mu.Unlock()
+		var saveTask SavePieceTask
+		select {
+		case saveTask = <-client.saveChan:
+		case <-client.cancelChan:
+			log.Println("download stop")
+			return
+		}
+		// endgame中同一个piece可能被多个peer下载
+		if client.bitField.Has(saveTask.PieceIndex) {
+			continue
+		}
+		// 先写入数据再更新bitfield, 保证做种时不会读到未保存的piece
+		bitfield := client.bitField.Snapshot()
+		bitfield.Set(saveTask.PieceIndex)
+		err := client.storage.SavePiece(saveTask, bitfield)
+		if err != nil {
+			log.Println("saving piece error ", err)
+			panic(err)
+		}
+		client.mu.Lock()
+		client.bitField.Set(saveTask.PieceIndex)
+		client.savedNum++
+		discarded := client.pieceDiscardedLocked(saveTask.PieceIndex)
+		if discarded {
+			client.discarded.Set(saveTask.PieceIndex)
+		}
+		client.pieceCond.Broadcast()
+		client.mu.Unlock()
+		client.picker.Done(saveTask.PieceIndex)
+		if discarded {
+			continue
+		}
+		for _, downloader := range client.activeDownloaders() {
+			downloader.notifyHave(saveTask.PieceIndex)
 		}
 	}
-	if client.savedNum == client.pieceNum {
-		log.Println("download finished")
-		close(client.fallbackChan)
-		close(client.downloadChan)
-	} else {
-		log.Println("download stop")
-		close(client.fallbackChan)
+}
+
+func (client *Client) stopped() bool {
+	select {
+	case <-client.cancelChan:
+		return true
+	default:
+		return false
 	}
-	return
 }
 
 func (client *Client) FetchPeers(cancelChan chan struct{}) {
 	trackerList := make([]string, 0, 50)
-	trackerList = append(trackerList, client.metaInfo.Announce)
+	seen := make(map[string]bool)
+	if strings.HasPrefix(client.metaInfo.Announce, "http") {
+		trackerList = append(trackerList, client.metaInfo.Announce)
+		seen[client.metaInfo.Announce] = true
+	}
 	for _, urlList := range client.metaInfo.AnnounceList {
 		for _, trackerUrl := range urlList {
 			// 只支持http tracker
-			if strings.HasPrefix(trackerUrl, "http") {
+			if strings.HasPrefix(trackerUrl, "http") && !seen[trackerUrl] {
 				trackerList = append(trackerList, trackerUrl)
+				seen[trackerUrl] = true
 			}
 		}
 	}
@@ -149,37 +290,193 @@ func (client *Client) FetchPeers(cancelChan chan struct{}) {
 		case <-cancelChan:
 			return
 		default:
-			go client.FetchPeersFromTracker(trackerUrl)
+			go client.FetchPeersFromTracker(trackerUrl, cancelChan)
 		}
 	}
+
+	// 私有种子只能使用tracker
+	if client.config.DHTEnabled && !client.metaInfo.Info.Private {
+		go client.FetchPeersFromDHT(cancelChan)
+	}
+	if client.config.LSDEnabled && !client.metaInfo.Info.Private {
+		go client.FetchPeersFromLSD(cancelChan)
+	}
 }
 
-func (client *Client) FetchPeersFromTracker(trackerUrl string) {
-	trackerClient := NewTrackerClient(trackerUrl, client.metaInfo.InfoHash, client.peerId,
-		client.peerPort, 0, 0, client.metaInfo.Info.Length, 1, 50, "started")
-	res, err := trackerClient.Announce()
+// FetchPeersFromLSD 在局域网内组播announce, 发现的peer走正常的连接流程
+func (client *Client) FetchPeersFromLSD(cancelChan chan struct{}) {
+	transport := client.config.LSDTransport
+	if transport == nil {
+		var err error
+		transport, err = NewMulticastLSDTransport("")
+		if err != nil {
+			log.Println("warning: start lsd failed, error: " + err.Error())
+			return
+		}
+	}
+	lsd := NewLSD(transport, client.peerPort)
+	lsd.Add(client.metaInfo.InfoHash, func(peer *Peer) {
+		log.Printf("lsd found peer %s", peerAddr(peer))
+		client.addPeer(peer, false)
+	})
+	lsd.Run(cancelChan)
+}
+
+// FetchPeersFromDHT 启动DHT节点, bootstrap后定期查询并announce自己
+func (client *Client) FetchPeersFromDHT(cancelChan chan struct{}) {
+	dht, err := NewDHT(DHTConfig{
+		Addr:           fmt.Sprintf(":%d", client.config.DHTPort),
+		StateFile:      client.config.DHTStateFile,
+		BootstrapNodes: client.config.DHTBootstrapNodes,
+	})
 	if err != nil {
-		log.Println("warning: request " + trackerUrl + " failed, error: " + err.Error())
+		log.Println("warning: start dht failed, error: " + err.Error())
+		return
+	}
+	client.mu.Lock()
+	client.dht = dht
+	client.mu.Unlock()
+	go func() {
+		<-cancelChan
+		dht.Close()
+	}()
+
+	dht.Bootstrap()
+	for {
+		peers := dht.Announce(client.metaInfo.InfoHash, client.peerPort)
+		log.Printf("dht found %d peers, routing table nodes: %d", len(peers), dht.NodeNum())
+		for i := range peers {
+			client.addPeer(&peers[i], true)
+		}
+		select {
+		case <-cancelChan:
+			return
+		case <-time.After(client.config.DHTAnnounceEvery):
+		}
+	}
+}
+
+// addDHTNode 把peer通过Port消息通告的DHT节点加入路由表
+func (client *Client) addDHTNode(peer *Peer, port int) {
+	client.mu.Lock()
+	dht := client.dht
+	client.mu.Unlock()
+	if dht == nil {
+		return
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(peer.IP), Port: port}
+	if addr.IP.To4() == nil {
 		return
 	}
-	for i, _ := range res.Peers {
-		client.peerChan <- &res.Peers[i]
+	go func() {
+		if err := dht.AddNode(addr); err != nil {
+			log.Println("Error adding dht node ", addr, ": ", err)
+		}
+	}()
+}
+
+// FetchPeersFromTracker 周期性向tracker announce, 失败时指数退避重试
+func (client *Client) FetchPeersFromTracker(trackerUrl string, cancelChan chan struct{}) {
+	trackerClient := NewTrackerClient(trackerUrl, client.metaInfo.InfoHash, client.peerId,
+		client.peerPort, 0, 0, client.metaInfo.Info.Length, 1, 50, "started")
+	status := client.trackerStatus(trackerUrl)
+	for {
+		trackerClient.left = client.left()
+		res, err := trackerClient.Announce()
+
+		var wait time.Duration
+		client.mu.Lock()
+		status.LastAnnounce = time.Now()
+		if err != nil {
+			status.Failures++
+			status.LastError = err.Error()
+			if res != nil && res.WarningMessage != "" {
+				status.Warning = res.WarningMessage
+			}
+			wait = trackerRetryDelay(status.Failures)
+		} else {
+			status.Failures = 0
+			status.LastError = ""
+			status.Warning = res.WarningMessage
+			status.Peers = len(res.Peers)
+			// 后续的定期announce不带event
+			trackerClient.event = ""
+			wait = time.Duration(res.Interval) * time.Second
+			if minInterval := time.Duration(res.MinInterval) * time.Second; wait < minInterval {
+				wait = minInterval
+			}
+			if wait <= 0 {
+				wait = defaultTrackerInterval
+			}
+		}
+		status.NextAnnounce = time.Now().Add(wait)
+		client.mu.Unlock()
+
+		if err != nil {
+			log.Println("warning: request " + trackerUrl + " failed, error: " + err.Error() + ", retry in " + wait.String())
+		} else {
+			if res.WarningMessage != "" {
+				log.Println("warning: tracker " + trackerUrl + " says: " + res.WarningMessage)
+			}
+			for i := range res.Peers {
+				client.addPeer(&res.Peers[i], true)
+			}
+		}
+
+		select {
+		case <-cancelChan:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (client *Client) trackerStatus(trackerUrl string) *TrackerStatus {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	status := client.trackers[trackerUrl]
+	if status == nil {
+		status = &TrackerStatus{Url: trackerUrl}
+		client.trackers[trackerUrl] = status
+	}
+	return status
+}
+
+// GetTrackerStatus 返回所有tracker的状态副本, 包括最近的错误和警告
+func (client *Client) GetTrackerStatus() []TrackerStatus {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	statuses := make([]TrackerStatus, 0, len(client.trackers))
+	for _, status := range client.trackers {
+		statuses = append(statuses, *status)
 	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Url < statuses[j].Url
+	})
+	return statuses
+}
+
+// left 需要的文件中剩余的字节数
+func (client *Client) left() int {
+	downloaded, all := client.wantedBytes()
+	return all - downloaded
 }
 
 func (client *Client) DownloadFromPeer(Id int) {
 	for {
 		peer := <-client.peerChan
-		downloader, err := NewDownloader(peer, client.handShakeMsg, client.bitField, Id)
+		downloader, err := NewDownloader(peer, client.handShakeMsg, client.advertisedBitfield(), client.pieceNum, Id, client.extensions, client.dialer)
 		log.Println("new downloader ", Id)
 		if err != nil {
+			client.recordPeerError(err)
+			continue
+		}
+		if err := client.registerDownloader(downloader); err != nil {
+			log.Println("drop connection to ", peerAddr(peer), ": ", err)
+			downloader.conn.Close()
 			continue
 		}
-		client.peers[Id] = peer
-		client.wg.Add(1)
-		err = downloader.Download(client.downloadChan, client.saveChan, client.fallbackChan, client.cancelChan)
-		client.wg.Done()
-		delete(client.peers, Id)
+		err = client.runDownloader(downloader)
 		if err != nil {
 			log.Println("downloader error ", err)
 			continue
@@ -189,34 +486,246 @@ func (client *Client) DownloadFromPeer(Id int) {
 	}
 }
 
-func (client *Client) SendDownloadTask() {
-	defer client.wg.Done()
+// acceptPeer 回复被动连接的握手, 之后与主动连接一样运行downloader
+func (client *Client) acceptPeer(conn net.Conn, handshake *PeerHandshake) error {
+	client.mu.Lock()
+	ip, port := remoteHostPort(conn)
+	err := client.checkPeerLocked(handshake.PeerId, ip)
+	id := client.nextDownloaderId
+	client.nextDownloaderId++
+	client.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(client.handShakeMsg); err != nil {
+		return err
+	}
 
-	for i := 0; i < client.pieceNum; i++ {
-		bitFiledIndex := i / 8
-		bitFiledOffset := i % 8
-		if client.bitField[bitFiledIndex]&(1<<uint(7-bitFiledOffset)) == 0 {
-			var pieceLength int
-			if i == client.pieceNum-1 {
-				pieceLength = client.metaInfo.Info.Length % client.metaInfo.Info.PieceLength
-			} else {
-				pieceLength = client.metaInfo.Info.PieceLength
-			}
-			for len(client.fallbackChan) > 0 {
-				client.downloadChan <- <-client.fallbackChan
+	peer := &Peer{PeerId: handshake.PeerId, IP: ip, Port: port}
+	downloader, err := newDownloaderFromConn(conn, peer, handshake, client.advertisedBitfield(), client.pieceNum, id, client.extensions)
+	if err != nil {
+		client.recordPeerError(err)
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	downloader.inbound = true
+	if err := client.registerDownloader(downloader); err != nil {
+		return err
+	}
+	log.Println("accepted peer ", peerAddr(peer), " as downloader ", id)
+	go client.runDownloader(downloader)
+	return nil
+}
+
+// checkPeerLocked 拒绝连接自己, 被封禁的IP, 重复的peer id和超出上限的连接, 调用方需持有锁
+func (client *Client) checkPeerLocked(peerId string, ip string) error {
+	if peerId == client.peerId {
+		return errSelfConnection
+	}
+	if client.bans.Banned(ip) {
+		return errBannedPeer
+	}
+	for _, downloader := range client.downloaders {
+		if downloader.peerId == peerId {
+			return errDuplicatePeer
+		}
+	}
+	// 主动和被动连接共用MaxConnections上限
+	if len(client.downloaders) >= client.config.MaxConnections {
+		return errTooManyConnections
+	}
+	return nil
+}
+
+func (client *Client) registerDownloader(downloader *Downloader) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if err := client.checkPeerLocked(downloader.peerId, downloader.peer.IP); err != nil {
+		return err
+	}
+	client.peers[downloader.Id] = downloader.peer
+	client.downloaders[downloader.Id] = downloader
+	return nil
+}
+
+// runDownloader 运行downloader直到连接断开或停止, 下载完成后继续做种
+func (client *Client) runDownloader(downloader *Downloader) error {
+	downloader.storage = client
+	downloader.queueDepth = client.config.RequestQueueDepth
+	downloader.requestTimeout = client.config.RequestTimeout
+	client.mu.Lock()
+	if client.dht != nil {
+		downloader.dhtPort = client.dht.Addr().Port
+	}
+	client.mu.Unlock()
+	downloader.onPort = client.addDHTNode
+	// 握手后立即收到的Port消息在设置onPort之前已经处理
+	if downloader.peerDHTPort != 0 {
+		client.addDHTNode(downloader.peer, downloader.peerDHTPort)
+	}
+	downloader.suppressHaves = client.config.SuppressHaves
+	// 连接建立期间保存的piece和lazy bitfield隐藏的piece用Have补发
+	var missed []int
+	client.servableBitfield().Difference(downloader.advertised).ForEach(func(index int) {
+		missed = append(missed, index)
+	})
+	downloader.notifyHave(missed...)
+	err := downloader.Download(client, client.saveChan, client.cancelChan)
+	client.recordPeerError(err)
+	client.mu.Lock()
+	delete(client.peers, downloader.Id)
+	delete(client.downloaders, downloader.Id)
+	client.mu.Unlock()
+	return err
+}
+
+// advertisedBitfield 握手后发送给对方的bitfield, LazyBitfield时随机隐藏最多lazyBitfieldPieces个piece
+func (client *Client) advertisedBitfield() *Bitfield {
+	bitfield := client.servableBitfield()
+	if !client.config.LazyBitfield {
+		return bitfield
+	}
+	var pieces []int
+	bitfield.ForEach(func(index int) { pieces = append(pieces, index) })
+	rand.Shuffle(len(pieces), func(i, j int) { pieces[i], pieces[j] = pieces[j], pieces[i] })
+	if len(pieces) > lazyBitfieldPieces {
+		pieces = pieces[:lazyBitfieldPieces]
+	}
+	for _, index := range pieces {
+		bitfield.Clear(index)
+	}
+	return bitfield
+}
+
+// recordPeerError 统计因违反协议而断开的连接
+func (client *Client) recordPeerError(err error) {
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		return
+	}
+	log.Println("peer protocol violation: ", err)
+	client.mu.Lock()
+	client.protocolErrors++
+	client.mu.Unlock()
+}
+
+// listen 开始接受其他peer的连接, 端口为0时使用系统分配的端口
+func (client *Client) listen() error {
+	if client.config.Listener != nil {
+		client.listener = client.config.Listener
+		client.listener.Register(client)
+		return nil
+	}
+	listener, err := NewPeerListener(fmt.Sprintf(":%d", client.peerPort))
+	if err != nil {
+		return err
+	}
+	client.listener = listener
+	client.peerPort = listener.Addr().Port
+	client.extensions.listenPort = client.peerPort
+	listener.Register(client)
+	go listener.Serve()
+	if client.config.Transport != TransportTCP {
+		// uTP与TCP使用相同的端口号
+		socket, err := ListenUTP(fmt.Sprintf(":%d", client.peerPort))
+		if err != nil {
+			log.Println("warning: listen utp failed, error: ", err)
+			return nil
+		}
+		client.dialer.UTP = socket
+		go listener.ServeUTP(socket)
+	}
+	return nil
+}
+
+func (client *Client) Interesting(bitfield *Bitfield) *Bitfield {
+	return client.scheduler.Interesting(bitfield)
+}
+
+func (client *Client) Wanted(index int) bool {
+	return client.scheduler.Wanted(index)
+}
+
+func (client *Client) RequestBlocks(downloaderId int, bitfield *Bitfield, n int) []blockRequest {
+	return client.scheduler.RequestBlocks(downloaderId, bitfield, n)
+}
+
+func (client *Client) BlockReceived(downloaderId int, req blockRequest, data []byte) (*SavePieceTask, error) {
+	return client.scheduler.BlockReceived(downloaderId, req, data)
+}
+
+func (client *Client) AbortBlocks(downloaderId int, reqs []blockRequest) {
+	client.scheduler.AbortBlocks(downloaderId, reqs)
+}
+
+// cancelDuplicate 通知其他downloader取消endgame中重复的请求
+func (client *Client) cancelDuplicate(downloaderId int, req blockRequest) {
+	client.mu.Lock()
+	downloader := client.downloaders[downloaderId]
+	client.mu.Unlock()
+	if downloader != nil {
+		downloader.notifyDuplicate(req)
+	}
+}
+
+// peerIP 提供分片的peer按IP记录信任分
+func (client *Client) peerIP(downloaderId int) string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if downloader := client.downloaders[downloaderId]; downloader != nil {
+		return downloader.peer.IP
+	}
+	return ""
+}
+
+// pieceVerified 更新提供过分片的peer的信任分, 断开新封禁的peer
+func (client *Client) pieceVerified(contributors []string, ok bool) {
+	ips := make([]string, 0, len(contributors))
+	for _, ip := range contributors {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	for _, ip := range client.bans.PieceVerified(ips, ok) {
+		log.Println("ban peer ", ip, " for sending corrupt data")
+		for _, downloader := range client.activeDownloaders() {
+			if downloader.peer.IP == ip {
+				downloader.conn.Close()
 			}
-			client.downloadChan <- DownloadPieceTask{i, pieceLength, client.metaInfo.Info.Pieces[i]}
 		}
 	}
+}
+
+func (client *Client) AddPeer(bitfield *Bitfield) {
+	client.picker.AddPeer(bitfield)
+}
+
+func (client *Client) RemovePeer(bitfield *Bitfield) {
+	client.picker.RemovePeer(bitfield)
+}
 
-	for failTask := range client.fallbackChan {
-		client.downloadChan <- failTask
+func (client *Client) PeerHave(index int) {
+	client.picker.PeerHave(index)
+}
+
+func (client *Client) Finished() <-chan struct{} {
+	return client.finishedChan
+}
+
+func (client *Client) pieceTask(index int) DownloadPieceTask {
+	return DownloadPieceTask{index, client.pieceLength(index), client.metaInfo.Info.Pieces[index]}
+}
+
+func (client *Client) pieceLength(index int) int {
+	if index == client.pieceNum-1 {
+		return client.metaInfo.Info.Length - index*client.metaInfo.Info.PieceLength
 	}
+	return client.metaInfo.Info.PieceLength
 }
 
 func (client *Client) GetDownloadProcess() map[string]string {
 	info := make(map[string]string)
-	downloadedBytes := client.savedNum * client.metaInfo.Info.PieceLength
+	downloadedBytes, all := client.wantedBytes()
 	if downloadedBytes < 1024 {
 		info["downloaded"] = strconv.Itoa(downloadedBytes) + "B"
 	} else if downloadedBytes < 1024*1024 {
@@ -226,7 +735,6 @@ func (client *Client) GetDownloadProcess() map[string]string {
 	} else {
 		info["downloaded"] = fmt.Sprintf("%.1f", float64(downloadedBytes)/float64(1024*1024*1024)) + "GB"
 	}
-	all := client.metaInfo.Info.Length
 	if all < 1024 {
 		info["all"] = strconv.Itoa(all) + "B"
 	} else if all < 1024*1024 {
@@ -237,22 +745,200 @@ func (client *Client) GetDownloadProcess() map[string]string {
 		info["all"] = fmt.Sprintf("%.1f", float64(all)/float64(1024*1024*1024)) + "GB"
 	}
 	percent := float64(downloadedBytes) / float64(all) * 100
-	if percent-100 > 0 {
+	if all == 0 || percent-100 > 0 {
 		percent = 100
 	}
 	info["percent"] = fmt.Sprintf("%.2f", percent) + "%"
 	info["speed"] = client.speed
+	client.mu.Lock()
+	info["protocol_errors"] = strconv.Itoa(client.protocolErrors)
+	client.mu.Unlock()
 
 	return info
 }
 
+// RegisterExtension 注册一个扩展协议处理器, 需在StartDownload之前调用
+func (client *Client) RegisterExtension(handler ExtensionHandler) {
+	client.extensions.Register(handler)
+}
+
 func (client *Client) GetPeers() map[int]*Peer {
-	return client.peers
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	peers := make(map[int]*Peer, len(client.peers))
+	for id, peer := range client.peers {
+		peers[id] = peer
+	}
+	return peers
+}
+
+// PeerStatus 已连接peer的choke状态和速率
+type PeerStatus struct {
+	Id             int
+	Peer           Peer
+	Client         ClientInfo // 由peer id和扩展握手识别的客户端
+	Inbound        bool
+	Choked         bool // 我们choke对方
+	Interested     bool // 我们对对方感兴趣
+	PeerChoking    bool
+	PeerInterested bool
+	DownloadRate   float64
+	UploadRate     float64
+	Trust          int // 校验通过的piece加分, 失败扣分
+}
+
+func (client *Client) GetPeerStatus() []PeerStatus {
+	downloaders := client.activeDownloaders()
+	statuses := make([]PeerStatus, 0, len(downloaders))
+	for _, downloader := range downloaders {
+		state := downloader.State()
+		stats := client.choker.Stats(downloader)
+		v := ""
+		if handshake := downloader.ExtendedHandshake(); handshake != nil {
+			v = handshake.V
+		}
+		statuses = append(statuses, PeerStatus{
+			Id:             downloader.Id,
+			Peer:           *downloader.peer,
+			Client:         IdentifyClient(downloader.peerId, v),
+			Inbound:        downloader.inbound,
+			Choked:         state.am_choking,
+			Interested:     state.am_interested,
+			PeerChoking:    state.peer_choking,
+			PeerInterested: state.peer_interested,
+			DownloadRate:   stats.DownloadRate,
+			UploadRate:     stats.UploadRate,
+			Trust:          client.bans.Trust(downloader.peer.IP),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Id < statuses[j].Id })
+	return statuses
+}
+
+// activeDownloaders 返回当前已连接的downloader
+func (client *Client) activeDownloaders() []*Downloader {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	downloaders := make([]*Downloader, 0, len(client.downloaders))
+	for _, downloader := range client.downloaders {
+		downloaders = append(downloaders, downloader)
+	}
+	return downloaders
+}
+
+// addPeer 去重后把peer交给DownloadFromPeer
+// wait为false时peerChan满了就丢弃, 用于PEX等不能阻塞的来源
+func (client *Client) addPeer(peer *Peer, wait bool) bool {
+	if client.bans.Banned(peer.IP) {
+		return false
+	}
+	addr := peerAddr(peer)
+	now := time.Now()
+	client.mu.Lock()
+	for _, connected := range client.peers {
+		if peerAddr(connected) == addr {
+			client.mu.Unlock()
+			return false
+		}
+	}
+	if offered, ok := client.knownPeers[addr]; ok && now.Sub(offered) < peerRetryInterval {
+		client.mu.Unlock()
+		return false
+	}
+	if len(client.knownPeers) >= maxKnownPeers {
+		for key, offered := range client.knownPeers {
+			if now.Sub(offered) >= peerRetryInterval {
+				delete(client.knownPeers, key)
+			}
+		}
+		if len(client.knownPeers) >= maxKnownPeers {
+			client.mu.Unlock()
+			return false
+		}
+	}
+	client.knownPeers[addr] = now
+	client.mu.Unlock()
+
+	if wait {
+		select {
+		case client.peerChan <- peer:
+			return true
+		case <-client.cancelChan:
+			return false
+		}
+	}
+	select {
+	case client.peerChan <- peer:
+		return true
+	default:
+		// 没有空闲的downloader, 允许之后重新加入
+		client.mu.Lock()
+		delete(client.knownPeers, addr)
+		client.mu.Unlock()
+		return false
+	}
 }
 
 func (client *Client) Stop() {
 	close(client.cancelChan)
+	client.mu.Lock()
+	client.pieceCond.Broadcast()
+	client.mu.Unlock()
+	if client.listener != nil {
+		if client.listener == client.config.Listener {
+			client.listener.Unregister(client.metaInfo.InfoHash)
+		} else {
+			client.listener.Close()
+		}
+	}
 	time.Sleep(time.Second * 3)
+	client.mu.Lock()
+	if client.storage != nil {
+		client.storage.Close()
+		client.storage = nil
+	}
+	client.mu.Unlock()
+}
+
+// HavePiece piece已保存且数据完整, 可以上传
+func (client *Client) HavePiece(index int) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.bitField.Has(index) && !client.discarded.Has(index)
+}
+
+// servableBitfield 可以上传的piece, 不包括数据被丢弃的piece
+func (client *Client) servableBitfield() *Bitfield {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.bitField.Snapshot().Difference(client.discarded)
+}
+
+// ReadBlock 读取已保存的piece中的一段, 用于做种, 数据被丢弃的piece不能上传
+func (client *Client) ReadBlock(index, begin, length int) ([]byte, error) {
+	if !client.HavePiece(index) {
+		return nil, fmt.Errorf("piece %d not downloaded", index)
+	}
+	return client.readSaved(index, begin, length)
+}
+
+// readSaved 读取已保存的piece中的一段, 只检查bitfield
+// 本地读取只读需要的文件所在的范围, 不会读到被丢弃的数据
+func (client *Client) readSaved(index, begin, length int) ([]byte, error) {
+	if !client.bitField.Has(index) {
+		return nil, fmt.Errorf("piece %d not downloaded", index)
+	}
+	pieceLength := client.pieceLength(index)
+	if begin < 0 || length <= 0 || begin+length > pieceLength {
+		return nil, fmt.Errorf("block %d+%d out of piece %d", begin, length, index)
+	}
+	client.mu.Lock()
+	storage := client.storage
+	client.mu.Unlock()
+	if storage == nil {
+		return nil, errors.New("storage closed")
+	}
+	return storage.ReadBlock(index, begin, length)
 }
 
 func (client *Client) calcSpeed() {
@@ -307,15 +993,3 @@ func randomString(n int, allowedChars ...[]rune) string {
 
 	return string(b)
 }
-
-func calcSavedNum(bitField []byte, pieceNum int) int {
-	savedNum := 0
-	for i := 0; i < pieceNum; i++ {
-		bitFiledIndex := i / 8
-		bitFiledOffset := i % 8
-		if bitField[bitFiledIndex]&(1<<uint(7-bitFiledOffset)) == 1<<uint(7-bitFiledOffset) {
-			savedNum++
-		}
-	}
-	return savedNum
-}
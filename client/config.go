@@ -0,0 +1,67 @@
+package client
+
+import "time"
+
+var defaultDHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	PeerIdPrefix   string // Azureus风格的peer id前缀, 为空时使用-JB0001-
+	DownloaderNum  int
+	PeerPort       int              // 监听端口, 为0时由系统分配
+	MaxConnections int              // 主动和被动连接的总数上限
+	Listener       *PeerListener    // 多个Client共用监听端口时设置, 为nil时自己监听PeerPort
+	Encryption     EncryptionPolicy // 主动连接的加密策略, require时也拒绝明文的被动连接
+	Transport      TransportPolicy  // 主动连接使用的传输, 不为tcp时同时在PeerPort上监听uTP
+
+	UploadSlots     int            // 常规unchoke的peer数量
+	OptimisticSlots int            // optimistic unchoke的peer数量
+	ChokeAlgorithm  ChokeAlgorithm // 为nil时使用TitForTat
+
+	PiecePicker       PiecePicker   // 为nil时使用RarestFirstPicker
+	Sequential        bool          // 整个torrent按顺序下载, 需要picker支持StreamingPicker
+	StreamWindow      int           // 流式下载时读取位置之后优先下载的piece数
+	RequestQueueDepth int           // 每个peer同时请求的分片数, 不超过对方的reqq
+	RequestTimeout    time.Duration // 超时的请求会被取消并重新请求
+	BanListFile       string        // 封禁的IP持久化文件, 为空时不保存
+	LazyBitfield      bool          // 初始bitfield中隐藏部分已有的piece, 之后用Have发送
+	SuppressHaves     bool          // 不向已经拥有该piece的peer发送Have
+
+	DHTEnabled        bool
+	DHTPort           int // 启用uTP时与PeerPort相同则改用下一个端口
+	DHTBootstrapNodes []string
+	DHTStateFile      string        // 路由表持久化文件, 为空时不保存
+	DHTAnnounceEvery  time.Duration // 向DHT重新查询和announce的间隔
+
+	PEXEnabled bool
+
+	LSDEnabled   bool
+	LSDTransport LSDTransport // 为nil时加入BEP 14的组播组
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PeerIdPrefix:      defaultPeerIdPrefix,
+		DownloaderNum:     64,
+		PeerPort:          6881,
+		MaxConnections:    100,
+		Encryption:        EncryptionPrefer,
+		Transport:         TransportTCP,
+		UploadSlots:       4,
+		OptimisticSlots:   1,
+		StreamWindow:      defaultStreamWindow,
+		RequestQueueDepth: defaultRequestQueueDepth,
+		RequestTimeout:    defaultRequestTimeout,
+		BanListFile:       bitfieldDir + "/banned.list",
+		DHTEnabled:        true,
+		DHTPort:           6881,
+		DHTBootstrapNodes: defaultDHTBootstrapNodes,
+		DHTStateFile:      bitfieldDir + "/dht.state",
+		DHTAnnounceEvery:  15 * time.Minute,
+		PEXEnabled:        true,
+		LSDEnabled:        true,
+	}
+}
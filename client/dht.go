@@ -0,0 +1,640 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	dhtAlpha          = 3 // 迭代查询的并发数
+	dhtQueryTimeout   = 2 * time.Second
+	dhtMaxLookupRound = 16
+	dhtSecretRotate   = 5 * time.Minute
+	dhtPeerTTL        = 30 * time.Minute
+	dhtMaxPeersReply  = 50
+	dhtRefreshEvery   = time.Minute
+	dhtTidLength      = 4
+	// peerStore的上限, 满了之后淘汰最早过期的info_hash或peer
+	dhtMaxInfoHashes  = 2000
+	dhtMaxStoredPeers = 200
+)
+
+// reserved[7]的0x01表示支持DHT, 握手后可以发送Port消息
+const (
+	dhtReservedByte = 7
+	dhtReservedBit  = 0x01
+)
+
+var errDHTClosed = errors.New("dht closed")
+
+func supportsDHT(reserved [8]byte) bool {
+	return reserved[dhtReservedByte]&dhtReservedBit != 0
+}
+
+type DHTConfig struct {
+	Addr           string // UDP监听地址, 如 ":6881"
+	StateFile      string // 为空时不持久化
+	BootstrapNodes []string
+	QueryTimeout   time.Duration
+}
+
+// DHT 是一个Mainline DHT节点 (BEP 5), 同时作为KRPC客户端和服务端
+type DHT struct {
+	conn      *net.UDPConn
+	table     *routingTable
+	config    DHTConfig
+	mu        sync.Mutex
+	pending   map[string]*dhtQuery // key为transaction id
+	secret    []byte
+	oldSecret []byte
+	peerStore map[string]map[string]time.Time // info_hash -> 紧凑peer -> 过期时间
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// dhtQuery 等待响应的查询, 只接受来自addr的响应
+type dhtQuery struct {
+	addr    *net.UDPAddr
+	resChan chan *krpcMessage
+}
+
+type dhtLookupResult struct {
+	peers  []Peer
+	tokens map[*dhtNode]string // 返回了token的节点
+}
+
+func NewDHT(config DHTConfig) (*DHT, error) {
+	if config.QueryTimeout <= 0 {
+		config.QueryTimeout = dhtQueryTimeout
+	}
+	addr, err := net.ResolveUDPAddr("udp4", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	id := randomNodeId()
+	var savedNodes []*dhtNode
+	if config.StateFile != "" {
+		if savedId, nodes, err := loadRoutingState(config.StateFile); err == nil {
+			id = savedId
+			savedNodes = nodes
+		}
+	}
+
+	dht := &DHT{
+		conn:      conn,
+		table:     newRoutingTable(id),
+		config:    config,
+		pending:   make(map[string]*dhtQuery),
+		secret:    randomSecret(),
+		peerStore: make(map[string]map[string]time.Time),
+		closed:    make(chan struct{}),
+	}
+	dht.oldSecret = dht.secret
+	for _, node := range savedNodes {
+		dht.table.addUnverified(node)
+	}
+	go dht.readLoop()
+	go dht.maintain()
+	return dht, nil
+}
+
+func (dht *DHT) Id() string {
+	return dht.table.id
+}
+
+func (dht *DHT) Addr() *net.UDPAddr {
+	return dht.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NodeNum 路由表中的节点数
+func (dht *DHT) NodeNum() int {
+	return dht.table.size()
+}
+
+func (dht *DHT) Close() error {
+	var err error
+	dht.closeOnce.Do(func() {
+		close(dht.closed)
+		if dht.config.StateFile != "" {
+			if saveErr := dht.table.save(dht.config.StateFile); saveErr != nil {
+				log.Println("Error saving dht state: ", saveErr)
+			}
+		}
+		err = dht.conn.Close()
+	})
+	return err
+}
+
+// Bootstrap 向bootstrap节点和持久化的节点查询自身id附近的节点
+func (dht *DHT) Bootstrap() {
+	for _, hostport := range dht.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", hostport)
+		if err != nil {
+			log.Println("Error resolving dht bootstrap node: ", err)
+			continue
+		}
+		nodes, err := dht.FindNode(addr, dht.Id())
+		if err != nil {
+			log.Println("Error querying dht bootstrap node: ", err)
+			continue
+		}
+		for _, node := range nodes {
+			dht.table.addUnverified(node)
+		}
+	}
+	dht.lookupNodes(dht.Id())
+	log.Println("dht bootstrap finished, nodes: ", dht.NodeNum())
+}
+
+// AddNode 尝试将一个已知地址的节点加入路由表, 例如peer通过Port消息通告的DHT端口
+func (dht *DHT) AddNode(addr *net.UDPAddr) error {
+	_, err := dht.Ping(addr)
+	return err
+}
+
+func (dht *DHT) Ping(addr *net.UDPAddr) (string, error) {
+	res, err := dht.query(addr, "ping", map[string]interface{}{"id": dht.Id()})
+	if err != nil {
+		return "", err
+	}
+	id, _ := res.senderId()
+	return id, nil
+}
+
+func (dht *DHT) FindNode(addr *net.UDPAddr, target string) ([]*dhtNode, error) {
+	res, err := dht.query(addr, "find_node", map[string]interface{}{"id": dht.Id(), "target": target})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := dictString(res.R, "nodes")
+	return decodeCompactNodes(nodes)
+}
+
+// GetPeers 向单个节点查询info_hash, 返回peers, 更近的节点和announce用的token
+func (dht *DHT) GetPeers(addr *net.UDPAddr, infoHash string) ([]Peer, []*dhtNode, string, error) {
+	res, err := dht.query(addr, "get_peers", map[string]interface{}{"id": dht.Id(), "info_hash": infoHash})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	token, _ := dictString(res.R, "token")
+	peers := make([]Peer, 0)
+	if values, ok := dictList(res.R, "values"); ok {
+		for _, value := range values {
+			compact, _ := value.(string)
+			if peer, ok := decodeCompactPeer(compact); ok {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	compactNodes, _ := dictString(res.R, "nodes")
+	nodes, err := decodeCompactNodes(compactNodes)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return peers, nodes, token, nil
+}
+
+func (dht *DHT) AnnouncePeer(addr *net.UDPAddr, infoHash string, port int, token string) error {
+	_, err := dht.query(addr, "announce_peer", map[string]interface{}{
+		"id":        dht.Id(),
+		"info_hash": infoHash,
+		"port":      port,
+		"token":     token,
+	})
+	return err
+}
+
+// FindPeers 迭代查询距离info_hash最近的节点, 返回找到的peers
+func (dht *DHT) FindPeers(infoHash string) []Peer {
+	return dht.lookup(infoHash, true).peers
+}
+
+// Announce 查找info_hash并向最近的返回了token的节点announce自己的端口, 返回查询到的peers
+func (dht *DHT) Announce(infoHash string, port int) []Peer {
+	result := dht.lookup(infoHash, true)
+	nodes := make([]*dhtNode, 0, len(result.tokens))
+	for node := range result.tokens {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(infoHash, nodes[i].id, nodes[j].id)
+	})
+	if len(nodes) > dhtBucketSize {
+		nodes = nodes[:dhtBucketSize]
+	}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *dhtNode) {
+			defer wg.Done()
+			if err := dht.AnnouncePeer(node.addr, infoHash, port, result.tokens[node]); err != nil {
+				log.Println("Error announcing to dht node: ", err)
+			}
+		}(node)
+	}
+	wg.Wait()
+	return result.peers
+}
+
+func (dht *DHT) lookupNodes(target string) {
+	dht.lookup(target, false)
+}
+
+// lookup Kademlia迭代查询, getPeers为false时只使用find_node
+func (dht *DHT) lookup(target string, getPeers bool) *dhtLookupResult {
+	result := &dhtLookupResult{tokens: make(map[*dhtNode]string)}
+	seenPeers := make(map[string]bool)
+	candidates := dht.table.closest(target, dhtBucketSize)
+	known := make(map[string]bool)
+	for _, node := range candidates {
+		known[node.addr.String()] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	var mu sync.Mutex
+	for round := 0; round < dhtMaxLookupRound; round++ {
+		// 只从最近的K个可用节点中选择未查询过的
+		toQuery := make([]*dhtNode, 0, dhtAlpha)
+		usable := 0
+		for _, node := range candidates {
+			if usable >= dhtBucketSize || len(toQuery) >= dhtAlpha {
+				break
+			}
+			if failed[node.addr.String()] {
+				continue
+			}
+			usable++
+			if !queried[node.addr.String()] {
+				queried[node.addr.String()] = true
+				toQuery = append(toQuery, node)
+			}
+		}
+		if len(toQuery) == 0 {
+			break
+		}
+
+		found := make([]*dhtNode, 0)
+		var wg sync.WaitGroup
+		for _, node := range toQuery {
+			wg.Add(1)
+			go func(node *dhtNode) {
+				defer wg.Done()
+				var peers []Peer
+				var nodes []*dhtNode
+				var token string
+				var err error
+				if getPeers {
+					peers, nodes, token, err = dht.GetPeers(node.addr, target)
+				} else {
+					nodes, err = dht.FindNode(node.addr, target)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed[node.addr.String()] = true
+					return
+				}
+				if token != "" {
+					result.tokens[node] = token
+				}
+				for _, peer := range peers {
+					key := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+					if !seenPeers[key] {
+						seenPeers[key] = true
+						result.peers = append(result.peers, peer)
+					}
+				}
+				found = append(found, nodes...)
+			}(node)
+		}
+		wg.Wait()
+
+		for _, node := range found {
+			if node.id == dht.Id() || known[node.addr.String()] {
+				continue
+			}
+			known[node.addr.String()] = true
+			candidates = append(candidates, node)
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].id, candidates[j].id)
+		})
+	}
+	return result
+}
+
+// query 发送查询并等待响应, 超时或出错时在路由表中记录失败
+func (dht *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (*krpcMessage, error) {
+	// 随机的transaction id, 防止伪造的响应
+	tidBytes := make([]byte, dhtTidLength)
+	resChan := make(chan *krpcMessage, 1)
+	dht.mu.Lock()
+	tid := ""
+	for tid == "" || dht.pending[tid] != nil {
+		rand.Read(tidBytes)
+		tid = string(tidBytes)
+	}
+	dht.pending[tid] = &dhtQuery{addr: addr, resChan: resChan}
+	dht.mu.Unlock()
+
+	defer func() {
+		dht.mu.Lock()
+		delete(dht.pending, tid)
+		dht.mu.Unlock()
+	}()
+
+	msg := &krpcMessage{T: tid, Y: "q", Q: method, A: args}
+	if err := dht.send(addr, msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(dht.config.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-resChan:
+		if res.Y == "e" {
+			return nil, res.err()
+		}
+		return res, nil
+	case <-timer.C:
+		dht.markFailed(addr)
+		return nil, errors.New("dht query " + method + " to " + addr.String() + " timed out")
+	case <-dht.closed:
+		return nil, errDHTClosed
+	}
+}
+
+func (dht *DHT) markFailed(addr *net.UDPAddr) {
+	for _, node := range dht.table.closest(dht.Id(), dhtBucketNum*dhtBucketSize) {
+		if node.addr.String() == addr.String() {
+			dht.table.failed(node.id)
+			return
+		}
+	}
+}
+
+func (dht *DHT) send(addr *net.UDPAddr, msg *krpcMessage) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	_, err = dht.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (dht *DHT) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := dht.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-dht.closed:
+				return
+			default:
+				log.Println("Error reading from dht socket: ", err)
+				continue
+			}
+		}
+		msg, err := decodeKrpcMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			dht.handleQuery(addr, msg)
+		case "r", "e":
+			// 只有对应我们发出的查询、来自被查询地址的响应才被接受
+			dht.mu.Lock()
+			query := dht.pending[msg.T]
+			if query != nil && query.addr.IP.Equal(addr.IP) && query.addr.Port == addr.Port {
+				delete(dht.pending, msg.T)
+			} else {
+				query = nil
+			}
+			dht.mu.Unlock()
+			if query == nil {
+				continue
+			}
+			if id, ok := msg.senderId(); ok {
+				dht.table.insert(id, addr, time.Now())
+			}
+			select {
+			case query.resChan <- msg:
+			default:
+			}
+		}
+	}
+}
+
+func (dht *DHT) handleQuery(addr *net.UDPAddr, msg *krpcMessage) {
+	id, ok := msg.senderId()
+	if !ok {
+		dht.sendError(addr, msg.T, krpcProtocolError, "invalid id")
+		return
+	}
+	// 只读节点(BEP 43)不加入路由表
+	if readOnly, _ := dictInt(msg.A, "ro"); readOnly != 1 {
+		dht.table.insert(id, addr, time.Now())
+	}
+
+	res := map[string]interface{}{"id": dht.Id()}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, ok := dictString(msg.A, "target")
+		if !ok || len(target) != 20 {
+			dht.sendError(addr, msg.T, krpcProtocolError, "invalid target")
+			return
+		}
+		res["nodes"] = encodeCompactNodes(dht.table.closest(target, dhtBucketSize))
+	case "get_peers":
+		infoHash, ok := dictString(msg.A, "info_hash")
+		if !ok || len(infoHash) != 20 {
+			dht.sendError(addr, msg.T, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		res["token"] = dht.token(addr.IP, dht.currentSecret())
+		if values := dht.storedPeers(infoHash); len(values) > 0 {
+			res["values"] = values
+		} else {
+			res["nodes"] = encodeCompactNodes(dht.table.closest(infoHash, dhtBucketSize))
+		}
+	case "announce_peer":
+		infoHash, ok := dictString(msg.A, "info_hash")
+		if !ok || len(infoHash) != 20 {
+			dht.sendError(addr, msg.T, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		token, _ := dictString(msg.A, "token")
+		if !dht.validToken(addr.IP, token) {
+			dht.sendError(addr, msg.T, krpcProtocolError, "bad token")
+			return
+		}
+		port, _ := dictInt(msg.A, "port")
+		if impliedPort, _ := dictInt(msg.A, "implied_port"); impliedPort == 1 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			dht.sendError(addr, msg.T, krpcProtocolError, "invalid port")
+			return
+		}
+		dht.storePeer(infoHash, addr.IP, port)
+	default:
+		dht.sendError(addr, msg.T, krpcMethodUnknown, "method unknown")
+		return
+	}
+	dht.send(addr, &krpcMessage{T: msg.T, Y: "r", R: res})
+}
+
+func (dht *DHT) sendError(addr *net.UDPAddr, tid string, code int, message string) {
+	dht.send(addr, &krpcMessage{T: tid, Y: "e", E: []interface{}{code, message}})
+}
+
+func (dht *DHT) currentSecret() []byte {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	return dht.secret
+}
+
+// token = sha1(ip + secret), 当前和上一个secret生成的token都有效
+func (dht *DHT) token(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte{}, ip.To16()...), secret...))
+	return string(hash[:8])
+}
+
+func (dht *DHT) validToken(ip net.IP, token string) bool {
+	dht.mu.Lock()
+	secret, oldSecret := dht.secret, dht.oldSecret
+	dht.mu.Unlock()
+	return token != "" && (token == dht.token(ip, secret) || token == dht.token(ip, oldSecret))
+}
+
+func (dht *DHT) storePeer(infoHash string, ip net.IP, port int) {
+	compact := encodeCompactPeer(ip, port)
+	if compact == "" {
+		return
+	}
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	now := time.Now()
+	peers := dht.peerStore[infoHash]
+	if peers == nil {
+		if len(dht.peerStore) >= dhtMaxInfoHashes {
+			dht.evictInfoHashLocked(now)
+		}
+		peers = make(map[string]time.Time)
+		dht.peerStore[infoHash] = peers
+	}
+	if _, ok := peers[compact]; !ok && len(peers) >= dhtMaxStoredPeers {
+		evictOldest(peers)
+	}
+	peers[compact] = now.Add(dhtPeerTTL)
+}
+
+// evictInfoHashLocked 删除过期的peer和空的info_hash, 仍然满时删除最久没有announce的info_hash
+func (dht *DHT) evictInfoHashLocked(now time.Time) {
+	oldest := ""
+	var oldestExpire time.Time
+	for infoHash, peers := range dht.peerStore {
+		var latest time.Time
+		for compact, expire := range peers {
+			if now.After(expire) {
+				delete(peers, compact)
+			} else if expire.After(latest) {
+				latest = expire
+			}
+		}
+		if len(peers) == 0 {
+			delete(dht.peerStore, infoHash)
+			continue
+		}
+		if oldest == "" || latest.Before(oldestExpire) {
+			oldest, oldestExpire = infoHash, latest
+		}
+	}
+	if len(dht.peerStore) >= dhtMaxInfoHashes {
+		delete(dht.peerStore, oldest)
+	}
+}
+
+// evictOldest 删除最早过期的peer
+func evictOldest(peers map[string]time.Time) {
+	oldest := ""
+	var oldestExpire time.Time
+	for compact, expire := range peers {
+		if oldest == "" || expire.Before(oldestExpire) {
+			oldest, oldestExpire = compact, expire
+		}
+	}
+	delete(peers, oldest)
+}
+
+func (dht *DHT) storedPeers(infoHash string) []interface{} {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	values := make([]interface{}, 0)
+	now := time.Now()
+	for compact, expire := range dht.peerStore[infoHash] {
+		if now.After(expire) {
+			delete(dht.peerStore[infoHash], compact)
+			continue
+		}
+		if len(values) < dhtMaxPeersReply {
+			values = append(values, compact)
+		}
+	}
+	return values
+}
+
+// maintain 定期轮换token secret, 刷新不活跃的bucket并保存路由表
+func (dht *DHT) maintain() {
+	rotate := time.NewTicker(dhtSecretRotate)
+	refresh := time.NewTicker(dhtRefreshEvery)
+	defer rotate.Stop()
+	defer refresh.Stop()
+	for {
+		select {
+		case <-dht.closed:
+			return
+		case <-rotate.C:
+			dht.mu.Lock()
+			dht.oldSecret = dht.secret
+			dht.secret = randomSecret()
+			dht.mu.Unlock()
+		case <-refresh.C:
+			for _, index := range dht.table.staleBuckets(time.Now()) {
+				dht.lookupNodes(dht.table.randomIdInBucket(index))
+			}
+			if dht.config.StateFile != "" {
+				if err := dht.table.save(dht.config.StateFile); err != nil {
+					log.Println("Error saving dht state: ", err)
+				}
+			}
+		}
+	}
+}
+
+func randomNodeId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return string(id)
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return secret
+}
@@ -0,0 +1,248 @@
+package client
+
+import (
+	"errors"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dhtBucketSize    = 8 // K
+	dhtBucketNum     = 160
+	dhtMaxNodeFails  = 2
+	dhtQuestionAfter = 15 * time.Minute
+)
+
+type dhtNode struct {
+	id       string
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// good 最近15分钟内有响应且没有连续失败
+func (node *dhtNode) good(now time.Time) bool {
+	return node.failures == 0 && now.Sub(node.lastSeen) < dhtQuestionAfter
+}
+
+// routingTable 按与自身id的公共前缀长度划分的k-bucket
+type routingTable struct {
+	mu      sync.Mutex
+	id      string
+	buckets [dhtBucketNum][]*dhtNode // 每个bucket按lastSeen从旧到新排列
+}
+
+func newRoutingTable(id string) *routingTable {
+	return &routingTable{id: id}
+}
+
+// closer 判断a是否比b更接近target
+func closer(target, a, b string) bool {
+	for i := 0; i < 20; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func commonPrefixLen(a, b string) int {
+	for i := 0; i < 20; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return dhtBucketNum
+}
+
+func (table *routingTable) bucketIndex(id string) int {
+	index := commonPrefixLen(table.id, id)
+	if index >= dhtBucketNum {
+		index = dhtBucketNum - 1
+	}
+	return index
+}
+
+// insert 添加或刷新节点, 返回节点是否在路由表中
+func (table *routingTable) insert(id string, addr *net.UDPAddr, now time.Time) bool {
+	if len(id) != 20 || id == table.id {
+		return false
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	index := table.bucketIndex(id)
+	bucket := table.buckets[index]
+	for i, node := range bucket {
+		if node.id == id {
+			node.addr = addr
+			node.lastSeen = now
+			node.failures = 0
+			// 移到末尾, 保持LRU顺序
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return true
+		}
+	}
+	node := &dhtNode{id: id, addr: addr, lastSeen: now}
+	if len(bucket) < dhtBucketSize {
+		table.buckets[index] = append(bucket, node)
+		return true
+	}
+	// bucket已满, 替换掉一个失败过或长时间没有响应的节点
+	for i, old := range bucket {
+		if !old.good(now) {
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return true
+		}
+	}
+	return false
+}
+
+// addUnverified 加载持久化节点或bootstrap结果时使用, lastSeen为零值
+func (table *routingTable) addUnverified(node *dhtNode) {
+	if len(node.id) != 20 || node.id == table.id {
+		return
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	index := table.bucketIndex(node.id)
+	for _, existing := range table.buckets[index] {
+		if existing.id == node.id {
+			return
+		}
+	}
+	if len(table.buckets[index]) < dhtBucketSize {
+		table.buckets[index] = append([]*dhtNode{{id: node.id, addr: node.addr}}, table.buckets[index]...)
+	}
+}
+
+// failed 记录一次查询超时, 失败过多的节点被移除
+func (table *routingTable) failed(id string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	index := table.bucketIndex(id)
+	bucket := table.buckets[index]
+	for i, node := range bucket {
+		if node.id == id {
+			node.failures++
+			if node.failures >= dhtMaxNodeFails {
+				table.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest 返回距离target最近的n个节点
+func (table *routingTable) closest(target string, n int) []*dhtNode {
+	table.mu.Lock()
+	nodes := make([]*dhtNode, 0, n)
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, &dhtNode{id: node.id, addr: node.addr, lastSeen: node.lastSeen, failures: node.failures})
+		}
+	}
+	table.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].id, nodes[j].id)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (table *routingTable) size() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	size := 0
+	for _, bucket := range table.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+// staleBuckets 返回一段时间内没有节点活动的非空bucket下标, 用于刷新
+func (table *routingTable) staleBuckets(now time.Time) []int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	stale := make([]int, 0)
+	for i, bucket := range table.buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		if now.Sub(bucket[len(bucket)-1].lastSeen) > dhtQuestionAfter {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// randomIdInBucket 生成与自身id恰好有index位公共前缀的随机id
+func (table *routingTable) randomIdInBucket(index int) string {
+	id := []byte(randomNodeId())
+	for i := 0; i < index/8; i++ {
+		id[i] = table.id[i]
+	}
+	byteIndex := index / 8
+	if byteIndex < 20 {
+		bit := byte(0x80) >> uint(index%8)
+		keepMask := ^(bit<<1 - 1) // index位之前的位
+		b := table.id[byteIndex]&keepMask | id[byteIndex]&(bit-1)
+		id[byteIndex] = b | (^table.id[byteIndex] & bit)
+	}
+	return string(id)
+}
+
+// save 持久化自身id和路由表中的节点
+func (table *routingTable) save(path string) error {
+	nodes := table.closest(table.id, dhtBucketNum*dhtBucketSize)
+	data, err := Bencode(map[string]interface{}{
+		"id":    table.id,
+		"nodes": encodeCompactNodes(nodes),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadRoutingState 读取持久化的id和节点
+func loadRoutingState(path string) (string, []*dhtNode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := DecodeBencode(data)
+	if err != nil {
+		return "", nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return "", nil, errors.New("invalid dht state")
+	}
+	id, ok := dictString(dict, "id")
+	if !ok || len(id) != 20 {
+		return "", nil, errors.New("invalid dht state id")
+	}
+	compactNodes, _ := dictString(dict, "nodes")
+	nodes, err := decodeCompactNodes(compactNodes)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, nodes, nil
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDHTs(t *testing.T, n int, stateFile string) []*DHT {
+	nodes := make([]*DHT, 0, n)
+	first, err := NewDHT(DHTConfig{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Error starting dht node: ", err)
+	}
+	nodes = append(nodes, first)
+	for i := 1; i < n; i++ {
+		config := DHTConfig{
+			Addr:           "127.0.0.1:0",
+			BootstrapNodes: []string{first.Addr().String()},
+			QueryTimeout:   500 * time.Millisecond,
+		}
+		if i == n-1 {
+			config.StateFile = stateFile
+		}
+		node, err := NewDHT(config)
+		if err != nil {
+			t.Fatal("Error starting dht node: ", err)
+		}
+		node.Bootstrap()
+		nodes = append(nodes, node)
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	})
+	return nodes
+}
+
+func TestDHTAnnounceAndFindPeers(t *testing.T) {
+	nodes := newTestDHTs(t, 6, "")
+	infoHash := "cccccccccccccccccccc"
+
+	nodes[2].Announce(infoHash, 7000)
+	peers := nodes[5].FindPeers(infoHash)
+	found := false
+	for _, peer := range peers {
+		if peer.IP == "127.0.0.1" && peer.Port == 7000 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected to find announced peer 127.0.0.1:7000, got ", peers)
+	}
+	if nodes[0].NodeNum() < 5 {
+		t.Error("Expected bootstrap node to know all other nodes, got ", nodes[0].NodeNum())
+	}
+}
+
+func TestDHTRejectsBadToken(t *testing.T) {
+	nodes := newTestDHTs(t, 2, "")
+	err := nodes[1].AnnouncePeer(nodes[0].Addr(), "cccccccccccccccccccc", 7000, "bad token")
+	var krpcErr *KrpcError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != krpcProtocolError {
+		t.Error("Expected protocol error for bad token, got ", err)
+	}
+
+	_, _, token, err := nodes[1].GetPeers(nodes[0].Addr(), "cccccccccccccccccccc")
+	if err != nil {
+		t.Fatal("Error sending get_peers: ", err)
+	}
+	if err := nodes[1].AnnouncePeer(nodes[0].Addr(), "cccccccccccccccccccc", 7000, token); err != nil {
+		t.Error("Expected announce with a valid token to succeed, got ", err)
+	}
+}
+
+func TestDHTRoutingTablePersistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "dht.state")
+	nodes := newTestDHTs(t, 4, stateFile)
+	saved := nodes[3]
+	id := saved.Id()
+	saved.Close()
+
+	restored, err := NewDHT(DHTConfig{Addr: "127.0.0.1:0", StateFile: stateFile})
+	if err != nil {
+		t.Fatal("Error starting dht node: ", err)
+	}
+	defer restored.Close()
+	if restored.Id() != id {
+		t.Error("Expected restored node to keep its id")
+	}
+	if restored.NodeNum() != 3 {
+		t.Error("Expected 3 restored nodes, got ", restored.NodeNum())
+	}
+}
+
+func TestRoutingTableRandomIdInBucket(t *testing.T) {
+	table := newRoutingTable(randomNodeId())
+	for _, index := range []int{0, 1, 7, 8, 63, 159} {
+		id := table.randomIdInBucket(index)
+		if commonPrefixLen(table.id, id) != index {
+			t.Errorf("Expected common prefix %d, got %d", index, commonPrefixLen(table.id, id))
+		}
+	}
+}
+
+func TestKrpcMessageRoundTrip(t *testing.T) {
+	msg := &krpcMessage{T: "aa", Y: "q", Q: "get_peers", A: map[string]interface{}{"id": "abcdefghij0123456789", "info_hash": "mnopqrstuvwxyz123456"}}
+	data, err := msg.encode()
+	if err != nil {
+		t.Fatal("Error encoding krpc message: ", err)
+	}
+	expected := "d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe"
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+	decoded, err := decodeKrpcMessage(data)
+	if err != nil {
+		t.Fatal("Error decoding krpc message: ", err)
+	}
+	if id, ok := decoded.senderId(); !ok || id != "abcdefghij0123456789" || decoded.Q != "get_peers" {
+		t.Error("Unexpected decoded message: ", decoded)
+	}
+}
+
+func TestDHTIgnoresUnsolicitedResponses(t *testing.T) {
+	node := newTestDHTs(t, 1, "")[0]
+	spoofer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Error listening udp: ", err)
+	}
+	defer spoofer.Close()
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	resChan := make(chan *krpcMessage, 1)
+	node.mu.Lock()
+	node.pending["tid1"] = &dhtQuery{addr: other, resChan: resChan}
+	node.pending["tid2"] = &dhtQuery{addr: spoofer.LocalAddr().(*net.UDPAddr), resChan: resChan}
+	node.mu.Unlock()
+
+	reply := func(tid string, id string) {
+		data, _ := (&krpcMessage{T: tid, Y: "r", R: map[string]interface{}{"id": id}}).encode()
+		spoofer.WriteToUDP(data, node.Addr())
+	}
+	// 没有对应的查询, 或者不是来自被查询的地址
+	reply("none", "aaaaaaaaaaaaaaaaaaaa")
+	reply("tid1", "bbbbbbbbbbbbbbbbbbbb")
+	reply("tid2", "cccccccccccccccccccc")
+	select {
+	case res := <-resChan:
+		if id, _ := res.senderId(); id != "cccccccccccccccccccc" {
+			t.Error("Expected only the matching response, got ", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected matching response to be delivered")
+	}
+	if n := node.NodeNum(); n != 1 {
+		t.Error("Expected only the responding node in the routing table, got ", n)
+	}
+}
+
+func TestDHTPeerStoreLimits(t *testing.T) {
+	node := newTestDHTs(t, 1, "")[0]
+	for port := 1; port <= dhtMaxStoredPeers+10; port++ {
+		node.storePeer("cccccccccccccccccccc", net.IPv4(10, 0, 0, 1), port)
+	}
+	if n := len(node.storedPeers("cccccccccccccccccccc")); n > dhtMaxPeersReply || len(node.peerStore["cccccccccccccccccccc"]) != dhtMaxStoredPeers {
+		t.Error("Expected stored peers to be capped, got ", len(node.peerStore["cccccccccccccccccccc"]))
+	}
+	for i := 0; i < dhtMaxInfoHashes+10; i++ {
+		node.storePeer(fmt.Sprintf("%020d", i), net.IPv4(10, 0, 0, 1), 6881)
+	}
+	if n := len(node.peerStore); n != dhtMaxInfoHashes {
+		t.Error("Expected info hashes to be capped, got ", n)
+	}
+	if _, ok := node.peerStore[fmt.Sprintf("%020d", dhtMaxInfoHashes+9)]; !ok {
+		t.Error("Expected the newest info hash to be kept")
+	}
+}
@@ -2,20 +2,64 @@ package client
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Downloader struct {
-	bitfield []byte
+	bitfield *Bitfield
 	conn     net.Conn
+	wire     *peerIO // conn上的缓冲读写
 	state    *State
+	stateMu  sync.Mutex // 只有Download所在的goroutine修改state, 修改和外部读取时加锁
 	Id       int
 	finished bool
+	peer     *Peer
+	peerId   string
+	inbound  bool    // 对方主动连接
+	reserved [8]byte // 对方握手中的保留位
+	writeMu  sync.Mutex
+	pieceNum int
+	infoHash string
+
+	fast            bool         // 双方都支持fast extension
+	allowedFast     map[int]bool // 对方允许我们在被choke时请求的piece
+	suggested       map[int]bool // 对方建议下载的piece
+	allowedFastSent map[int]bool // 我们允许对方在被choke时请求的piece
+
+	extensions        *ExtensionRegistry
+	extMu             sync.RWMutex
+	remoteExtensions  map[string]int
+	extendedHandshake *ExtendedHandshake
+
+	storage    pieceReader    // 为nil时不上传
+	uploads    []blockRequest // 对方请求的、尚未发送的分片
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	chokeChan  chan bool // Choker的决定, 由Download循环执行
+	source     pieceSource
+	haveMu     sync.Mutex
+	haves      []int                      // 已保存、尚未通知对方的piece
+	haveReady  chan struct{}              // haves不为空
+	duplicates chan blockRequest          // endgame中已由其他peer收到的分片
+	pending    map[blockRequest]time.Time // 已请求的分片 -> 请求时间
+
+	queueDepth     int           // 同时请求的分片数上限, 为0时使用默认值
+	requestTimeout time.Duration // 为0时使用默认值
+
+	dhtPort     int                        // 为0时不发送Port消息
+	onPort      func(peer *Peer, port int) // 对方通告了DHT端口
+	peerDHTPort int                        // onPort设置之前收到的Port消息, 之后补发
+
+	advertised    *Bitfield // 已经通过bitfield或Have告诉对方的piece
+	interesting   *Bitfield // 对方拥有、我们还需要的piece, 不为空时interested
+	suppressHaves bool      // 不向已经拥有该piece的peer发送Have
 }
 
 type State struct {
@@ -25,18 +69,30 @@ type State struct {
 	peer_interested bool
 }
 
-func NewDownloader(peer *Peer, handShakeMsg []byte, bitfield []byte, Id int) (*Downloader, error) {
-	conn, err := Connect(peer)
+// PeerHandshake 对方握手消息中的内容
+type PeerHandshake struct {
+	Reserved [8]byte
+	InfoHash string
+	PeerId   string
+}
+
+func NewDownloader(peer *Peer, handShakeMsg []byte, bitfield *Bitfield, pieceNum int, Id int, extensions *ExtensionRegistry, dialer *PeerDialer) (*Downloader, error) {
+	conn, err := dialer.Dial(peer, string(handShakeMsg[28:48]))
 	if err != nil {
 		log.Println("Error connecting to peer: ", err)
 		return nil, err
 	}
-	err = HandShake(peer, handShakeMsg, conn)
+	handshake, err := HandShake(peer, handShakeMsg, conn)
 	if err != nil {
 		log.Println("Error handshaking with peer: ", err)
+		conn.Close()
 		return nil, err
 	}
+	return newDownloaderFromConn(conn, peer, handshake, bitfield, pieceNum, Id, extensions)
+}
 
+// newDownloaderFromConn 在握手完成后交换bitfield, 主动和被动连接共用
+func newDownloaderFromConn(conn net.Conn, peer *Peer, handshake *PeerHandshake, bitfield *Bitfield, pieceNum int, Id int, extensions *ExtensionRegistry) (*Downloader, error) {
 	state := &State{
 		am_choking:      true,
 		am_interested:   false,
@@ -44,26 +100,48 @@ func NewDownloader(peer *Peer, handShakeMsg []byte, bitfield []byte, Id int) (*D
 		peer_interested: false,
 	}
 
-	sendBitfield(conn, bitfield)
+	downloader := &Downloader{
+		conn:       conn,
+		wire:       newPeerIO(conn),
+		state:      state,
+		Id:         Id,
+		finished:   false,
+		peer:       peer,
+		peerId:     handshake.PeerId,
+		reserved:   handshake.Reserved,
+		pieceNum:   pieceNum,
+		infoHash:   handshake.InfoHash,
+		extensions: extensions,
+		chokeChan:  make(chan bool, 1),
+		haveReady:  make(chan struct{}, 1),
+		duplicates: make(chan blockRequest, duplicateChanSize),
 
-	bitfieldMsg, err := getBitfield(conn, state)
-	if err != nil {
-		log.Println("Error getting bitfield from peer: ", err)
+		fast:            supportsFastExtension(handshake.Reserved),
+		allowedFast:     make(map[int]bool),
+		suggested:       make(map[int]bool),
+		allowedFastSent: make(map[int]bool),
+	}
+
+	// 扩展握手需要在bitfield之后发送, 但必须在其他消息之前
+	downloader.advertised = bitfield.Clone()
+	if err := downloader.sendHaves(bitfield); err != nil {
+		log.Println("Error sending bitfield to peer: ", err)
+		conn.Close()
+		return nil, err
+	}
+	if err := downloader.sendExtendedHandshake(); err != nil {
+		log.Println("Error sending extended handshake to peer: ", err)
+		conn.Close()
 		return nil, err
 	}
 
-	if err != nil {
-		log.Println("Error sending interested to peer: ", err)
+	if err := downloader.getBitfield(); err != nil {
+		log.Println("Error getting bitfield from peer: ", err)
+		conn.Close()
 		return nil, err
 	}
 
-	return &Downloader{
-		bitfield: bitfieldMsg.payload,
-		conn:     conn,
-		state:    state,
-		Id:       Id,
-		finished: false,
-	}, nil
+	return downloader, nil
 }
 
 func Connect(server *Peer) (net.Conn, error) {
@@ -78,240 +156,625 @@ func Connect(server *Peer) (net.Conn, error) {
 	return conn, nil
 }
 
-func HandShake(server *Peer, handShakeMsg []byte, conn net.Conn) error {
+func HandShake(server *Peer, handShakeMsg []byte, conn net.Conn) (*PeerHandshake, error) {
 	_, err := conn.Write(handShakeMsg)
 	if err != nil {
 		log.Println("Error writing handshake: ", err)
-		return fmt.Errorf("could not send handshake message: %s", err)
+		return nil, fmt.Errorf("could not send handshake message: %s", err)
 	}
 
 	resp := make([]byte, 68)
 	n, err := io.ReadFull(conn, resp)
 	if err != nil {
 		log.Println("Error reading handshake: ", err)
-		return err
+		return nil, err
 	}
 	if n != 68 {
-		return fmt.Errorf("handshake response is not 68 bytes")
+		return nil, fmt.Errorf("handshake response is not 68 bytes")
 	}
 
 	if !bytes.Equal(resp[0:20], handShakeMsg[0:20]) ||
 		!bytes.Equal(resp[28:48], handShakeMsg[28:48]) ||
 		(server.PeerId != "" && !bytes.Equal(resp[48:68], []byte(server.PeerId))) {
-		return fmt.Errorf("handshake response: %s is not valid", resp)
+		return nil, fmt.Errorf("handshake response: %s is not valid", resp)
 	}
 
 	log.Println("Handshake successful")
 
-	return nil
+	return parseHandShake(resp)
+}
+
+// ReadHandShake 读取对方主动发送的握手, 用于被动连接
+func ReadHandShake(conn net.Conn) (*PeerHandshake, error) {
+	msg := make([]byte, 68)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	if msg[0] != pstrlen || string(msg[1:20]) != pstr {
+		return nil, fmt.Errorf("handshake: unknown protocol %q", msg[1:20])
+	}
+	return parseHandShake(msg)
+}
+
+func parseHandShake(msg []byte) (*PeerHandshake, error) {
+	if len(msg) != 68 {
+		return nil, fmt.Errorf("handshake is not 68 bytes")
+	}
+	handshake := &PeerHandshake{
+		InfoHash: string(msg[28:48]),
+		PeerId:   string(msg[48:68]),
+	}
+	copy(handshake.Reserved[:], msg[20:28])
+	return handshake, nil
+}
+
+const (
+	blockLength                 = 16384
+	defaultRequestQueueDepth    = 16
+	defaultRequestTimeout       = 30 * time.Second
+	requestTimeoutCheckInterval = 5 * time.Second
+	duplicateChanSize           = 64
+)
+
+// closedChan 总是可读, 用于在select中表示有待处理的工作
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// pieceSource 以分片为单位分配下载并记录peer拥有的piece, 由Client实现
+type pieceSource interface {
+	// Interesting bitfield中我们还需要的piece
+	Interesting(bitfield *Bitfield) *Bitfield
+	Wanted(index int) bool
+	RequestBlocks(downloaderId int, bitfield *Bitfield, n int) []blockRequest
+	// BlockReceived piece完整且校验通过时返回保存任务
+	BlockReceived(downloaderId int, req blockRequest, data []byte) (*SavePieceTask, error)
+	AbortBlocks(downloaderId int, reqs []blockRequest)
+	AddPeer(bitfield *Bitfield)
+	RemovePeer(bitfield *Bitfield)
+	PeerHave(index int)
+	Finished() <-chan struct{} // 所有piece下载完成后关闭
 }
 
-func (downloader *Downloader) Download(downloadChan <-chan DownloadPieceTask, saveChan chan SavePieceTask,
-	fallbackChan chan DownloadPieceTask, cancelChan <-chan struct{}) error {
+// Download 下载source分配的分片, 同时响应对方的请求
+// 下载完成后继续做种, 直到连接断开或cancelChan关闭
+func (downloader *Downloader) Download(source pieceSource, saveChan chan SavePieceTask, cancelChan <-chan struct{}) error {
 	defer downloader.conn.Close()
-	go downloader.Keepalive()
+	if downloader.wire == nil {
+		downloader.wire = newPeerIO(downloader.conn)
+	}
+	if downloader.advertised == nil {
+		downloader.advertised = NewBitfield(downloader.pieceNum)
+	}
+	downloader.source = source
+	downloader.interesting = source.Interesting(downloader.bitfield)
+	downloader.pending = make(map[blockRequest]time.Time)
+	source.AddPeer(downloader.bitfield)
+	// 断开时未收到的分片交给其他peer, 已收到的分片保留
+	defer func() {
+		downloader.abortPending()
+		source.RemovePeer(downloader.bitfield)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	msgChan, errChan := downloader.startReading(done)
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	requestTimeout := time.NewTicker(requestTimeoutCheckInterval)
+	defer requestTimeout.Stop()
+	// 当前没有可下载的分片时定期重新选择
+	pickRetry := time.NewTicker(time.Second)
+	defer pickRetry.Stop()
+	finished := source.Finished()
+	if err := downloader.sendAllowedFast(); err != nil {
+		log.Println("Error sending allowed fast: ", err)
+		return err
+	}
+	if err := downloader.sendPort(); err != nil {
+		log.Println("Error sending port: ", err)
+		return err
+	}
+
+	for {
+		// 上一轮写入的消息一起发送
+		if err := downloader.flush(); err != nil {
+			log.Println("Error sending messages: ", err)
+			return err
+		}
+		var uploadReady chan struct{}
+		if len(downloader.uploads) > 0 {
+			uploadReady = closedChan
+		}
 
-	for task := range downloadChan {
 		select {
 		case <-cancelChan:
 			return nil
-		default:
-			log.Println("Downloading piece: ", task.PieceIndex)
-			if (downloader.bitfield[task.PieceIndex/8] & (1 << uint(7-(task.PieceIndex%8)))) == 0 {
-				log.Println("Peer does not have piece: ", task)
-				fallbackChan <- task
-				continue
+		case err := <-errChan:
+			log.Println("Error reading message: ", err)
+			return err
+		case <-keepalive.C:
+			if err := downloader.sendKeepalive(); err != nil {
+				log.Printf("Error sending keepalive: %s", err)
+				return err
 			}
-			sendInterested(downloader.conn)
-			downloader.state.am_interested = true
-			for downloader.state.peer_choking {
-				log.Printf("Downloader %d is choking, waiting for unchoke", downloader.Id)
-				msg, err := ReadMessageFrom(downloader.conn)
-				if err != nil {
-					log.Println("Error reading message: ", err)
-					fallbackChan <- task
-					return err
-				}
-				switch msg.typeId {
-				case Unchoke:
-					downloader.state.peer_choking = false
-				case Choke:
-					downloader.state.peer_choking = true
-				case Have:
-					index := int(msg.payload[0])<<24 | int(msg.payload[1])<<16 | int(msg.payload[2])<<8 | int(msg.payload[3])
-					downloader.bitfield[index/8] |= 1 << uint(7-(index%8))
-				}
+		case now := <-requestTimeout.C:
+			if err := downloader.expireRequests(now); err != nil {
+				log.Println("Error sending cancel: ", err)
+				return err
 			}
-			log.Println("Starting download of piece: ", task.PieceIndex)
-			piece := make([]byte, task.PieceLength)
-			slicebegin := 0
-			slicelength := 16384
-
-			sliceNum := task.PieceLength/slicelength + 1
-
-			for slicebegin < task.PieceLength {
-				slicebeginSend := slicebegin
-				slicelengthSend := slicelength
-				for i := 0; i < sliceNum; i++ {
-					if slicebeginSend < task.PieceLength {
-						if slicebeginSend+slicelengthSend > task.PieceLength {
-							slicelengthSend = task.PieceLength - slicebeginSend
-						}
-						err := sendRequest(downloader.conn, task.PieceIndex, slicebeginSend, slicelengthSend)
-						if err != nil {
-							log.Println("Error sending request: ", err)
-							fallbackChan <- task
-							return err
-						}
-						slicebeginSend += slicelengthSend
-					} else {
-						break
-					}
-				}
-				for i := 0; i < sliceNum; i++ {
-					if slicebegin < task.PieceLength {
-						for pieceMsg := false; !pieceMsg; {
-							msg, err := ReadMessageFrom(downloader.conn)
-							if err != nil {
-								log.Println("Error reading message: ", err)
-								fallbackChan <- task
-								return err
-							}
-							switch msg.typeId {
-							case Piece:
-								pieceIndex := uint32(BytesToInt32(msg.payload[0:4]))
-								begin := uint32(BytesToInt32(msg.payload[4:8]))
-								slice := msg.payload[8:]
-								if pieceIndex != uint32(task.PieceIndex) {
-									log.Println("Error: piece index does not match")
-									continue
-								} else if begin != uint32(slicebegin) {
-									log.Println("Error: begin does not match")
-									continue
-								}
-								copy(piece[slicebegin:], slice)
-								slicebegin += len(slice)
-								log.Printf("Downloaded slice of piece %d, slice begin:%d, slice length: %dB\n", task.PieceIndex, slicebegin, slicelength)
-								pieceMsg = true
-							}
-						}
-					} else {
-						break
+		case <-finished:
+			log.Printf("downloader %d work done, seeding.\n", downloader.Id)
+			finished = nil
+			downloader.finished = true
+		case <-pickRetry.C:
+			// 文件优先级可能已经改变
+			downloader.interesting = source.Interesting(downloader.bitfield)
+		case <-downloader.haveReady:
+			if err := downloader.handleHaves(); err != nil {
+				log.Println("Error sending have: ", err)
+				return err
+			}
+		case block := <-downloader.duplicates:
+			if err := downloader.cancelPending(func(req blockRequest) bool { return req == block }); err != nil {
+				return err
+			}
+		case msg := <-msgChan:
+			if msg.typeId == Piece {
+				saveTask := downloader.handlePiece(msg)
+				msg.Release()
+				if saveTask != nil {
+					log.Println("Downloaded piece: ", saveTask.PieceIndex)
+					select {
+					case saveChan <- *saveTask:
+					case <-cancelChan:
 					}
 				}
+			} else if err := downloader.handleMessage(msg); err != nil {
+				log.Println("Error handling message: ", err)
+				return err
+			}
+		case choke := <-downloader.chokeChan:
+			if err := downloader.applyChoke(choke); err != nil {
+				log.Println("Error sending choke: ", err)
+				return err
+			}
+		case <-uploadReady:
+			if err := downloader.serveRequest(); err != nil {
+				log.Println("Error serving request: ", err)
+				return err
+			}
+		}
+
+		// 对方拥有我们需要的piece时才能被unchoke
+		if err := downloader.updateInterest(); err != nil {
+			log.Println("Error sending interest: ", err)
+			return err
+		}
+		if downloader.finished {
+			continue
+		}
+		// 被choke后之前的请求会被丢弃, unchoke后重新分配
+		// fast extension中对方会拒绝请求, 并允许请求allowed fast集合中的piece
+		if downloader.state.peer_choking && !downloader.fast {
+			downloader.abortPending()
+			continue
+		}
+		if err := downloader.requestBlocks(); err != nil {
+			log.Println("Error sending request: ", err)
+			return err
+		}
+	}
+}
+
+// startReading 在单独的goroutine中读取消息, 连接出错时通过errChan返回
+func (downloader *Downloader) startReading(done <-chan struct{}) (<-chan *Message, <-chan error) {
+	msgChan := make(chan *Message, 16)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := downloader.wire.ReadMessage()
+			if err != nil {
+				errChan <- err
+				return
 			}
-			downloadPieceHash := sha1.Sum(piece)
-			if !bytes.Equal(downloadPieceHash[:], task.PieceHash[:]) {
-				log.Println("Error: piece hash does not match")
-				fallbackChan <- task
+			if msg.IsKeepalive() {
 				continue
 			}
-			log.Println("Downloaded piece: ", task.PieceIndex)
-			saveChan <- SavePieceTask{PieceIndex: task.PieceIndex, Piece: piece}
+			select {
+			case msgChan <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return msgChan, errChan
+}
+
+// requestQueueDepth 同时请求的分片数, 不超过对方扩展握手中的reqq
+func (downloader *Downloader) requestQueueDepth() int {
+	depth := downloader.queueDepth
+	if depth <= 0 {
+		depth = defaultRequestQueueDepth
+	}
+	if handshake := downloader.ExtendedHandshake(); handshake != nil && handshake.Reqq > 0 && handshake.Reqq < depth {
+		depth = handshake.Reqq
+	}
+	return depth
+}
+
+// requestBlocks 向source申请分片, 直到填满请求队列
+// 被choke时只请求allowed fast的piece, 优先请求对方建议的piece
+func (downloader *Downloader) requestBlocks() error {
+	n := downloader.requestQueueDepth() - len(downloader.pending)
+	if n <= 0 {
+		return nil
+	}
+	bitfield := downloader.bitfield
+	if downloader.state.peer_choking {
+		bitfield = maskBitfield(bitfield, downloader.allowedFast)
+	}
+	reqs := make([]blockRequest, 0, n)
+	if len(downloader.suggested) > 0 {
+		reqs = downloader.source.RequestBlocks(downloader.Id, maskBitfield(bitfield, downloader.suggested), n)
+	}
+	if len(reqs) < n {
+		reqs = append(reqs, downloader.source.RequestBlocks(downloader.Id, bitfield, n-len(reqs))...)
+	}
+	for i, req := range reqs {
+		if err := downloader.sendRequest(req.index, req.begin, req.length); err != nil {
+			downloader.source.AbortBlocks(downloader.Id, reqs[i:])
+			return err
 		}
+		downloader.pending[req] = time.Now()
 	}
-	log.Printf("downloader %d work done.\n", downloader.Id)
-	downloader.finished = true
 	return nil
 }
 
-func (downloader *Downloader) Keepalive() error {
-	for !downloader.finished {
-		time.Sleep(30 * time.Second)
-		err := SendKeepalive(downloader.conn)
-		if err != nil {
-			log.Printf("Error sending keepalive: %s", err)
+// expireRequests 取消超时的请求, 分片交给source重新分配
+func (downloader *Downloader) expireRequests(now time.Time) error {
+	timeout := downloader.requestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	expired := make([]blockRequest, 0)
+	for req, requested := range downloader.pending {
+		if now.Sub(requested) >= timeout {
+			log.Printf("downloader %d request of piece %d block %d timed out", downloader.Id, req.index, req.begin)
+			expired = append(expired, req)
+		}
+	}
+	for _, req := range expired {
+		delete(downloader.pending, req)
+		if err := downloader.sendCancel(req.index, req.begin, req.length); err != nil {
+			downloader.source.AbortBlocks(downloader.Id, expired)
 			return err
 		}
 	}
+	downloader.source.AbortBlocks(downloader.Id, expired)
 	return nil
 }
 
-func sendBitfield(conn net.Conn, bitfield []byte) error {
-	msg := Message{
-		typeId:  Bitfield,
-		payload: bitfield,
+// cancelPending 取消已经由其他peer完成的请求
+func (downloader *Downloader) cancelPending(match func(req blockRequest) bool) error {
+	for req := range downloader.pending {
+		if !match(req) {
+			continue
+		}
+		delete(downloader.pending, req)
+		if err := downloader.sendCancel(req.index, req.begin, req.length); err != nil {
+			return err
+		}
 	}
-	_, err := msg.WriteTo(conn)
-	return err
+	return nil
 }
 
-func getBitfield(conn net.Conn, state *State) (*Message, error) {
-	for {
-		bitfieldMsg, err := ReadMessageFrom(conn)
-		if err != nil {
-			return nil, err
+// abortPending 放弃所有未完成的请求
+func (downloader *Downloader) abortPending() {
+	if len(downloader.pending) == 0 {
+		return
+	}
+	reqs := make([]blockRequest, 0, len(downloader.pending))
+	for req := range downloader.pending {
+		reqs = append(reqs, req)
+	}
+	downloader.pending = make(map[blockRequest]time.Time)
+	downloader.source.AbortBlocks(downloader.Id, reqs)
+}
+
+// notifyHave 通知downloader该piece已经保存, 由Download循环取消请求并发送Have
+func (downloader *Downloader) notifyHave(indexes ...int) {
+	downloader.haveMu.Lock()
+	downloader.haves = append(downloader.haves, indexes...)
+	downloader.haveMu.Unlock()
+	select {
+	case downloader.haveReady <- struct{}{}:
+	default:
+	}
+}
+
+// handleHaves 取消对已保存piece的请求, 并向对方发送Have
+func (downloader *Downloader) handleHaves() error {
+	downloader.haveMu.Lock()
+	haves := downloader.haves
+	downloader.haves = nil
+	downloader.haveMu.Unlock()
+	for _, index := range haves {
+		if err := downloader.cancelPending(func(req blockRequest) bool { return req.index == index }); err != nil {
+			return err
 		}
-		switch bitfieldMsg.typeId {
-		case Bitfield:
-			return bitfieldMsg, nil
-		case Unchoke:
-			state.peer_choking = false
-		default:
+		downloader.interesting.Clear(index)
+		if downloader.advertised.Has(index) || (downloader.suppressHaves && downloader.bitfield.Has(index)) {
 			continue
 		}
+		if err := downloader.sendHave(index); err != nil {
+			return err
+		}
+		downloader.advertised.Set(index)
 	}
+	return nil
 }
 
-// func sendBitfield(conn net.Conn) error {
-// 	bitfieldMsg := NewMessage(Bitfield, client.bitfield)
-// 	_, err := bitfieldMsg.WriteTo(conn)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-func sendInterested(conn net.Conn) error {
-	interestedMsg := NewMessage(Interested, nil)
-	_, err := interestedMsg.WriteTo(conn)
+// updateInterest interesting集合从空变为非空或者相反时发送Interested/NotInterested
+func (downloader *Downloader) updateInterest() error {
+	interested := downloader.interesting.Count() > 0
+	if interested == downloader.state.am_interested {
+		return nil
+	}
+	var err error
+	if interested {
+		err = downloader.sendInterested()
+	} else {
+		err = downloader.sendNotInterested()
+	}
 	if err != nil {
 		return err
 	}
+	downloader.updateState(func(state *State) { state.am_interested = interested })
 	return nil
 }
 
-// func sendNotInterested(conn net.Conn) error {
-// 	notInterestedMsg := NewMessage(NotInterested, nil)
-// 	_, err := notInterestedMsg.WriteTo(conn)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-// func sendChoke(conn net.Conn) error {
-// 	chokeMsg := NewMessage(Choke, nil)
-// 	_, err := chokeMsg.WriteTo(conn)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-// func sendUnchoke(conn net.Conn) error {
-// 	unchokeMsg := NewMessage(Unchoke, nil)
-// 	_, err := unchokeMsg.WriteTo(conn)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-func sendRequest(conn net.Conn, index, begin, length int) error {
-	requestMsg := NewRequestMessage(index, begin, length)
-	_, err := requestMsg.WriteTo(conn)
+// notifyDuplicate 通知downloader该分片已由其他peer收到, 队列满时丢弃
+func (downloader *Downloader) notifyDuplicate(req blockRequest) {
+	select {
+	case downloader.duplicates <- req:
+	default:
+	}
+}
+
+// handlePiece 接受任意顺序到达的分片, 没有请求过的分片被丢弃
+func (downloader *Downloader) handlePiece(msg *Message) *SavePieceTask {
+	if len(msg.payload) < 8 {
+		return nil
+	}
+	req := blockRequest{
+		index:  int(BytesToInt32(msg.payload[0:4])),
+		begin:  int(BytesToInt32(msg.payload[4:8])),
+		length: len(msg.payload) - 8,
+	}
+	if _, ok := downloader.pending[req]; !ok {
+		log.Printf("downloader %d unexpected block of piece %d begin %d", downloader.Id, req.index, req.begin)
+		return nil
+	}
+	delete(downloader.pending, req)
+	downloader.downloaded.Add(int64(req.length))
+	log.Printf("Downloaded slice of piece %d, slice begin:%d, slice length: %dB\n", req.index, req.begin, req.length)
+	saveTask, err := downloader.source.BlockReceived(downloader.Id, req, msg.payload[8:])
 	if err != nil {
-		return err
+		log.Printf("downloader %d: %s", downloader.Id, err)
+	}
+	return saveTask
+}
+
+// handleMessage 处理与当前下载步骤无关的消息
+func (downloader *Downloader) handleMessage(msg *Message) error {
+	switch msg.typeId {
+	case Unchoke:
+		downloader.updateState(func(state *State) { state.peer_choking = false })
+	case Choke:
+		downloader.updateState(func(state *State) { state.peer_choking = true })
+	case Interested:
+		downloader.updateState(func(state *State) { state.peer_interested = true })
+	case NotInterested:
+		downloader.updateState(func(state *State) { state.peer_interested = false })
+	case Have:
+		index := int(BytesToInt32(msg.payload))
+		if index >= downloader.pieceNum {
+			return protocolErrorf(msg.typeId, "piece index %d out of range", index)
+		}
+		if downloader.bitfield.Has(index) {
+			return nil
+		}
+		downloader.bitfield.Set(index)
+		if downloader.source != nil {
+			downloader.source.PeerHave(index)
+			if downloader.source.Wanted(index) {
+				downloader.interesting.Set(index)
+			}
+		}
+	case Request:
+		return downloader.handleRequest(msg)
+	case Cancel:
+		return downloader.handleCancel(msg)
+	case SuggestPiece, RejectRequest, AllowedFast:
+		return downloader.handleFastMessage(msg)
+	case BitfieldMessage, HaveAll, HaveNone:
+		return protocolErrorf(msg.typeId, "must be the first message")
+	case Port:
+		port := int(binary.BigEndian.Uint16(msg.payload))
+		if port != 0 && downloader.onPort != nil {
+			downloader.onPort(downloader.peer, port)
+		} else if port != 0 {
+			downloader.peerDHTPort = port
+		}
+	case Extended:
+		return downloader.handleExtended(msg.payload)
 	}
 	return nil
 }
 
-// func sendCancel(conn net.Conn, index, begin, length int) error {
-// 	cancelMsg := NewCancelMessage(index, begin, length)
-// 	_, err := cancelMsg.WriteTo(conn)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
+func (downloader *Downloader) updateState(update func(state *State)) {
+	downloader.stateMu.Lock()
+	defer downloader.stateMu.Unlock()
+	update(downloader.state)
+}
+
+// State 返回当前状态的副本
+func (downloader *Downloader) State() State {
+	downloader.stateMu.Lock()
+	defer downloader.stateMu.Unlock()
+	return *downloader.state
+}
+
+// SetChoking 通知Download循环choke或unchoke对方, 只保留最新的决定
+func (downloader *Downloader) SetChoking(choke bool) {
+	for {
+		select {
+		case downloader.chokeChan <- choke:
+			return
+		default:
+			select {
+			case <-downloader.chokeChan:
+			default:
+			}
+		}
+	}
+}
+
+// applyChoke 状态变化时发送choke或unchoke, choke时丢弃未发送的请求
+func (downloader *Downloader) applyChoke(choke bool) error {
+	if downloader.state.am_choking == choke {
+		return nil
+	}
+	downloader.updateState(func(state *State) { state.am_choking = choke })
+	if choke {
+		if err := downloader.sendChoke(); err != nil {
+			return err
+		}
+		// fast extension中allowed fast的请求继续发送, 其他的明确拒绝
+		uploads := downloader.uploads[:0]
+		for _, req := range downloader.uploads {
+			if downloader.fast && downloader.allowedFastSent[req.index] {
+				uploads = append(uploads, req)
+			} else if err := downloader.sendReject(req); err != nil {
+				return err
+			}
+		}
+		downloader.uploads = uploads
+		return nil
+	}
+	return downloader.sendUnchoke()
+}
+
+func (downloader *Downloader) sendKeepalive() error {
+	return downloader.send(&Message{keepalive: true})
+}
+
+// send 立即发送一条消息, 多个goroutine发送时不会交错
+func (downloader *Downloader) send(msg *Message) error {
+	downloader.writeMu.Lock()
+	defer downloader.writeMu.Unlock()
+	if err := downloader.wire.WriteMessage(msg); err != nil {
+		return err
+	}
+	return downloader.wire.Flush()
+}
+
+// write 只写入缓冲区, 由Download循环在下一轮开始时发送, 只能在Download循环中调用
+func (downloader *Downloader) write(msg *Message) error {
+	downloader.writeMu.Lock()
+	defer downloader.writeMu.Unlock()
+	return downloader.wire.WriteMessage(msg)
+}
+
+func (downloader *Downloader) flush() error {
+	downloader.writeMu.Lock()
+	defer downloader.writeMu.Unlock()
+	return downloader.wire.Flush()
+}
+
+func (downloader *Downloader) sendBitfield(bitfield *Bitfield) error {
+	return downloader.send(NewMessage(BitfieldMessage, bitfield.Bytes()))
+}
+
+// getBitfield 读取对方拥有的piece, bitfield只能是扩展握手之外的第一条消息
+// 没有piece的peer可能不发送bitfield, 此时视为空的bitfield
+func (downloader *Downloader) getBitfield() error {
+	for {
+		msg, err := downloader.wire.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msg.IsKeepalive() {
+			continue
+		}
+		switch msg.typeId {
+		case Extended, Port:
+			if err := downloader.handleMessage(msg); err != nil {
+				return err
+			}
+			continue
+		case BitfieldMessage:
+			bitfield, err := DecodeBitfield(msg.payload, downloader.pieceNum)
+			if err != nil {
+				return err
+			}
+			downloader.bitfield = bitfield
+			return nil
+		case HaveAll, HaveNone:
+			if !downloader.fast {
+				return protocolErrorf(msg.typeId, "without fast extension")
+			}
+			if msg.typeId == HaveAll {
+				downloader.bitfield = FullBitfield(downloader.pieceNum)
+			} else {
+				downloader.bitfield = NewBitfield(downloader.pieceNum)
+			}
+			return nil
+		}
+		if downloader.fast {
+			return protocolErrorf(msg.typeId, "expected bitfield, have all or have none")
+		}
+		downloader.bitfield = NewBitfield(downloader.pieceNum)
+		return downloader.handleMessage(msg)
+	}
+}
+
+// sendPort 对方支持DHT时通告我们的DHT端口
+func (downloader *Downloader) sendPort() error {
+	if downloader.dhtPort == 0 || !supportsDHT(downloader.reserved) {
+		return nil
+	}
+	return downloader.send(NewPortMessage(downloader.dhtPort))
+}
+
+// sendInterested, sendNotInterested和sendHave只写入缓冲, 由Download循环一起发送
+func (downloader *Downloader) sendInterested() error {
+	return downloader.write(NewMessage(Interested, nil))
+}
+
+func (downloader *Downloader) sendNotInterested() error {
+	return downloader.write(NewMessage(NotInterested, nil))
+}
+
+func (downloader *Downloader) sendHave(index int) error {
+	return downloader.write(newIndexMessage(Have, index))
+}
+
+func (downloader *Downloader) sendChoke() error {
+	return downloader.send(NewMessage(Choke, nil))
+}
+
+func (downloader *Downloader) sendUnchoke() error {
+	return downloader.send(NewMessage(Unchoke, nil))
+}
+
+// sendRequest和sendCancel只在Download循环中调用, 同一轮的请求合并发送
+func (downloader *Downloader) sendRequest(index, begin, length int) error {
+	return downloader.write(NewRequestMessage(index, begin, length))
+}
+
+func (downloader *Downloader) sendCancel(index, begin, length int) error {
+	return downloader.write(NewCancelMessage(index, begin, length))
+}
@@ -0,0 +1,333 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakePeer 在本地监听, 模拟远端peer的握手
+type fakePeer struct {
+	listener net.Listener
+	peer     *Peer
+	reserved [8]byte
+	peerId   string
+}
+
+func newFakePeer(t *testing.T, reserved [8]byte) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	addr := listener.Addr().(*net.TCPAddr)
+	return &fakePeer{
+		listener: listener,
+		peer:     &Peer{IP: addr.IP.String(), Port: addr.Port},
+		reserved: reserved,
+		peerId:   "-FK0001-" + strconv.Itoa(100000000000+addr.Port),
+	}
+}
+
+// accept 接受连接并完成握手, 返回连接和对方的握手消息
+func (fake *fakePeer) accept(t *testing.T) (net.Conn, []byte) {
+	conn, err := fake.listener.Accept()
+	if err != nil {
+		t.Error("Error accepting: ", err)
+		return nil, nil
+	}
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		t.Error("Error reading handshake: ", err)
+		return nil, nil
+	}
+	resp := make([]byte, 68)
+	copy(resp, handshake)
+	copy(resp[20:28], fake.reserved[:])
+	copy(resp[48:68], fake.peerId)
+	if _, err := conn.Write(resp); err != nil {
+		t.Error("Error writing handshake: ", err)
+		return nil, nil
+	}
+	return conn, handshake
+}
+
+func testMetaInfo(pieceNum int, pieceLength int) *MetaInfo {
+	metaInfo := &MetaInfo{InfoHash: "aaaaaaaaaaaaaaaaaaaa"}
+	metaInfo.Info.Name = "test"
+	metaInfo.Info.PieceLength = pieceLength
+	metaInfo.Info.Length = pieceNum * pieceLength
+	metaInfo.Info.Pieces = make([][20]byte, pieceNum)
+	return metaInfo
+}
+
+// testPieceSource 用blockScheduler分配tasks中的piece, 其他piece视为已下载
+type testPieceSource struct {
+	*blockScheduler
+	finished chan struct{}
+}
+
+func newTestPieceSource(pieceNum int, tasks ...DownloadPieceTask) *testPieceSource {
+	picker := NewRarestFirstPicker(pieceNum, 0)
+	byIndex := make(map[int]DownloadPieceTask)
+	for _, task := range tasks {
+		byIndex[task.PieceIndex] = task
+	}
+	for i := 0; i < pieceNum; i++ {
+		if _, ok := byIndex[i]; !ok {
+			picker.Done(i)
+		}
+	}
+	return &testPieceSource{
+		blockScheduler: newBlockScheduler(picker, func(index int) DownloadPieceTask { return byIndex[index] }),
+		finished:       make(chan struct{}),
+	}
+}
+
+func (source *testPieceSource) AddPeer(bitfield *Bitfield)    {}
+func (source *testPieceSource) RemovePeer(bitfield *Bitfield) {}
+func (source *testPieceSource) PeerHave(index int)            {}
+func (source *testPieceSource) Finished() <-chan struct{}     { return source.finished }
+
+func TestDownloaderPipelinesRequests(t *testing.T) {
+	piece := make([]byte, 4*blockLength)
+	for i := range piece {
+		piece[i] = byte(i / 7)
+	}
+	task := DownloadPieceTask{PieceIndex: 0, PieceLength: len(piece), PieceHash: sha1.Sum(piece)}
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	downloader.bitfield = bitfieldOf(0x80)
+	downloader.queueDepth = 2
+
+	saveChan := make(chan SavePieceTask, 1)
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(1, task), saveChan, cancelChan)
+
+	if msg := readMessageTimeout(t, remote); msg.typeId != Interested {
+		t.Fatal("Expected interested, got ", msg.typeId)
+	}
+	NewMessage(Unchoke, nil).WriteTo(remote)
+
+	readRequest := func() blockRequest {
+		msg := readMessageTimeout(t, remote)
+		if msg.typeId != Request {
+			t.Fatal("Expected request, got ", msg.typeId)
+		}
+		req, _ := parseBlockRequest(msg.payload)
+		return req
+	}
+	// 请求队列深度为2, 回复乱序到达
+	first, second := readRequest(), readRequest()
+	if first.begin != 0 || second.begin != blockLength {
+		t.Fatalf("Unexpected first requests: %+v %+v", first, second)
+	}
+	NewPieceMessage(0, second.begin, piece[second.begin:second.begin+second.length]).WriteTo(remote)
+	NewPieceMessage(0, first.begin, piece[first.begin:first.begin+first.length]).WriteTo(remote)
+	for i := 0; i < 2; i++ {
+		req := readRequest()
+		NewPieceMessage(0, req.begin, piece[req.begin:req.begin+req.length]).WriteTo(remote)
+	}
+
+	select {
+	case saveTask := <-saveChan:
+		if !bytes.Equal(saveTask.Piece, piece) {
+			t.Error("Unexpected piece content")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for piece")
+	}
+}
+
+func TestDownloaderCancelsTimedOutRequests(t *testing.T) {
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	downloader.source = newTestPieceSource(4)
+	now := time.Now()
+	downloader.pending = map[blockRequest]time.Time{
+		{index: 3, begin: 0, length: blockLength}:           now.Add(-time.Minute),
+		{index: 3, begin: blockLength, length: blockLength}: now,
+	}
+
+	go func() {
+		downloader.expireRequests(now)
+		downloader.flush()
+	}()
+	msg := readMessageTimeout(t, remote)
+	if msg.typeId != Cancel {
+		t.Fatal("Expected cancel, got ", msg.typeId)
+	}
+	if req, _ := parseBlockRequest(msg.payload); req != (blockRequest{index: 3, begin: 0, length: blockLength}) {
+		t.Errorf("Unexpected cancel: %+v", req)
+	}
+}
+
+func TestDownloaderCancelsPieceCompletedElsewhere(t *testing.T) {
+	piece := make([]byte, 2*blockLength)
+	task := DownloadPieceTask{PieceIndex: 0, PieceLength: len(piece), PieceHash: sha1.Sum(piece)}
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	downloader.bitfield = bitfieldOf(0x80)
+
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(1, task), make(chan SavePieceTask, 1), cancelChan)
+
+	readMessageTimeout(t, remote)
+	NewMessage(Unchoke, nil).WriteTo(remote)
+	for i := 0; i < 2; i++ {
+		if msg := readMessageTimeout(t, remote); msg.typeId != Request {
+			t.Fatal("Expected request, got ", msg.typeId)
+		}
+	}
+	downloader.notifyHave(0)
+	for i := 0; i < 2; i++ {
+		if msg := readMessageTimeout(t, remote); msg.typeId != Cancel {
+			t.Fatal("Expected duplicate requests to be cancelled, got ", msg.typeId)
+		}
+	}
+	if msg := readMessageTimeout(t, remote); msg.typeId != Have || binary.BigEndian.Uint32(msg.payload) != 0 {
+		t.Fatal("Expected have for the completed piece, got ", msg)
+	}
+	if msg := readMessageTimeout(t, remote); msg.typeId != NotInterested {
+		t.Error("Expected not interested after the last needed piece, got ", msg.typeId)
+	}
+}
+
+func TestDownloaderInterestFollowsPeerPieces(t *testing.T) {
+	task := DownloadPieceTask{PieceIndex: 3, PieceLength: blockLength}
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(8, task), make(chan SavePieceTask, 1), cancelChan)
+
+	// 对方没有我们需要的piece, 不发送Interested
+	newIndexMessage(Have, 5).WriteTo(remote)
+	newIndexMessage(Have, 3).WriteTo(remote)
+	if msg := readMessageTimeout(t, remote); msg.typeId != Interested {
+		t.Fatal("Expected interested after the peer got a needed piece, got ", msg.typeId)
+	}
+	downloader.notifyHave(3)
+	if msg := readMessageTimeout(t, remote); msg.typeId != Have || binary.BigEndian.Uint32(msg.payload) != 3 {
+		t.Fatal("Expected have, got ", msg)
+	}
+	if msg := readMessageTimeout(t, remote); msg.typeId != NotInterested {
+		t.Error("Expected not interested, got ", msg.typeId)
+	}
+}
+
+func TestDownloaderSuppressesHaves(t *testing.T) {
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	downloader.bitfield = bitfieldOf(0x80)
+	downloader.advertised = bitfieldOf(0x20)
+	downloader.suppressHaves = true
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(8), make(chan SavePieceTask, 1), cancelChan)
+
+	// 对方已经有piece 0, 已经告诉过对方piece 2
+	downloader.notifyHave(0, 2)
+	downloader.notifyHave(1)
+	if msg := readMessageTimeout(t, remote); msg.typeId != Have || binary.BigEndian.Uint32(msg.payload) != 1 {
+		t.Error("Expected only the have for piece 1, got ", msg)
+	}
+}
+
+// readUntil 跳过其他消息, 直到读到typeId类型的消息
+func readUntil(t *testing.T, conn net.Conn, typeId byte) *Message {
+	for {
+		if msg := readMessageTimeout(t, conn); !msg.IsKeepalive() && msg.typeId == typeId {
+			return msg
+		}
+	}
+}
+
+func TestClientBroadcastsHave(t *testing.T) {
+	c := newListeningClient(t, 10)
+	var err error
+	c.storage, err = NewPieceSaver(c.metaInfo, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal("Error opening storage: ", err)
+	}
+	defer c.storage.Close()
+	go c.SavePiece()
+	defer close(c.cancelChan)
+
+	conn, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001")
+	if !ok {
+		t.Fatal("Expected handshake response")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	c.saveChan <- SavePieceTask{PieceIndex: 2, Piece: make([]byte, 16384)}
+	if msg := readUntil(t, conn, Have); binary.BigEndian.Uint32(msg.payload) != 2 {
+		t.Error("Expected have for the saved piece, got ", msg)
+	}
+}
+
+func TestClientLazyBitfield(t *testing.T) {
+	c := newListeningClient(t, 10)
+	c.config.LazyBitfield = true
+	for _, index := range []int{0, 4, 7} {
+		c.bitField.Set(index)
+	}
+	conn, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001")
+	if !ok {
+		t.Fatal("Expected handshake response")
+	}
+	// 拥有的piece少于lazyBitfieldPieces时全部隐藏
+	if msg := readMessageTimeout(t, conn); msg.typeId != HaveNone {
+		t.Fatal("Expected all pieces to be hidden from the bitfield, got ", msg.typeId)
+	}
+	haves := make(map[uint32]bool)
+	for len(haves) < 3 {
+		haves[binary.BigEndian.Uint32(readUntil(t, conn, Have).payload)] = true
+	}
+	if !haves[0] || !haves[4] || !haves[7] {
+		t.Error("Expected haves for the hidden pieces, got ", haves)
+	}
+}
+
+func TestClientAddsDHTNodeFromEarlyPort(t *testing.T) {
+	c := newListeningClient(t, 10)
+	nodes := make([]*DHT, 0, 2)
+	for i := 0; i < 2; i++ {
+		node, err := NewDHT(DHTConfig{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatal("Error starting dht node: ", err)
+		}
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+	c.dht = nodes[0]
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", c.listener.Addr().Port))
+	if err != nil {
+		t.Fatal("Error dialing client: ", err)
+	}
+	defer conn.Close()
+	conn.Write(handShakeMsg(c.metaInfo, "-FK0001-000000000001"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		t.Fatal("Error reading handshake: ", err)
+	}
+	// Port消息在bitfield之前到达
+	NewPortMessage(nodes[1].Addr().Port).WriteTo(conn)
+	NewMessage(BitfieldMessage, []byte{0}).WriteTo(conn)
+	for i := 0; i < 100 && nodes[0].NodeNum() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nodes[0].NodeNum() != 1 {
+		t.Error("Expected dht node from the early port message to be added")
+	}
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	extendedHandshakeId = 0
+	// reserved[5]的0x10即BEP 10中的第20位
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10
+	defaultReqq           = 250
+	clientVersion         = "jBittorrent 0.0.1"
+)
+
+// ExtendedHandshake BEP 10扩展握手中的字段
+type ExtendedHandshake struct {
+	M            map[string]int // 扩展名 -> 对方使用的消息id, id为0表示禁用
+	V            string
+	P            int
+	YourIp       net.IP
+	Reqq         int
+	MetadataSize int
+}
+
+// ExtensionHandler 处理一种扩展消息, 比如ut_pex
+type ExtensionHandler interface {
+	Name() string
+	// OnHandshake 收到对方的扩展握手后调用
+	OnHandshake(downloader *Downloader, handshake *ExtendedHandshake)
+	HandleMessage(downloader *Downloader, payload []byte) error
+}
+
+// ExtensionRegistry 维护本地注册的扩展, 本地消息id为注册顺序加1
+type ExtensionRegistry struct {
+	mu           sync.RWMutex
+	handlers     []ExtensionHandler
+	listenPort   int
+	metadataSize int
+}
+
+func NewExtensionRegistry(listenPort int, metadataSize int) *ExtensionRegistry {
+	return &ExtensionRegistry{
+		handlers:     make([]ExtensionHandler, 0),
+		listenPort:   listenPort,
+		metadataSize: metadataSize,
+	}
+}
+
+func (registry *ExtensionRegistry) Register(handler ExtensionHandler) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.handlers = append(registry.handlers, handler)
+}
+
+func (registry *ExtensionRegistry) handler(id byte) ExtensionHandler {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	if id == extendedHandshakeId || int(id) > len(registry.handlers) {
+		return nil
+	}
+	return registry.handlers[id-1]
+}
+
+func (registry *ExtensionRegistry) all() []ExtensionHandler {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return append([]ExtensionHandler{}, registry.handlers...)
+}
+
+// handshakePayload 生成发送给remoteIp的扩展握手
+func (registry *ExtensionRegistry) handshakePayload(remoteIp net.IP) ([]byte, error) {
+	registry.mu.RLock()
+	m := make(map[string]interface{}, len(registry.handlers))
+	for i, handler := range registry.handlers {
+		m[handler.Name()] = i + 1
+	}
+	registry.mu.RUnlock()
+
+	dict := map[string]interface{}{
+		"m":    m,
+		"v":    clientVersion,
+		"reqq": defaultReqq,
+	}
+	if registry.listenPort > 0 {
+		dict["p"] = registry.listenPort
+	}
+	if registry.metadataSize > 0 {
+		dict["metadata_size"] = registry.metadataSize
+	}
+	if ip4 := remoteIp.To4(); ip4 != nil {
+		dict["yourip"] = []byte(ip4)
+	} else if ip16 := remoteIp.To16(); ip16 != nil {
+		dict["yourip"] = []byte(ip16)
+	}
+	payload, err := Bencode(dict)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{extendedHandshakeId}, payload...), nil
+}
+
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	value, err := DecodeBencode(payload)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("extended handshake is not a dictionary")
+	}
+	handshake := &ExtendedHandshake{M: make(map[string]int)}
+	if m, ok := dictDict(dict, "m"); ok {
+		for name, id := range m {
+			if id, ok := id.(int); ok && id >= 0 && id <= 255 {
+				handshake.M[name] = id
+			}
+		}
+	}
+	handshake.V, _ = dictString(dict, "v")
+	handshake.P, _ = dictInt(dict, "p")
+	handshake.Reqq, _ = dictInt(dict, "reqq")
+	handshake.MetadataSize, _ = dictInt(dict, "metadata_size")
+	if yourIp, ok := dictString(dict, "yourip"); ok && (len(yourIp) == 4 || len(yourIp) == 16) {
+		handshake.YourIp = net.IP(yourIp)
+	}
+	return handshake, nil
+}
+
+func supportsExtensionProtocol(reserved [8]byte) bool {
+	return reserved[extensionReservedByte]&extensionReservedBit != 0
+}
+
+// sendExtendedHandshake 对方支持扩展协议时发送扩展握手
+func (downloader *Downloader) sendExtendedHandshake() error {
+	if downloader.extensions == nil || !supportsExtensionProtocol(downloader.reserved) {
+		return nil
+	}
+	var remoteIp net.IP
+	if addr, ok := downloader.conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIp = addr.IP
+	}
+	payload, err := downloader.extensions.handshakePayload(remoteIp)
+	if err != nil {
+		return err
+	}
+	return downloader.send(NewMessage(Extended, payload))
+}
+
+// SendExtended 按对方握手中声明的id发送扩展消息
+func (downloader *Downloader) SendExtended(name string, payload []byte) error {
+	downloader.extMu.RLock()
+	id, ok := downloader.remoteExtensions[name]
+	downloader.extMu.RUnlock()
+	if !ok || id == 0 {
+		return fmt.Errorf("peer does not support extension %s", name)
+	}
+	return downloader.send(NewMessage(Extended, append([]byte{byte(id)}, payload...)))
+}
+
+// SupportsExtension 对方是否在扩展握手中声明了name
+func (downloader *Downloader) SupportsExtension(name string) bool {
+	downloader.extMu.RLock()
+	defer downloader.extMu.RUnlock()
+	return downloader.remoteExtensions[name] != 0
+}
+
+// ExtendedHandshake 返回对方的扩展握手, 未收到时为nil
+func (downloader *Downloader) ExtendedHandshake() *ExtendedHandshake {
+	downloader.extMu.RLock()
+	defer downloader.extMu.RUnlock()
+	return downloader.extendedHandshake
+}
+
+func (downloader *Downloader) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty extended message")
+	}
+	if payload[0] == extendedHandshakeId {
+		handshake, err := parseExtendedHandshake(payload[1:])
+		if err != nil {
+			return fmt.Errorf("invalid extended handshake: %s", err)
+		}
+		downloader.extMu.Lock()
+		downloader.extendedHandshake = handshake
+		downloader.remoteExtensions = handshake.M
+		downloader.extMu.Unlock()
+		log.Printf("downloader %d peer client %q, extensions: %v", downloader.Id, handshake.V, handshake.M)
+		if downloader.extensions != nil {
+			for _, handler := range downloader.extensions.all() {
+				handler.OnHandshake(downloader, handshake)
+			}
+		}
+		return nil
+	}
+	if downloader.extensions == nil {
+		return nil
+	}
+	handler := downloader.extensions.handler(payload[0])
+	if handler == nil {
+		log.Printf("downloader %d unknown extended message id %d", downloader.Id, payload[0])
+		return nil
+	}
+	return handler.HandleMessage(downloader, payload[1:])
+}
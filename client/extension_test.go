@@ -0,0 +1,103 @@
+package client
+
+import (
+	"net"
+	"testing"
+)
+
+type testExtension struct {
+	handshakes chan *ExtendedHandshake
+	messages   chan []byte
+}
+
+func (ext *testExtension) Name() string {
+	return "ut_test"
+}
+
+func (ext *testExtension) OnHandshake(downloader *Downloader, handshake *ExtendedHandshake) {
+	ext.handshakes <- handshake
+}
+
+func (ext *testExtension) HandleMessage(downloader *Downloader, payload []byte) error {
+	ext.messages <- payload
+	return nil
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	registry := NewExtensionRegistry(6881, 1234)
+	registry.Register(&testExtension{})
+	payload, err := registry.handshakePayload(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatal("Error encoding extended handshake: ", err)
+	}
+	if payload[0] != extendedHandshakeId {
+		t.Fatal("Expected handshake message id 0, got ", payload[0])
+	}
+	handshake, err := parseExtendedHandshake(payload[1:])
+	if err != nil {
+		t.Fatal("Error parsing extended handshake: ", err)
+	}
+	if handshake.M["ut_test"] != 1 || handshake.P != 6881 || handshake.MetadataSize != 1234 ||
+		handshake.Reqq != defaultReqq || handshake.V != clientVersion || !handshake.YourIp.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Unexpected extended handshake: %+v", handshake)
+	}
+}
+
+func TestDownloaderExtensionNegotiation(t *testing.T) {
+	var remoteReserved [8]byte
+	remoteReserved[extensionReservedByte] |= extensionReservedBit
+	fake := newFakePeer(t, remoteReserved)
+	metaInfo := testMetaInfo(8, 16384)
+	ext := &testExtension{handshakes: make(chan *ExtendedHandshake, 1), messages: make(chan []byte, 1)}
+	registry := NewExtensionRegistry(6881, 0)
+	registry.Register(ext)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, handshake := fake.accept(t)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		var localReserved [8]byte
+		copy(localReserved[:], handshake[20:28])
+		if !supportsExtensionProtocol(localReserved) {
+			t.Error("Expected extension protocol bit in our handshake")
+		}
+		sawExtendedHandshake := false
+		for !sawExtendedHandshake {
+			msg, err := ReadMessageFrom(conn)
+			if err != nil {
+				t.Error("Error reading message: ", err)
+				return
+			}
+			if msg.typeId == Extended && msg.payload[0] == extendedHandshakeId {
+				sawExtendedHandshake = true
+			}
+		}
+		remote, _ := Bencode(map[string]interface{}{"m": map[string]interface{}{"ut_test": 3}, "v": "Fake 1.0", "reqq": 500})
+		NewMessage(Extended, append([]byte{extendedHandshakeId}, remote...)).WriteTo(conn)
+		// 本地为ut_test分配的id是1
+		NewMessage(Extended, []byte{1, 'h', 'i'}).WriteTo(conn)
+		NewMessage(BitfieldMessage, []byte{0xff}).WriteTo(conn)
+	}()
+
+	downloader, err := NewDownloader(fake.peer, handShakeMsg(metaInfo, "-JB0001-123456789012"), NewBitfield(8), 8, 0, registry, nil)
+	if err != nil {
+		t.Fatal("Error creating downloader: ", err)
+	}
+	defer downloader.conn.Close()
+	<-done
+
+	handshake := <-ext.handshakes
+	if handshake.V != "Fake 1.0" || handshake.Reqq != 500 {
+		t.Errorf("Unexpected remote handshake: %+v", handshake)
+	}
+	if !downloader.SupportsExtension("ut_test") || downloader.SupportsExtension("ut_pex") {
+		t.Error("Unexpected remote extensions: ", downloader.remoteExtensions)
+	}
+	if payload := <-ext.messages; string(payload) != "hi" {
+		t.Error("Expected extension payload 'hi', got ", payload)
+	}
+}
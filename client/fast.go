@@ -0,0 +1,124 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	// reserved[7]的0x04表示支持fast extension (BEP 6)
+	fastReservedByte = 7
+	fastReservedBit  = 0x04
+	// allowedFastSetSize 发给每个peer的allowed fast piece数
+	allowedFastSetSize = 10
+)
+
+func supportsFastExtension(reserved [8]byte) bool {
+	return reserved[fastReservedByte]&fastReservedBit != 0
+}
+
+// allowedFastSet 按BEP 6的算法由对方IP和info_hash计算allowed fast集合, 只支持IPv4
+func allowedFastSet(ip string, infoHash string, pieceNum int, k int) []int {
+	ipv4 := net.ParseIP(ip).To4()
+	if ipv4 == nil || pieceNum <= 0 {
+		return nil
+	}
+	if k > pieceNum {
+		k = pieceNum
+	}
+	x := make([]byte, 0, 24)
+	x = append(x, ipv4[0], ipv4[1], ipv4[2], 0)
+	x = append(x, infoHash...)
+	set := make([]int, 0, k)
+	seen := make(map[int]bool)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(pieceNum))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendHaves 双方都支持fast extension时用Have All/Have None代替bitfield
+func (downloader *Downloader) sendHaves(bitfield *Bitfield) error {
+	if !downloader.fast {
+		return downloader.sendBitfield(bitfield)
+	}
+	switch bitfield.Count() {
+	case 0:
+		return downloader.send(NewMessage(HaveNone, nil))
+	case bitfield.Len():
+		return downloader.send(NewMessage(HaveAll, nil))
+	}
+	return downloader.sendBitfield(bitfield)
+}
+
+// maskBitfield 返回bitfield中属于pieces的部分
+func maskBitfield(bitfield *Bitfield, pieces map[int]bool) *Bitfield {
+	masked := NewBitfield(bitfield.Len())
+	for index := range pieces {
+		if bitfield.Has(index) {
+			masked.Set(index)
+		}
+	}
+	return masked
+}
+
+// sendAllowedFast 允许对方在被choke时下载的piece
+func (downloader *Downloader) sendAllowedFast() error {
+	if !downloader.fast || downloader.storage == nil {
+		return nil
+	}
+	for _, index := range allowedFastSet(downloader.peer.IP, downloader.infoHash, downloader.pieceNum, allowedFastSetSize) {
+		downloader.allowedFastSent[index] = true
+		if err := downloader.send(newIndexMessage(AllowedFast, index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendReject 不处理的请求在fast extension中需要明确拒绝
+func (downloader *Downloader) sendReject(req blockRequest) error {
+	if !downloader.fast {
+		return nil
+	}
+	return downloader.send(NewRejectMessage(req.index, req.begin, req.length))
+}
+
+// handleFastMessage 处理Suggest Piece, Reject Request和Allowed Fast
+func (downloader *Downloader) handleFastMessage(msg *Message) error {
+	if !downloader.fast {
+		return protocolErrorf(msg.typeId, "without fast extension")
+	}
+	switch msg.typeId {
+	case SuggestPiece, AllowedFast:
+		index := int(binary.BigEndian.Uint32(msg.payload))
+		if index >= downloader.pieceNum {
+			return protocolErrorf(msg.typeId, "piece index %d out of range", index)
+		}
+		if msg.typeId == SuggestPiece {
+			downloader.suggested[index] = true
+		} else {
+			downloader.allowedFast[index] = true
+		}
+	case RejectRequest:
+		req, err := parseBlockRequest(msg.payload)
+		if err != nil {
+			return err
+		}
+		// 被拒绝的分片立即重新分配, 不需要等待超时
+		if _, ok := downloader.pending[req]; ok {
+			delete(downloader.pending, req)
+			downloader.source.AbortBlocks(downloader.Id, []blockRequest{req})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// BEP 6中的例子
+	infoHash := strings.Repeat("\xaa", 20)
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	set := allowedFastSet("80.4.4.200", infoHash, 1313, 9)
+	if len(set) != len(expected) {
+		t.Fatal("Unexpected allowed fast set: ", set)
+	}
+	for i := range expected {
+		if set[i] != expected[i] {
+			t.Fatal("Unexpected allowed fast set: ", set)
+		}
+	}
+	if set := allowedFastSet("80.4.4.200", infoHash, 3, 10); len(set) != 3 {
+		t.Error("Expected set to be limited by piece count, got ", set)
+	}
+	if set := allowedFastSet("::1", infoHash, 1313, 10); set != nil {
+		t.Error("Expected no allowed fast set for IPv6, got ", set)
+	}
+}
+
+func TestFastHandshake(t *testing.T) {
+	var remoteReserved [8]byte
+	remoteReserved[fastReservedByte] |= fastReservedBit
+	fake := newFakePeer(t, remoteReserved)
+	metaInfo := testMetaInfo(8, 16384)
+	done := make(chan *Message, 1)
+	go func() {
+		conn, _ := fake.accept(t)
+		if conn == nil {
+			close(done)
+			return
+		}
+		defer conn.Close()
+		msg, err := ReadMessageFrom(conn)
+		if err != nil {
+			t.Error("Error reading message: ", err)
+		}
+		NewMessage(HaveNone, nil).WriteTo(conn)
+		done <- msg
+	}()
+
+	downloader, err := NewDownloader(fake.peer, handShakeMsg(metaInfo, "-JB0001-123456789012"), bitfieldOf(0xff), 8, 0, nil, nil)
+	if err != nil {
+		t.Fatal("Error creating downloader: ", err)
+	}
+	defer downloader.conn.Close()
+	if msg := <-done; msg == nil || msg.typeId != HaveAll {
+		t.Error("Expected have all instead of bitfield, got ", msg)
+	}
+	if !downloader.fast || downloader.bitfield.Count() != 0 {
+		t.Error("Expected have none to give an empty bitfield, got ", downloader.bitfield)
+	}
+}
+
+func newFastDownloader(storage pieceReader) (*Downloader, net.Conn) {
+	downloader, remote := newSeedingDownloader(storage)
+	downloader.fast = true
+	downloader.allowedFast = make(map[int]bool)
+	downloader.suggested = make(map[int]bool)
+	downloader.allowedFastSent = make(map[int]bool)
+	return downloader, remote
+}
+
+func TestDownloaderRequestsAllowedFastWhileChoked(t *testing.T) {
+	piece := make([]byte, blockLength)
+	task := func(index int) DownloadPieceTask {
+		return DownloadPieceTask{PieceIndex: index, PieceLength: len(piece), PieceHash: sha1.Sum(piece)}
+	}
+	downloader, remote := newFastDownloader(nil)
+	defer remote.Close()
+	downloader.pieceNum = 2
+	downloader.bitfield = bitfieldOf(0xc0)
+
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(2, task(0), task(1)), make(chan SavePieceTask, 1), cancelChan)
+
+	newIndexMessage(AllowedFast, 1).WriteTo(remote)
+	if msg := readMessageTimeout(t, remote); msg.typeId != Interested {
+		t.Fatal("Expected interested, got ", msg.typeId)
+	}
+	msg := readMessageTimeout(t, remote)
+	req, _ := parseBlockRequest(msg.payload)
+	if msg.typeId != Request || req.index != 1 {
+		t.Fatalf("Expected request for allowed fast piece while choked, got %d %+v", msg.typeId, req)
+	}
+	// 被拒绝的请求立即重新分配
+	NewRejectMessage(req.index, req.begin, req.length).WriteTo(remote)
+	msg = readMessageTimeout(t, remote)
+	if again, _ := parseBlockRequest(msg.payload); msg.typeId != Request || again != req {
+		t.Fatalf("Expected rejected block to be requested again, got %d %+v", msg.typeId, again)
+	}
+}
+
+func TestDownloaderRejectsRequestsWhenChoking(t *testing.T) {
+	downloader, remote := newFastDownloader(memPieces{0: make([]byte, 16384), 1: make([]byte, 16384)})
+	defer remote.Close()
+	downloader.allowedFastSent[1] = true
+
+	done := make(chan struct{})
+	go func() {
+		downloader.handleRequest(NewRequestMessage(0, 0, 1024))
+		downloader.handleRequest(NewRequestMessage(1, 0, 1024))
+		close(done)
+	}()
+	msg := readMessageTimeout(t, remote)
+	if req, _ := parseBlockRequest(msg.payload); msg.typeId != RejectRequest || req.index != 0 {
+		t.Fatalf("Expected reject while choking, got %d %+v", msg.typeId, req)
+	}
+	<-done
+	if len(downloader.uploads) != 1 || downloader.uploads[0].index != 1 {
+		t.Errorf("Expected allowed fast request to be queued, got %+v", downloader.uploads)
+	}
+}
+
+func TestDownloaderRejectsUnreadableBlock(t *testing.T) {
+	downloader, remote := newFastDownloader(memPieces{0: make([]byte, 16384)})
+	defer remote.Close()
+	downloader.uploads = []blockRequest{{index: 1, begin: 0, length: 1024}}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- downloader.serveRequest()
+	}()
+	msg := readMessageTimeout(t, remote)
+	if req, _ := parseBlockRequest(msg.payload); msg.typeId != RejectRequest || req.index != 1 {
+		t.Fatalf("Expected reject for unreadable block, got %d %+v", msg.typeId, req)
+	}
+	if err := <-errChan; err != nil {
+		t.Error("Expected connection to stay open, got ", err)
+	}
+}
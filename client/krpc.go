@@ -0,0 +1,167 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// KRPC错误码 (BEP 5)
+const (
+	krpcGenericError  = 201
+	krpcServerError   = 202
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+const compactNodeLen = 26
+
+type krpcMessage struct {
+	T string                 // transaction id
+	Y string                 // q, r 或 e
+	Q string                 // 查询方法
+	A map[string]interface{} // 查询参数
+	R map[string]interface{} // 响应
+	E []interface{}          // 错误 [code, message]
+}
+
+// KrpcError 远端节点返回的错误
+type KrpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *KrpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func (msg *krpcMessage) encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": msg.T,
+		"y": msg.Y,
+	}
+	switch msg.Y {
+	case "q":
+		dict["q"] = msg.Q
+		dict["a"] = msg.A
+	case "r":
+		dict["r"] = msg.R
+	case "e":
+		dict["e"] = msg.E
+	default:
+		return nil, fmt.Errorf("invalid krpc message type: %s", msg.Y)
+	}
+	return Bencode(dict)
+}
+
+func decodeKrpcMessage(data []byte) (*krpcMessage, error) {
+	value, err := DecodeBencode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("krpc message is not a dictionary")
+	}
+	msg := &krpcMessage{}
+	if msg.T, ok = dictString(dict, "t"); !ok {
+		return nil, errors.New("krpc message has no transaction id")
+	}
+	if msg.Y, ok = dictString(dict, "y"); !ok {
+		return nil, errors.New("krpc message has no type")
+	}
+	switch msg.Y {
+	case "q":
+		if msg.Q, ok = dictString(dict, "q"); !ok {
+			return nil, errors.New("krpc query has no method")
+		}
+		if msg.A, ok = dictDict(dict, "a"); !ok {
+			return nil, errors.New("krpc query has no arguments")
+		}
+	case "r":
+		if msg.R, ok = dictDict(dict, "r"); !ok {
+			return nil, errors.New("krpc response has no body")
+		}
+	case "e":
+		msg.E, _ = dictList(dict, "e")
+	default:
+		return nil, fmt.Errorf("invalid krpc message type: %s", msg.Y)
+	}
+	return msg, nil
+}
+
+// senderId 返回查询或响应中的节点id
+func (msg *krpcMessage) senderId() (string, bool) {
+	var id string
+	var ok bool
+	if msg.Y == "q" {
+		id, ok = dictString(msg.A, "id")
+	} else if msg.Y == "r" {
+		id, ok = dictString(msg.R, "id")
+	}
+	return id, ok && len(id) == 20
+}
+
+func (msg *krpcMessage) err() error {
+	if len(msg.E) < 2 {
+		return &KrpcError{Code: krpcGenericError, Message: "malformed error"}
+	}
+	code, _ := msg.E[0].(int)
+	message, _ := msg.E[1].(string)
+	return &KrpcError{Code: code, Message: message}
+}
+
+// 紧凑格式: 20字节节点id + 4字节IPv4 + 2字节端口
+func encodeCompactNodes(nodes []*dhtNode) string {
+	buf := make([]byte, 0, compactNodeLen*len(nodes))
+	for _, node := range nodes {
+		ip4 := node.addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		buf = append(buf, node.id...)
+		buf = append(buf, ip4...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(node.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeCompactNodes(data string) ([]*dhtNode, error) {
+	if len(data)%compactNodeLen != 0 {
+		return nil, errors.New("compact node info length error")
+	}
+	nodes := make([]*dhtNode, 0, len(data)/compactNodeLen)
+	for i := 0; i < len(data); i += compactNodeLen {
+		addr := &net.UDPAddr{
+			IP:   net.IPv4(data[i+20], data[i+21], data[i+22], data[i+23]),
+			Port: int(binary.BigEndian.Uint16([]byte(data[i+24 : i+26]))),
+		}
+		if addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, &dhtNode{id: data[i : i+20], addr: addr})
+	}
+	return nodes, nil
+}
+
+func encodeCompactPeer(ip net.IP, port int) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	buf := make([]byte, 6)
+	copy(buf, ip4)
+	binary.BigEndian.PutUint16(buf[4:], uint16(port))
+	return string(buf)
+}
+
+func decodeCompactPeer(data string) (Peer, bool) {
+	if len(data) != 6 {
+		return Peer{}, false
+	}
+	return Peer{
+		IP:   fmt.Sprintf("%d.%d.%d.%d", data[0], data[1], data[2], data[3]),
+		Port: int(data[4])<<8 + int(data[5]),
+	}, true
+}
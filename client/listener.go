@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const handShakeTimeout = 10 * time.Second
+
+var (
+	errTooManyConnections = errors.New("too many connections")
+	errSelfConnection     = errors.New("connected to self")
+	errDuplicatePeer      = errors.New("duplicate peer id")
+	errBannedPeer         = errors.New("peer is banned")
+)
+
+// PeerListener 接受其他peer的连接, 按握手中的info_hash交给对应的Client
+type PeerListener struct {
+	listener net.Listener
+	utp      *UTPSocket
+	mu       sync.Mutex
+	clients  map[string]*Client
+}
+
+func NewPeerListener(addr string) (*PeerListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerListener{
+		listener: listener,
+		clients:  make(map[string]*Client),
+	}, nil
+}
+
+func (peerListener *PeerListener) Addr() *net.TCPAddr {
+	return peerListener.listener.Addr().(*net.TCPAddr)
+}
+
+func (peerListener *PeerListener) Register(client *Client) {
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	peerListener.clients[client.metaInfo.InfoHash] = client
+}
+
+func (peerListener *PeerListener) Unregister(infoHash string) {
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	delete(peerListener.clients, infoHash)
+}
+
+func (peerListener *PeerListener) lookup(infoHash string) *Client {
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	return peerListener.clients[infoHash]
+}
+
+// Serve 循环接受连接, 直到Close
+func (peerListener *PeerListener) Serve() error {
+	return peerListener.serve(peerListener.listener)
+}
+
+// ServeUTP 同时接受socket上的uTP连接, Close时socket随之关闭
+func (peerListener *PeerListener) ServeUTP(socket *UTPSocket) error {
+	peerListener.mu.Lock()
+	peerListener.utp = socket
+	peerListener.mu.Unlock()
+	return peerListener.serve(socket)
+}
+
+func (peerListener *PeerListener) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println("Error accepting peer connection: ", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go peerListener.handleConn(conn)
+	}
+}
+
+func (peerListener *PeerListener) Close() error {
+	peerListener.mu.Lock()
+	socket := peerListener.utp
+	peerListener.mu.Unlock()
+	if socket != nil {
+		socket.Close()
+	}
+	return peerListener.listener.Close()
+}
+
+// policies 返回所有torrent的加密策略, 用于识别加密连接的info_hash
+func (peerListener *PeerListener) policies() map[string]EncryptionPolicy {
+	peerListener.mu.Lock()
+	defer peerListener.mu.Unlock()
+	policies := make(map[string]EncryptionPolicy, len(peerListener.clients))
+	for infoHash, client := range peerListener.clients {
+		policies[infoHash] = client.config.Encryption
+	}
+	return policies
+}
+
+// handleConn 根据开头的20字节判断是明文握手还是MSE
+func (peerListener *PeerListener) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handShakeTimeout))
+	prefix := make([]byte, 20)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		log.Println("Error reading handshake from ", conn.RemoteAddr(), ": ", err)
+		conn.Close()
+		return
+	}
+	encrypted := prefix[0] != pstrlen || string(prefix[1:20]) != pstr
+	if encrypted {
+		decrypted, err := mseAccept(conn, prefix, peerListener.policies())
+		if err != nil {
+			log.Println("Error in encrypted handshake from ", conn.RemoteAddr(), ": ", err)
+			conn.Close()
+			return
+		}
+		conn = decrypted
+	} else {
+		conn = prefixConn(conn, prefix)
+	}
+	handshake, err := ReadHandShake(conn)
+	if err != nil {
+		log.Println("Error reading handshake from ", conn.RemoteAddr(), ": ", err)
+		conn.Close()
+		return
+	}
+	client := peerListener.lookup(handshake.InfoHash)
+	if client == nil {
+		log.Println("Incoming connection for unknown torrent from ", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !encrypted && client.config.Encryption == EncryptionRequire {
+		log.Println("Rejected plaintext connection from ", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if err := client.acceptPeer(conn, handshake); err != nil {
+		log.Println("Rejected incoming connection from ", conn.RemoteAddr(), ": ", err)
+		conn.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newListeningClient(t *testing.T, maxConnections int) *Client {
+	config := DefaultConfig()
+	config.DownloaderNum = 2
+	config.PeerPort = 0
+	config.MaxConnections = maxConnections
+	c, err := NewClientWithConfig(testMetaInfo(8, 16384), t.TempDir(), config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	if err := c.listen(); err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	t.Cleanup(func() { c.listener.Close() })
+	return c
+}
+
+// dialClient 作为远端peer主动连接, 握手成功后交换bitfield
+func dialClient(t *testing.T, c *Client, infoHash string, peerId string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", c.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error dialing client: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	metaInfo := &MetaInfo{InfoHash: infoHash}
+	conn.Write(handShakeMsg(metaInfo, peerId))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp := make([]byte, 68)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return conn, false
+	}
+	if string(resp[48:68]) != c.peerId {
+		t.Error("Expected our peer id in handshake response")
+	}
+	NewMessage(BitfieldMessage, []byte{0}).WriteTo(conn)
+	return conn, true
+}
+
+func waitDownloaders(c *Client, n int) bool {
+	for i := 0; i < 100; i++ {
+		if len(c.activeDownloaders()) == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestListenerAcceptsPeer(t *testing.T) {
+	c := newListeningClient(t, 10)
+	if c.peerPort == 0 || c.peerPort != c.listener.Addr().Port {
+		t.Error("Expected client to advertise the listening port, got ", c.peerPort)
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001"); !ok {
+		t.Fatal("Expected handshake response")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	downloader := c.activeDownloaders()[0]
+	if !downloader.inbound || downloader.peerId != "-FK0001-000000000001" || downloader.Id < c.downloaderNum {
+		t.Errorf("Unexpected inbound downloader: %+v", downloader)
+	}
+}
+
+func TestListenerRejectsConnections(t *testing.T) {
+	c := newListeningClient(t, 1)
+	if _, ok := dialClient(t, c, "bbbbbbbbbbbbbbbbbbbb", "-FK0001-000000000001"); ok {
+		t.Error("Expected connection for unknown torrent to be rejected")
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, c.peerId); ok {
+		t.Error("Expected connection from ourselves to be rejected")
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001"); !ok {
+		t.Fatal("Expected first connection to be accepted")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001"); ok {
+		t.Error("Expected duplicate peer id to be rejected")
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000002"); ok {
+		t.Error("Expected connection over the limit to be rejected")
+	}
+}
+
+func TestMaxConnectionsIncludesOutbound(t *testing.T) {
+	c := newListeningClient(t, 1)
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001"); !ok {
+		t.Fatal("Expected first connection to be accepted")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	outbound := &Downloader{Id: 0, peerId: "-FK0001-000000000002", peer: &Peer{IP: "127.0.0.2", Port: 6881}}
+	if err := c.registerDownloader(outbound); err != errTooManyConnections {
+		t.Error("Expected outbound connection over the limit to be rejected, got ", err)
+	}
+}
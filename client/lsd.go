@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsdMulticastAddr = "239.192.152.143:6771"
+	lsdInterval      = 5 * time.Minute
+	lsdMaxPacket     = 1400
+)
+
+// LSDTransport 发送和接收LSD报文, 可以替换为内存实现用于测试
+type LSDTransport interface {
+	Send(data []byte) error
+	Receive() ([]byte, *net.UDPAddr, error)
+	Close() error
+}
+
+type multicastTransport struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// NewMulticastLSDTransport 加入组播组, group为空时使用BEP 14的IPv4地址
+func NewMulticastLSDTransport(group string) (LSDTransport, error) {
+	if group == "" {
+		group = lsdMulticastAddr
+	}
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &multicastTransport{conn: conn, group: groupAddr}, nil
+}
+
+func (transport *multicastTransport) Send(data []byte) error {
+	_, err := transport.conn.WriteToUDP(data, transport.group)
+	return err
+}
+
+func (transport *multicastTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	buf := make([]byte, lsdMaxPacket)
+	n, addr, err := transport.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf[:n], addr, nil
+}
+
+func (transport *multicastTransport) Close() error {
+	return transport.conn.Close()
+}
+
+// LSD 本地服务发现 (BEP 14)
+type LSD struct {
+	transport  LSDTransport
+	port       int
+	cookie     string // 用于忽略自己发出的报文
+	mu         sync.Mutex
+	infoHashes map[string]func(peer *Peer)
+}
+
+func NewLSD(transport LSDTransport, port int) *LSD {
+	return &LSD{
+		transport:  transport,
+		port:       port,
+		cookie:     randomString(8),
+		infoHashes: make(map[string]func(peer *Peer)),
+	}
+}
+
+// Add 开始为infoHash发送announce, 发现的peer交给onPeer
+func (lsd *LSD) Add(infoHash string, onPeer func(peer *Peer)) {
+	lsd.mu.Lock()
+	defer lsd.mu.Unlock()
+	lsd.infoHashes[infoHash] = onPeer
+}
+
+func (lsd *LSD) Remove(infoHash string) {
+	lsd.mu.Lock()
+	defer lsd.mu.Unlock()
+	delete(lsd.infoHashes, infoHash)
+}
+
+// Run 立即announce一次, 之后每5分钟announce, 同时接收其他节点的announce
+func (lsd *LSD) Run(cancelChan <-chan struct{}) {
+	go func() {
+		<-cancelChan
+		lsd.transport.Close()
+	}()
+	go lsd.receive()
+
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+	for {
+		if err := lsd.Announce(); err != nil {
+			log.Println("Error sending lsd announce: ", err)
+		}
+		select {
+		case <-cancelChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Announce 在一个报文中announce所有torrent
+func (lsd *LSD) Announce() error {
+	lsd.mu.Lock()
+	infoHashes := make([]string, 0, len(lsd.infoHashes))
+	for infoHash := range lsd.infoHashes {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	lsd.mu.Unlock()
+	if len(infoHashes) == 0 {
+		return nil
+	}
+	return lsd.transport.Send(encodeLSDAnnounce(lsd.port, infoHashes, lsd.cookie))
+}
+
+func (lsd *LSD) receive() {
+	for {
+		data, addr, err := lsd.transport.Receive()
+		if err != nil {
+			return
+		}
+		port, infoHashes, cookie, err := parseLSDAnnounce(data)
+		if err != nil || cookie == lsd.cookie {
+			continue
+		}
+		for _, infoHash := range infoHashes {
+			lsd.mu.Lock()
+			onPeer := lsd.infoHashes[infoHash]
+			lsd.mu.Unlock()
+			if onPeer != nil {
+				onPeer(&Peer{IP: addr.IP.String(), Port: port})
+			}
+		}
+	}
+}
+
+func encodeLSDAnnounce(port int, infoHashes []string, cookie string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + lsdMulticastAddr + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(port) + "\r\n")
+	for _, infoHash := range infoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString([]byte(infoHash)) + "\r\n")
+	}
+	if cookie != "" {
+		buf.WriteString("cookie: " + cookie + "\r\n")
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// parseLSDAnnounce 返回端口, 二进制info_hash列表和cookie
+func parseLSDAnnounce(data []byte) (int, []string, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", fmt.Errorf("unexpected lsd method %s", req.Method)
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", errors.New("invalid lsd port")
+	}
+	infoHashes := make([]string, 0)
+	for _, value := range req.Header.Values("Infohash") {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(infoHash) != 20 {
+			continue
+		}
+		infoHashes = append(infoHashes, string(infoHash))
+	}
+	if len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("lsd announce has no infohash")
+	}
+	return port, infoHashes, req.Header.Get("Cookie"), nil
+}
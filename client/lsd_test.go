@@ -0,0 +1,142 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLSDBus 内存中的"组播组", 发送的报文会被所有成员(包括自己)收到
+type memLSDBus struct {
+	mu      sync.Mutex
+	members []*memLSDTransport
+}
+
+type memLSDTransport struct {
+	bus    *memLSDBus
+	addr   *net.UDPAddr
+	inbox  chan memLSDPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+type memLSDPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func (bus *memLSDBus) join(ip string) *memLSDTransport {
+	transport := &memLSDTransport{
+		bus:    bus,
+		addr:   &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771},
+		inbox:  make(chan memLSDPacket, 16),
+		closed: make(chan struct{}),
+	}
+	bus.mu.Lock()
+	bus.members = append(bus.members, transport)
+	bus.mu.Unlock()
+	return transport
+}
+
+func (transport *memLSDTransport) Send(data []byte) error {
+	transport.bus.mu.Lock()
+	defer transport.bus.mu.Unlock()
+	for _, member := range transport.bus.members {
+		select {
+		case member.inbox <- memLSDPacket{data: data, from: transport.addr}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (transport *memLSDTransport) Receive() ([]byte, *net.UDPAddr, error) {
+	select {
+	case packet := <-transport.inbox:
+		return packet.data, packet.from, nil
+	case <-transport.closed:
+		return nil, nil, errors.New("closed")
+	}
+}
+
+func (transport *memLSDTransport) Close() error {
+	transport.once.Do(func() { close(transport.closed) })
+	return nil
+}
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	data := encodeLSDAnnounce(6881, []string{testInfoHash, "bbbbbbbbbbbbbbbbbbbb"}, "abc")
+	port, infoHashes, cookie, err := parseLSDAnnounce(data)
+	if err != nil {
+		t.Fatal("Error parsing lsd announce: ", err)
+	}
+	if port != 6881 || cookie != "abc" || len(infoHashes) != 2 || infoHashes[0] != testInfoHash {
+		t.Errorf("Unexpected lsd announce: %d %q %q", port, infoHashes, cookie)
+	}
+	if _, _, _, err := parseLSDAnnounce([]byte("GET / HTTP/1.1\r\nPort: 1\r\n\r\n")); err == nil {
+		t.Error("Expected non BT-SEARCH request to be rejected")
+	}
+}
+
+func TestLSDDiscoversOtherNodes(t *testing.T) {
+	bus := &memLSDBus{}
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+
+	found := make(chan *Peer, 4)
+	first := NewLSD(bus.join("192.168.1.10"), 6881)
+	first.Add(testInfoHash, func(peer *Peer) { found <- peer })
+	second := NewLSD(bus.join("192.168.1.11"), 6882)
+	second.Add(testInfoHash, func(peer *Peer) { found <- peer })
+	other := NewLSD(bus.join("192.168.1.12"), 6883)
+	other.Add("bbbbbbbbbbbbbbbbbbbb", func(peer *Peer) { found <- peer })
+
+	go first.Run(cancelChan)
+	go second.Run(cancelChan)
+	go other.Run(cancelChan)
+
+	peers := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+	for len(peers) < 2 {
+		select {
+		case peer := <-found:
+			peers[peerAddr(peer)] = true
+		case <-timeout:
+			t.Fatal("Timed out waiting for lsd peers, got ", peers)
+		}
+	}
+	if !peers["192.168.1.10:6881"] || !peers["192.168.1.11:6882"] {
+		t.Error("Expected both nodes to discover each other, got ", peers)
+	}
+	select {
+	case peer := <-found:
+		t.Error("Unexpected peer from own or unrelated announce: ", peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientLSDFeedsPeerChan(t *testing.T) {
+	bus := &memLSDBus{}
+	config := DefaultConfig()
+	config.DownloaderNum = 2
+	config.LSDTransport = bus.join("192.168.1.10")
+	c, err := NewClientWithConfig(testMetaInfo(8, 16384), t.TempDir(), config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	go c.FetchPeersFromLSD(c.cancelChan)
+	defer close(c.cancelChan)
+
+	remote := bus.join("192.168.1.20")
+	remote.Send(encodeLSDAnnounce(7000, []string{c.metaInfo.InfoHash}, "remote"))
+	select {
+	case peer := <-c.peerChan:
+		if peerAddr(peer) != "192.168.1.20:7000" {
+			t.Error("Unexpected lsd peer: ", peerAddr(peer))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for lsd peer")
+	}
+}
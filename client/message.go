@@ -2,26 +2,38 @@ package client
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
 )
 
+// maxMessageLength 超过该长度的消息直接断开, 足够容纳最大的分片和bitfield
+const maxMessageLength = 1024 * 1024
+
 type Message struct {
-	typeId  byte
-	payload []byte
+	typeId    byte
+	payload   []byte
+	keepalive bool    // 长度为0的消息, 没有typeId
+	buffer    *[]byte // payload所在的blockPool缓冲区
 }
 
 const (
-	Choke         = 0
-	Unchoke       = 1
-	Interested    = 2
-	NotInterested = 3
-	Have          = 4
-	Bitfield      = 5
-	Request       = 6
-	Piece         = 7
-	Cancel        = 8
-	Keepalive     = 9
+	Choke           = 0
+	Unchoke         = 1
+	Interested      = 2
+	NotInterested   = 3
+	Have            = 4
+	BitfieldMessage = 5
+	Request         = 6
+	Piece           = 7
+	Cancel          = 8
+	Port            = 9 // BEP 5 DHT端口
+	// BEP 6 fast extension
+	SuggestPiece  = 13
+	HaveAll       = 14
+	HaveNone      = 15
+	RejectRequest = 16
+	AllowedFast   = 17
+	Extended      = 20
 )
 
 func NewMessage(typeId byte, payload []byte) *Message {
@@ -47,49 +59,156 @@ func NewCancelMessage(index, begin, length int) *Message {
 	return NewMessage(Cancel, payload)
 }
 
+func NewRejectMessage(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return NewMessage(RejectRequest, payload)
+}
+
+// newIndexMessage 只包含piece index的消息, 比如Allowed Fast
+func newIndexMessage(typeId byte, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return NewMessage(typeId, payload)
+}
+
+func NewPortMessage(port int) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(port))
+	return NewMessage(Port, payload)
+}
+
+func NewPieceMessage(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return NewMessage(Piece, payload)
+}
+
+// ProtocolError 对方违反了协议, 连接应当断开
+type ProtocolError struct {
+	TypeId byte
+	NoType bool // 还没有读到消息类型, 比如长度超限的帧
+	Reason string
+}
+
+func (err *ProtocolError) Error() string {
+	if err.NoType {
+		return "protocol violation: " + err.Reason
+	}
+	return fmt.Sprintf("protocol violation in message %d: %s", err.TypeId, err.Reason)
+}
+
+func protocolErrorf(typeId byte, format string, args ...interface{}) error {
+	return &ProtocolError{TypeId: typeId, Reason: fmt.Sprintf(format, args...)}
+}
+
+// validate 检查payload长度是否符合消息类型, 未知类型的消息不检查
+func (m *Message) validate() error {
+	expected := -1
+	switch m.typeId {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		expected = 0
+	case Have, SuggestPiece, AllowedFast:
+		expected = 4
+	case Request, Cancel, RejectRequest:
+		expected = 12
+	case Port:
+		expected = 2
+	case Piece:
+		if len(m.payload) < 8 || len(m.payload) > 8+maxRequestLength {
+			return protocolErrorf(m.typeId, "piece payload length %d", len(m.payload))
+		}
+	case Extended:
+		if len(m.payload) == 0 {
+			return protocolErrorf(m.typeId, "empty extended message")
+		}
+	}
+	if expected >= 0 && len(m.payload) != expected {
+		return protocolErrorf(m.typeId, "payload length %d, expected %d", len(m.payload), expected)
+	}
+	return nil
+}
+
 func BytesToInt32(bytes []byte) uint32 {
 	return binary.BigEndian.Uint32(bytes)
 }
 
 func ReadMessageFrom(r io.Reader) (*Message, error) {
-	var length uint32
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	return readMessage(r, make([]byte, 5), false)
+}
+
+// readMessage 读取一条消息, header为至少5字节的临时缓冲区
+// pooled时分片消息的payload来自blockPool, 处理完后需要调用Release
+func readMessage(r io.Reader, header []byte, pooled bool) (*Message, error) {
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
 		return nil, err
 	}
-
+	length := binary.BigEndian.Uint32(header[:4])
 	if length == 0 {
-		return &Message{typeId: Keepalive}, nil
+		return &Message{keepalive: true}, nil
+	}
+	if length > maxMessageLength {
+		return nil, &ProtocolError{NoType: true, Reason: fmt.Sprintf("message length %d too large", length)}
+	}
+	if _, err := io.ReadFull(r, header[4:5]); err != nil {
+		return nil, err
 	}
 
-	data := make([]byte, length)
-	if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+	msg := NewMessage(header[4], nil)
+	if length > 1 {
+		if pooled && msg.typeId == Piece && int(length-1) <= blockPayloadSize {
+			msg.buffer = blockPool.Get().(*[]byte)
+			msg.payload = (*msg.buffer)[:length-1]
+		} else {
+			msg.payload = make([]byte, length-1)
+		}
+		if _, err := io.ReadFull(r, msg.payload); err != nil {
+			msg.Release()
+			return nil, err
+		}
+	}
+	if err := msg.validate(); err != nil {
+		msg.Release()
 		return nil, err
 	}
+	return msg, nil
+}
 
-	if length == 1 {
-		return NewMessage(data[0], nil), nil
-	} else {
-		log.Println("length: ", length)
-		return NewMessage(data[0], data[1:]), nil
+// Release 归还分片消息的缓冲区, 之后不能再使用payload
+func (m *Message) Release() {
+	if m.buffer != nil {
+		blockPool.Put(m.buffer)
+		m.buffer = nil
+		m.payload = nil
 	}
 }
 
+func (m *Message) IsKeepalive() bool {
+	return m.keepalive
+}
+
+// WriteTo 先写5字节的长度和id, 再写payload, w带缓冲时不会产生多次系统调用
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
-	if err := binary.Write(w, binary.BigEndian, uint32(len(m.payload)+1)); err != nil {
-		return 0, err
+	if m.keepalive {
+		return 4, SendKeepalive(w)
 	}
-
-	if err := binary.Write(w, binary.BigEndian, m.typeId); err != nil {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(m.payload)+1))
+	header[4] = m.typeId
+	if _, err := w.Write(header[:]); err != nil {
 		return 0, err
 	}
-
-	if err := binary.Write(w, binary.BigEndian, m.payload); err != nil {
-		return 0, err
+	if _, err := w.Write(m.payload); err != nil {
+		return 5, err
 	}
-
-	return int64(4 + len(m.payload) + 1), nil
+	return int64(5 + len(m.payload)), nil
 }
 
 func SendKeepalive(w io.Writer) error {
-	return binary.Write(w, binary.BigEndian, uint32(0))
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
 }
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func isProtocolError(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr)
+}
+
+func TestReadMessageValidation(t *testing.T) {
+	var huge bytes.Buffer
+	binary.Write(&huge, binary.BigEndian, uint32(0xffffffff))
+	if _, err := ReadMessageFrom(&huge); !isProtocolError(err) || strings.Contains(err.Error(), "message 0") {
+		t.Error("Expected oversized message to be rejected without a message type, got ", err)
+	}
+	if _, err := parseBlockRequest(make([]byte, 8)); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("message %d", Request)) {
+		t.Error("Expected short request to be reported as a request, got ", err)
+	}
+
+	invalid := []*Message{
+		NewMessage(Have, []byte{0, 0, 1}),
+		NewMessage(Unchoke, []byte{0}),
+		NewMessage(Request, make([]byte, 8)),
+		NewMessage(Piece, make([]byte, 4)),
+		NewMessage(Piece, make([]byte, 9+maxRequestLength)),
+		NewMessage(Extended, nil),
+		NewMessage(Port, []byte{0x1a}),
+	}
+	for _, msg := range invalid {
+		var buf bytes.Buffer
+		msg.WriteTo(&buf)
+		if _, err := ReadMessageFrom(&buf); !isProtocolError(err) {
+			t.Errorf("Expected message %d with payload length %d to be rejected, got %v", msg.typeId, len(msg.payload), err)
+		}
+	}
+
+	valid := []*Message{
+		NewRequestMessage(1, 0, 16384),
+		NewPieceMessage(1, 0, make([]byte, 16384)),
+		newIndexMessage(Have, 3),
+		NewMessage(BitfieldMessage, []byte{0xff, 0x80}),
+		NewPortMessage(6881),
+		NewMessage(99, []byte{1, 2, 3}), // 未知的消息类型被忽略
+	}
+	for _, msg := range valid {
+		var buf bytes.Buffer
+		msg.WriteTo(&buf)
+		if _, err := ReadMessageFrom(&buf); err != nil {
+			t.Errorf("Expected message %d to be accepted, got %v", msg.typeId, err)
+		}
+	}
+}
+
+func TestDownloaderDisconnectsOnProtocolViolation(t *testing.T) {
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	source := newTestPieceSource(8)
+	errChan := make(chan error, 1)
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go func() { errChan <- downloader.Download(source, make(chan SavePieceTask), cancelChan) }()
+
+	newIndexMessage(Have, 8).WriteTo(remote)
+	select {
+	case err := <-errChan:
+		if !isProtocolError(err) {
+			t.Error("Expected protocol error, got ", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected downloader to disconnect")
+	}
+}
+
+func TestClientCountsProtocolErrors(t *testing.T) {
+	c := newListeningClient(t, 10)
+	conn, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000001")
+	if !ok {
+		t.Fatal("Expected handshake response")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	// bitfield只能是第一条消息
+	NewMessage(BitfieldMessage, []byte{0xff}).WriteTo(conn)
+	if !waitDownloaders(c, 0) {
+		t.Fatal("Expected peer to be disconnected")
+	}
+	if errors := c.GetDownloadProcess()["protocol_errors"]; errors != "1" {
+		t.Error("Expected one protocol error, got ", errors)
+	}
+}
+
+func TestKeepaliveIsNotPort(t *testing.T) {
+	var buf bytes.Buffer
+	SendKeepalive(&buf)
+	NewPortMessage(6881).WriteTo(&buf)
+	msg, err := ReadMessageFrom(&buf)
+	if err != nil || !msg.IsKeepalive() {
+		t.Fatal("Expected keepalive, got ", msg, err)
+	}
+	msg, err = ReadMessageFrom(&buf)
+	if err != nil || msg.IsKeepalive() || msg.typeId != Port || binary.BigEndian.Uint16(msg.payload) != 6881 {
+		t.Error("Expected port message, got ", msg, err)
+	}
+}
+
+func TestDownloaderExchangesPort(t *testing.T) {
+	downloader, remote := newSeedingDownloader(nil)
+	defer remote.Close()
+	downloader.reserved[dhtReservedByte] |= dhtReservedBit
+	downloader.dhtPort = 7000
+	ports := make(chan int, 1)
+	downloader.onPort = func(peer *Peer, port int) { ports <- port }
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(newTestPieceSource(8), make(chan SavePieceTask), cancelChan)
+
+	if msg := readMessageTimeout(t, remote); msg.typeId != Port || binary.BigEndian.Uint16(msg.payload) != 7000 {
+		t.Error("Expected our dht port, got ", msg)
+	}
+	SendKeepalive(remote)
+	NewPortMessage(6882).WriteTo(remote)
+	select {
+	case port := <-ports:
+		if port != 6882 {
+			t.Error("Expected announced port 6882, got ", port)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected port message to be handled")
+	}
+}
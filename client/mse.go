@@ -0,0 +1,277 @@
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+)
+
+// EncryptionPolicy 主动连接时是否使用Message Stream Encryption
+type EncryptionPolicy int
+
+const (
+	EncryptionPrefer   EncryptionPolicy = iota // 先尝试加密, 失败后使用明文
+	EncryptionRequire                          // 只接受加密的连接
+	EncryptionDisabled                         // 只使用明文
+)
+
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+
+	mseKeyLength  = 96
+	mseMaxPadding = 512
+	// RC4开头的1024字节被丢弃
+	rc4Discard = 1024
+)
+
+var (
+	// MSE中的768位素数P和生成元G
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	mseVC   = make([]byte, 8)
+
+	errUnknownSkey   = errors.New("mse: unknown info hash")
+	errCryptoRefused = errors.New("mse: no acceptable crypto method")
+)
+
+// cryptoConn 替换net.Conn的读写, 用于RC4加密或者拼接已经读出的数据
+type cryptoConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (conn *cryptoConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *cryptoConn) Write(p []byte) (int, error) {
+	return conn.writer.Write(p)
+}
+
+// prefixConn 把已经读出的数据放回连接的开头
+func prefixConn(conn net.Conn, prefix []byte) net.Conn {
+	return &cryptoConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(prefix), conn), writer: conn}
+}
+
+// mseKeys 生成私钥和96字节的公钥
+func mseKeys() (*big.Int, []byte, error) {
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(mseG, x, mseP)
+	return x, y.FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+// mseSecret 由对方的公钥计算共享密钥S
+func mseSecret(x *big.Int, remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(y, x, mseP).FillBytes(make([]byte, mseKeyLength))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// mseCipher 生成RC4并丢弃开头的1024字节, name为keyA或keyB
+func mseCipher(name string, secret []byte, infoHash string) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, []byte(infoHash)))
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// writePublicKey 发送公钥和随机长度的填充
+func writePublicKey(conn net.Conn, y []byte) error {
+	pad := make([]byte, mrand.Intn(mseMaxPadding+1))
+	rand.Read(pad)
+	_, err := conn.Write(append(append([]byte(nil), y...), pad...))
+	return err
+}
+
+// syncStream 逐字节读取, 直到最后读到的字节等于pattern, 最多跳过mseMaxPadding字节
+func syncStream(conn net.Conn, pattern []byte) error {
+	window := make([]byte, 0, mseMaxPadding+len(pattern))
+	b := make([]byte, 1)
+	for len(window) < cap(window) {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("mse: could not find synchronization pattern")
+}
+
+// selectCrypto 在对方提供的方法中选择, 优先使用RC4
+func selectCrypto(provide uint32, policy EncryptionPolicy) (uint32, error) {
+	if provide&cryptoRC4 != 0 && policy != EncryptionDisabled {
+		return cryptoRC4, nil
+	}
+	if provide&cryptoPlaintext != 0 && policy != EncryptionRequire {
+		return cryptoPlaintext, nil
+	}
+	return 0, errCryptoRefused
+}
+
+// mseInitiate 作为A完成MSE握手, provide为提供的加密方法, 返回之后收发BitTorrent消息的连接
+func mseInitiate(conn net.Conn, infoHash string, provide uint32) (net.Conn, error) {
+	x, ya, err := mseKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := writePublicKey(conn, ya); err != nil {
+		return nil, err
+	}
+	yb := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(conn, yb); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(x, yb)
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	req2 := mseHash([]byte("req2"), []byte(infoHash))
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	payload := make([]byte, 16)
+	copy(payload, mseVC)
+	binary.BigEndian.PutUint32(payload[8:12], provide)
+	encrypt.XORKeyStream(payload, payload)
+	msg := append(mseHash([]byte("req1"), secret), req2...)
+	if _, err := conn.Write(append(msg, payload...)); err != nil {
+		return nil, err
+	}
+
+	// B的回复以加密的VC开头, 之前是B的填充
+	vc := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(vc, mseVC)
+	if err := syncStream(conn, vc); err != nil {
+		return nil, err
+	}
+	reader := cipher.StreamReader{S: decrypt, R: conn}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(header[0:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLength > mseMaxPadding {
+		return nil, fmt.Errorf("mse: padding length %d too large", padLength)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, padLength)); err != nil {
+		return nil, err
+	}
+	switch {
+	case selected == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &cryptoConn{Conn: conn, reader: reader, writer: cipher.StreamWriter{S: encrypt, W: conn}}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return conn, nil
+	}
+	return nil, fmt.Errorf("mse: unexpected crypto method %d", selected)
+}
+
+// mseAccept 作为B完成MSE握手, prefix为检测协议时已经读出的数据
+// policies为可以接受的info_hash -> 加密策略, 返回之后收发BitTorrent消息的连接
+func mseAccept(conn net.Conn, prefix []byte, policies map[string]EncryptionPolicy) (net.Conn, error) {
+	ya := make([]byte, mseKeyLength)
+	copy(ya, prefix)
+	if _, err := io.ReadFull(conn, ya[len(prefix):]); err != nil {
+		return nil, err
+	}
+	x, yb, err := mseKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := writePublicKey(conn, yb); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(x, ya)
+	if err := syncStream(conn, mseHash([]byte("req1"), secret)); err != nil {
+		return nil, err
+	}
+
+	// 由HASH('req2', SKEY)找到对应的torrent
+	skeyHash := make([]byte, 20)
+	if _, err := io.ReadFull(conn, skeyHash); err != nil {
+		return nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range skeyHash {
+		skeyHash[i] ^= req3[i]
+	}
+	infoHash := ""
+	for candidate := range policies {
+		if bytes.Equal(mseHash([]byte("req2"), []byte(candidate)), skeyHash) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == "" {
+		return nil, errUnknownSkey
+	}
+
+	reader := cipher.StreamReader{S: mseCipher("keyA", secret, infoHash), R: conn}
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:8], mseVC) {
+		return nil, errors.New("mse: invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLength > mseMaxPadding {
+		return nil, fmt.Errorf("mse: padding length %d too large", padLength)
+	}
+	rest := make([]byte, padLength+2)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+	initialPayload := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+	if _, err := io.ReadFull(reader, initialPayload); err != nil {
+		return nil, err
+	}
+
+	selected, err := selectCrypto(provide, policies[infoHash])
+	if err != nil {
+		return nil, err
+	}
+	encrypt := mseCipher("keyB", secret, infoHash)
+	reply := make([]byte, 14)
+	copy(reply, mseVC)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if selected == cryptoPlaintext {
+		return prefixConn(conn, initialPayload), nil
+	}
+	return &cryptoConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(initialPayload), reader),
+		writer: cipher.StreamWriter{S: encrypt, W: conn},
+	}, nil
+}
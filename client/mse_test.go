@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair 返回本地TCP连接的两端, net.Pipe没有缓冲, 双方同时写入时会阻塞
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+	conn := <-accepted
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// mseHandshake 双方完成MSE握手, 返回A和B之后使用的连接
+func mseHandshake(t *testing.T, provide uint32, policy EncryptionPolicy) (net.Conn, net.Conn, error, error) {
+	infoHash := "aaaaaaaaaaaaaaaaaaaa"
+	a, b := tcpPair(t)
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		prefix := make([]byte, 20)
+		if _, err := io.ReadFull(b, prefix); err != nil {
+			accepted <- result{nil, err}
+			return
+		}
+		conn, err := mseAccept(b, prefix, map[string]EncryptionPolicy{infoHash: policy, "bbbbbbbbbbbbbbbbbbbb": EncryptionPrefer})
+		if err != nil {
+			b.Close()
+		}
+		accepted <- result{conn, err}
+	}()
+	initiated, err := mseInitiate(a, infoHash, provide)
+	r := <-accepted
+	return initiated, r.conn, err, r.err
+}
+
+func TestMSEHandshake(t *testing.T) {
+	for _, provide := range []uint32{cryptoRC4, cryptoPlaintext, cryptoRC4 | cryptoPlaintext} {
+		a, b, errA, errB := mseHandshake(t, provide, EncryptionPrefer)
+		if errA != nil || errB != nil {
+			t.Fatal("Error in handshake: ", errA, errB)
+		}
+		if _, encrypted := a.(*cryptoConn); encrypted != (provide&cryptoRC4 != 0) {
+			t.Errorf("Unexpected crypto method for provide %d", provide)
+		}
+		// 消息在两个方向上都能正常收发
+		go NewPieceMessage(1, 2, []byte("hello")).WriteTo(a)
+		msg, err := ReadMessageFrom(b)
+		if err != nil || msg.typeId != Piece || !bytes.Equal(msg.payload[8:], []byte("hello")) {
+			t.Fatal("Unexpected message from A: ", msg, err)
+		}
+		go NewMessage(Unchoke, nil).WriteTo(b)
+		if msg, err := ReadMessageFrom(a); err != nil || msg.typeId != Unchoke {
+			t.Fatal("Unexpected message from B: ", msg, err)
+		}
+	}
+}
+
+func TestMSEHandshakeRefused(t *testing.T) {
+	if _, _, errA, errB := mseHandshake(t, cryptoPlaintext, EncryptionRequire); errA == nil || errB != errCryptoRefused {
+		t.Error("Expected plaintext to be refused, got ", errA, errB)
+	}
+	if _, _, errA, errB := mseHandshake(t, cryptoRC4, EncryptionDisabled); errA == nil || errB != errCryptoRefused {
+		t.Error("Expected RC4 to be refused, got ", errA, errB)
+	}
+	a, b := tcpPair(t)
+	go mseInitiate(a, "cccccccccccccccccccc", cryptoRC4)
+	if _, err := mseAccept(b, nil, map[string]EncryptionPolicy{"aaaaaaaaaaaaaaaaaaaa": EncryptionPrefer}); err != errUnknownSkey {
+		t.Error("Expected unknown info hash, got ", err)
+	}
+}
+
+func TestListenerAcceptsEncryptedPeer(t *testing.T) {
+	c := newListeningClient(t, 10)
+	c.config.Encryption = EncryptionRequire
+	peer := &Peer{IP: "127.0.0.1", Port: c.listener.Addr().Port}
+	conn, err := (&PeerDialer{Encryption: EncryptionRequire}).Dial(peer, c.metaInfo.InfoHash)
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+	if _, err := HandShake(peer, handShakeMsg(c.metaInfo, "-FK0001-000000000001"), conn); err != nil {
+		t.Fatal("Error in handshake over encrypted connection: ", err)
+	}
+	NewMessage(BitfieldMessage, []byte{0}).WriteTo(conn)
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+
+	// require时拒绝明文连接
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-FK0001-000000000002"); ok {
+		t.Error("Expected plaintext connection to be rejected")
+	}
+}
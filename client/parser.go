@@ -1,9 +1,11 @@
 package client
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"net"
 )
 
 type MetaInfo struct {
@@ -14,6 +16,7 @@ type MetaInfo struct {
 	CreationDate int
 	Info         Info
 	InfoHash     string
+	InfoBytes    []byte // 原始的info字典, 用于扩展握手中的metadata_size
 }
 
 type Info struct {
@@ -22,6 +25,7 @@ type Info struct {
 	Name        string
 	PieceLength int
 	Pieces      [][20]byte
+	Private     bool
 }
 
 type File struct {
@@ -45,14 +49,19 @@ type Peer struct {
 	Port   int
 }
 
+var errTruncated = errors.New("unexpected end of bencoding data")
+
 func readPeers(data []byte) ([]Peer, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errTruncated
+	}
 	if data[0] == 'l' { //未压缩
-		if data[0] != 'l' {
-			return nil, 0, errors.New("not a bencoding list")
-		}
 		readLen := 1
 		peers := make([]Peer, 0)
 		for {
+			if readLen >= len(data) {
+				return nil, 0, errTruncated
+			}
 			if data[readLen] == 'e' {
 				readLen++
 				break
@@ -83,12 +92,32 @@ func readPeers(data []byte) ([]Peer, int, error) {
 	}
 }
 
+// 压缩的IPv6 peers, 每个peer 18字节
+func readPeers6(data []byte) ([]Peer, int, error) {
+	peerstr, readLen, err := readString(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read compact string peers6 error: %s", err)
+	}
+	if len(peerstr)%18 != 0 {
+		return nil, 0, errors.New("compact string peers6 length error")
+	}
+	peers := make([]Peer, len(peerstr)/18)
+	for i := 0; i < len(peerstr); i += 18 {
+		peers[i/18].IP = net.IP(peerstr[i : i+16]).String()
+		peers[i/18].Port = int(peerstr[i+16])<<8 + int(peerstr[i+17])
+	}
+	return peers, readLen, nil
+}
+
 func readPeer(data []byte, peer *Peer) (int, error) {
-	if data[0] != 'd' {
+	if len(data) == 0 || data[0] != 'd' {
 		return 0, errors.New("not a bencoding dictionary")
 	}
 	readLen := 1
 	for {
+		if readLen >= len(data) {
+			return 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -129,12 +158,15 @@ func readPeer(data []byte, peer *Peer) (int, error) {
 
 func ParseTrackerResponse(data []byte) (*TrackerResponse, error) {
 	readLen := 0
-	if data[readLen] != 'd' {
+	if len(data) == 0 || data[readLen] != 'd' {
 		return nil, errors.New("not a bencoding dictionary")
 	}
 	readLen++
 	trackerResponse := &TrackerResponse{}
 	for {
+		if readLen >= len(data) {
+			return nil, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -182,6 +214,13 @@ func ParseTrackerResponse(data []byte) (*TrackerResponse, error) {
 			if err != nil {
 				return nil, err
 			}
+		case "peers6":
+			var peers6 []Peer
+			peers6, valueLen, err = readPeers6(data[readLen:])
+			if err != nil {
+				return nil, err
+			}
+			trackerResponse.Peers = append(trackerResponse.Peers, peers6...)
 		default:
 			valueLen, err = readUnknown(data[readLen:])
 			if err != nil {
@@ -193,14 +232,55 @@ func ParseTrackerResponse(data []byte) (*TrackerResponse, error) {
 	return trackerResponse, nil
 }
 
+type ScrapeFile struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+// ParseScrapeResponse 解析scrape响应, key为info_hash
+func ParseScrapeResponse(data []byte) (map[string]ScrapeFile, error) {
+	value, err := DecodeBencode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("not a bencoding dictionary")
+	}
+	if reason, ok := dictString(dict, "failure reason"); ok {
+		return nil, errors.New(reason)
+	}
+	files, ok := dictDict(dict, "files")
+	if !ok {
+		return nil, errors.New("scrape response has no files")
+	}
+	result := make(map[string]ScrapeFile, len(files))
+	for infoHash, stats := range files {
+		statsDict, ok := stats.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid scrape file")
+		}
+		file := ScrapeFile{}
+		file.Complete, _ = dictInt(statsDict, "complete")
+		file.Downloaded, _ = dictInt(statsDict, "downloaded")
+		file.Incomplete, _ = dictInt(statsDict, "incomplete")
+		result[infoHash] = file
+	}
+	return result, nil
+}
+
 func ParseMetaInfo(data []byte) (*MetaInfo, error) {
 	readLen := 0
-	if data[readLen] != 'd' {
+	if len(data) == 0 || data[readLen] != 'd' {
 		return nil, errors.New("not a bencoding dictionary")
 	}
 	readLen++
 	metaInfo := &MetaInfo{}
 	for {
+		if readLen >= len(data) {
+			return nil, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -245,6 +325,7 @@ func ParseMetaInfo(data []byte) (*MetaInfo, error) {
 			}
 			sha1bytes := sha1.Sum(data[readLen : readLen+valueLen])
 			metaInfo.InfoHash = string(sha1bytes[:])
+			metaInfo.InfoBytes = append([]byte{}, data[readLen:readLen+valueLen]...)
 		default:
 			valueLen, err = readUnknown(data[readLen:])
 			if err != nil {
@@ -258,6 +339,9 @@ func ParseMetaInfo(data []byte) (*MetaInfo, error) {
 }
 
 func readUnknown(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errTruncated
+	}
 	switch data[0] {
 	case 'i':
 		_, readLen, err := readInt(data)
@@ -274,12 +358,15 @@ func readUnknown(data []byte) (int, error) {
 }
 
 func readDictionary(data []byte) (int, error) {
-	if data[0] != 'd' {
+	if len(data) == 0 || data[0] != 'd' {
 		return 0, errors.New("not a bencoding dictionary")
 	}
 	readLen := 1
 
 	for {
+		if readLen >= len(data) {
+			return 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -301,11 +388,14 @@ func readDictionary(data []byte) (int, error) {
 }
 
 func (metaInfo *MetaInfo) readInfo(data []byte) (int, error) {
-	if data[0] != 'd' {
+	if len(data) == 0 || data[0] != 'd' {
 		return 0, errors.New("invalid info")
 	}
 	readLen := 1
 	for {
+		if readLen >= len(data) {
+			return 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -343,6 +433,13 @@ func (metaInfo *MetaInfo) readInfo(data []byte) (int, error) {
 			if err != nil {
 				return 0, err
 			}
+		case "private":
+			var private int
+			private, valueLen, err = readInt(data[readLen:])
+			if err != nil {
+				return 0, err
+			}
+			metaInfo.Info.Private = private == 1
 		default:
 			valueLen, err = readUnknown(data[readLen:])
 			if err != nil {
@@ -356,11 +453,14 @@ func (metaInfo *MetaInfo) readInfo(data []byte) (int, error) {
 }
 
 func (metaInfo *MetaInfo) readFiles(data []byte) (int, error) {
-	if data[0] != 'l' {
+	if len(data) == 0 || data[0] != 'l' {
 		return 0, errors.New("invalid files")
 	}
 	readLen := 1
 	for {
+		if readLen >= len(data) {
+			return 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -371,6 +471,9 @@ func (metaInfo *MetaInfo) readFiles(data []byte) (int, error) {
 		}
 		readLen++
 		for {
+			if readLen >= len(data) {
+				return 0, errTruncated
+			}
 			if data[readLen] == 'e' {
 				readLen++
 				break
@@ -403,6 +506,8 @@ func (metaInfo *MetaInfo) readFiles(data []byte) (int, error) {
 			readLen += valueLen
 		}
 		metaInfo.Info.Files = append(metaInfo.Info.Files, file)
+		// 多文件torrent没有length, 使用所有文件长度之和
+		metaInfo.Info.Length += file.Length
 	}
 	return readLen, nil
 }
@@ -425,11 +530,14 @@ func (metaInfo *MetaInfo) readPieces(data []byte) (int, error) {
 }
 
 func (metaInfo *MetaInfo) readAnnouceList(data []byte) (int, error) {
-	if data[0] != 'l' {
+	if len(data) == 0 || data[0] != 'l' {
 		return 0, errors.New("invalid announce-list")
 	}
 	readLen := 1
 	for {
+		if readLen >= len(data) {
+			return 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -440,6 +548,9 @@ func (metaInfo *MetaInfo) readAnnouceList(data []byte) (int, error) {
 		readLen++
 		var announceList []string
 		for {
+			if readLen >= len(data) {
+				return 0, errTruncated
+			}
 			if data[readLen] == 'e' {
 				readLen++
 				break
@@ -457,12 +568,15 @@ func (metaInfo *MetaInfo) readAnnouceList(data []byte) (int, error) {
 }
 
 func readList(data []byte) ([]string, int, error) {
-	if data[0] != 'l' {
+	if len(data) == 0 || data[0] != 'l' {
 		return nil, 0, errors.New("invalid list")
 	}
 	readLen := 1
 	var list []string
 	for {
+		if readLen >= len(data) {
+			return nil, 0, errTruncated
+		}
 		if data[readLen] == 'e' {
 			readLen++
 			break
@@ -482,44 +596,55 @@ func readString(data []byte) (string, int, error) {
 	if err != nil {
 		return "", 0, err
 	}
-	return string(data[readLen : readLen+int(lengthPrefix)]), readLen + lengthPrefix, nil
+	return string(data[readLen : readLen+lengthPrefix]), readLen + lengthPrefix, nil
 }
 
+// readLengthPrefix 读取字符串的长度前缀, 保证之后的字符串没有超出data
 func readLengthPrefix(data []byte) (int, int, error) {
-	readLen := 0
+	colon := bytes.IndexByte(data, ':')
+	if colon < 0 {
+		return 0, 0, errTruncated
+	}
+	if colon == 0 || colon > 10 {
+		return 0, 0, errors.New("invalid length-prefix")
+	}
 	lengthPrefix := 0
-	for _, b := range data {
-		if b == ':' {
-			readLen++
-			break
-		} else if b < '0' || b > '9' {
+	for _, b := range data[:colon] {
+		if b < '0' || b > '9' {
 			return 0, 0, errors.New("invalid length-prefix")
-		} else {
-			lengthPrefix = lengthPrefix*10 + int(b-'0')
-			readLen++
 		}
+		lengthPrefix = lengthPrefix*10 + int(b-'0')
+	}
+	readLen := colon + 1
+	if lengthPrefix > len(data)-readLen {
+		return 0, 0, errTruncated
 	}
 	return lengthPrefix, readLen, nil
 }
 
 func readInt(data []byte) (int, int, error) {
-	intVal := 0
-	readLen := 1 //跳过'i'
+	if len(data) == 0 || data[0] != 'i' {
+		return 0, 0, errors.New("invalid integer")
+	}
+	end := bytes.IndexByte(data, 'e')
+	if end < 0 {
+		return 0, 0, errTruncated
+	}
+	digits := data[1:end]
 	factor := 1
-	if data[readLen] == '-' {
+	if len(digits) > 0 && digits[0] == '-' {
 		factor = -1
-		readLen++
+		digits = digits[1:]
 	}
-	for _, b := range data[readLen:] {
-		if b == 'e' {
-			readLen++
-			break
-		} else if b < '0' || b > '9' {
+	if len(digits) == 0 || len(digits) > 18 {
+		return 0, 0, errors.New("invalid integer")
+	}
+	intVal := 0
+	for _, b := range digits {
+		if b < '0' || b > '9' {
 			return 0, 0, errors.New("invalid integer")
-		} else {
-			intVal = intVal*10 + factor*int(b-'0')
-			readLen++
 		}
+		intVal = intVal*10 + factor*int(b-'0')
 	}
-	return intVal, readLen, nil
+	return intVal, end + 1, nil
 }
@@ -81,6 +81,28 @@ func TestParseMetaInfo(t *testing.T) {
 	}
 }
 
+func TestParseTruncatedResponses(t *testing.T) {
+	trackerResponse := []byte("d8:intervali1800e15:warning message4:slow5:peersld2:ip9:127.0.0.14:porti6881eee6:peers66:aaaaaae")
+	metaInfo := []byte("d8:announce35:http://tracker.example.com/announce13:announce-listll35:http://tracker.example.com/announceee4:infod5:filesld6:lengthi1e4:pathl1:aeee4:name4:spam12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee")
+	// 任何位置截断都返回错误而不是越界
+	for i := 0; i < len(trackerResponse); i++ {
+		if _, err := ParseTrackerResponse(trackerResponse[:i]); err == nil {
+			t.Errorf("Expected error for tracker response truncated at %d", i)
+		}
+	}
+	for i := 0; i < len(metaInfo); i++ {
+		if _, err := ParseMetaInfo(metaInfo[:i]); err == nil {
+			t.Errorf("Expected error for metainfo truncated at %d", i)
+		}
+	}
+	invalid := []string{"d8:intervalie", "d8:intervali1x2ee", "d5:peers99:abce", "d5:peersli1eee", "d8:interval5:helloe"}
+	for _, data := range invalid {
+		if _, err := ParseTrackerResponse([]byte(data)); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
+
 func TestParseMetaInfoFile(t *testing.T) {
 	file, err := os.Open("../download/Alpine Standard 3.16.2 x86 64 ISO.torrent")
 	if err != nil {
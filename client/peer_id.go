@@ -0,0 +1,166 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	peerIdLength = 20
+	// Azureus风格: '-' + 两个字母的客户端代码 + 四位版本号 + '-'
+	defaultPeerIdPrefix = "-JB0001-"
+)
+
+// azureusClients Azureus风格peer id中的客户端代码
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"JB": "jBittorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "uTorrent Mac",
+	"UT": "uTorrent",
+	"UW": "uTorrent Web",
+	"XL": "Xunlei",
+}
+
+// shadowClients Shadow风格peer id中的客户端代码, 版本号跟在后面直到'-'
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ClientInfo 由peer id或扩展握手中的v识别出的客户端
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (info ClientInfo) String() string {
+	if info.Name == "" {
+		return "unknown"
+	}
+	if info.Version == "" {
+		return info.Name
+	}
+	return info.Name + " " + info.Version
+}
+
+// generatePeerId 生成prefix开头的peer id, 剩余部分随机填充
+func generatePeerId(prefix string) string {
+	if prefix == "" {
+		prefix = defaultPeerIdPrefix
+	}
+	if len(prefix) > peerIdLength {
+		prefix = prefix[:peerIdLength]
+	}
+	return prefix + randomString(peerIdLength-len(prefix))
+}
+
+// IdentifyClient 优先使用扩展握手中的v, 其次解析peer id
+func IdentifyClient(peerId string, v string) ClientInfo {
+	if v = strings.TrimSpace(v); v != "" {
+		// v通常是"名字 版本号", 比如"uTorrent 3.5.5"
+		if i := strings.LastIndexByte(v, ' '); i > 0 && strings.ContainsAny(v[i+1:], "0123456789") {
+			return ClientInfo{Name: v[:i], Version: v[i+1:]}
+		}
+		return ClientInfo{Name: v}
+	}
+	return decodePeerId(peerId)
+}
+
+// decodePeerId 识别Azureus, Shadow和Mainline风格的peer id, 无法识别时返回空的ClientInfo
+func decodePeerId(peerId string) ClientInfo {
+	if len(peerId) != peerIdLength {
+		return ClientInfo{}
+	}
+	if peerId[0] == '-' && peerId[7] == '-' {
+		name, ok := azureusClients[peerId[1:3]]
+		if !ok {
+			name = peerId[1:3]
+		}
+		return ClientInfo{Name: name, Version: azureusVersion(peerId[3:7])}
+	}
+	// Mainline: M4-3-6--, 版本号各部分用'-'分隔
+	if peerId[0] == 'M' && strings.Contains(peerId[1:8], "-") {
+		parts := strings.Split(strings.TrimRight(peerId[1:8], "-"), "-")
+		if version := strings.Join(parts, "."); isVersion(version) {
+			return ClientInfo{Name: "Mainline", Version: version}
+		}
+	}
+	// Shadow: S58B-----, 没有'-'时多半是随机生成的peer id
+	if name, ok := shadowClients[peerId[0]]; ok && peerId[4] == '-' {
+		if version := shadowVersion(peerId[1:4]); version != "" {
+			return ClientInfo{Name: name, Version: version}
+		}
+	}
+	return ClientInfo{}
+}
+
+// azureusVersion 每个字符是版本号的一部分, 末尾的0省略, 比如3550为3.5.5
+func azureusVersion(digits string) string {
+	parts := versionParts(digits)
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// shadowVersion 版本号到'-'为止, 比如58B为5.8.11
+func shadowVersion(digits string) string {
+	if i := strings.IndexByte(digits, '-'); i >= 0 {
+		digits = digits[:i]
+	}
+	return strings.Join(versionParts(digits), ".")
+}
+
+// versionParts 逐个字符解析版本号, 有无法识别的字符时返回nil
+func versionParts(digits string) []string {
+	parts := make([]string, 0, len(digits))
+	for i := 0; i < len(digits); i++ {
+		value := versionDigit(digits[i])
+		if value < 0 {
+			return nil
+		}
+		parts = append(parts, strconv.Itoa(value))
+	}
+	return parts
+}
+
+// versionDigit 0-9为数字, A-Z为10-35, a-z为36-61, 其他字符返回-1
+func versionDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36
+	}
+	return -1
+}
+
+func isVersion(version string) bool {
+	if version == "" {
+		return false
+	}
+	for _, part := range strings.Split(version, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
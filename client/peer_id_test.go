@@ -0,0 +1,77 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePeerId(t *testing.T) {
+	peerId := generatePeerId("")
+	if len(peerId) != peerIdLength || !strings.HasPrefix(peerId, defaultPeerIdPrefix) {
+		t.Error("Unexpected default peer id: ", peerId)
+	}
+	if info := decodePeerId(peerId); info.Name != "jBittorrent" || info.Version != "0.0.0.1" {
+		t.Error("Expected our own peer id to be identified, got ", info)
+	}
+	if peerId := generatePeerId("-XX1234-"); len(peerId) != peerIdLength || !strings.HasPrefix(peerId, "-XX1234-") {
+		t.Error("Unexpected peer id with custom prefix: ", peerId)
+	}
+	if peerId := generatePeerId(strings.Repeat("x", 25)); peerId != strings.Repeat("x", peerIdLength) {
+		t.Error("Expected long prefix to be truncated, got ", peerId)
+	}
+	if generatePeerId("") == generatePeerId("") {
+		t.Error("Expected random peer ids")
+	}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	cases := []struct {
+		peerId string
+		v      string
+		want   ClientInfo
+	}{
+		{"-UT3550-abcdefghijkl", "", ClientInfo{"uTorrent", "3.5.5"}},
+		{"-qB4250-abcdefghijkl", "", ClientInfo{"qBittorrent", "4.2.5"}},
+		{"-TR294Z-abcdefghijkl", "", ClientInfo{"Transmission", "2.9.4.35"}},
+		{"-ZZ1000-abcdefghijkl", "", ClientInfo{"ZZ", "1.0"}},
+		{"M7-10-3-abcdefghijkl", "", ClientInfo{"Mainline", "7.10.3"}},
+		{"S58B-----abcdefghijk", "", ClientInfo{"Shadow", "5.8.11"}},
+		{"T03I--00000000000000", "", ClientInfo{"BitTornado", "0.3.18"}},
+		// 随机生成的peer id无法识别
+		{"Sx8eUqPz0abcdefghijk", "", ClientInfo{}},
+		{"abcdefghijklmnopqrst", "", ClientInfo{}},
+		{"short", "", ClientInfo{}},
+		// 扩展握手中的v优先
+		{"-UT3550-abcdefghijkl", "uTorrent 3.5.5(45988)", ClientInfo{"uTorrent", "3.5.5(45988)"}},
+		{"abcdefghijklmnopqrst", "Deluge 2.1.1", ClientInfo{"Deluge", "2.1.1"}},
+		{"abcdefghijklmnopqrst", "libTorrent/0.13.8", ClientInfo{Name: "libTorrent/0.13.8"}},
+	}
+	for _, c := range cases {
+		if got := IdentifyClient(c.peerId, c.v); got != c.want {
+			t.Errorf("IdentifyClient(%q, %q) = %+v, want %+v", c.peerId, c.v, got, c.want)
+		}
+	}
+	if s := (ClientInfo{}).String(); s != "unknown" {
+		t.Error("Unexpected unknown client: ", s)
+	}
+	if s := (ClientInfo{"uTorrent", "3.5.5"}).String(); s != "uTorrent 3.5.5" {
+		t.Error("Unexpected client string: ", s)
+	}
+}
+
+func TestPeerStatusIdentifiesClient(t *testing.T) {
+	c := newListeningClient(t, 10)
+	if !strings.HasPrefix(c.peerId, defaultPeerIdPrefix) {
+		t.Error("Expected default peer id prefix, got ", c.peerId)
+	}
+	if _, ok := dialClient(t, c, c.metaInfo.InfoHash, "-qB4250-000000000001"); !ok {
+		t.Fatal("Expected handshake response")
+	}
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	statuses := c.GetPeerStatus()
+	if len(statuses) != 1 || statuses[0].Client != (ClientInfo{"qBittorrent", "4.2.5"}) {
+		t.Errorf("Unexpected peer status: %+v", statuses)
+	}
+}
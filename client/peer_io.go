@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	peerReadBufferSize  = 64 * 1024
+	peerWriteBufferSize = 64 * 1024
+	// 分片消息的payload: index, begin和一个分片的数据
+	blockPayloadSize = 8 + blockLength
+)
+
+// blockPool 复用收到的分片消息的缓冲区
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, blockPayloadSize)
+		return &buf
+	},
+}
+
+// peerIO 一个连接的缓冲读写, 写入的消息在Flush时一起发送
+// 读取只能由一个goroutine调用, 写入由调用方加锁
+type peerIO struct {
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	readHeader [5]byte
+	pieceHead  [13]byte
+}
+
+func newPeerIO(conn io.ReadWriter) *peerIO {
+	return &peerIO{
+		reader: bufio.NewReaderSize(conn, peerReadBufferSize),
+		writer: bufio.NewWriterSize(conn, peerWriteBufferSize),
+	}
+}
+
+// ReadMessage 读取一条消息, 分片消息处理完后需要调用Release
+func (pio *peerIO) ReadMessage() (*Message, error) {
+	return readMessage(pio.reader, pio.readHeader[:], true)
+}
+
+func (pio *peerIO) WriteMessage(msg *Message) error {
+	_, err := msg.WriteTo(pio.writer)
+	return err
+}
+
+// WritePiece 直接写入分片数据, 不复制到新的消息中
+func (pio *peerIO) WritePiece(index, begin int, block []byte) error {
+	binary.BigEndian.PutUint32(pio.pieceHead[0:4], uint32(9+len(block)))
+	pio.pieceHead[4] = Piece
+	binary.BigEndian.PutUint32(pio.pieceHead[5:9], uint32(index))
+	binary.BigEndian.PutUint32(pio.pieceHead[9:13], uint32(begin))
+	if _, err := pio.writer.Write(pio.pieceHead[:]); err != nil {
+		return err
+	}
+	_, err := pio.writer.Write(block)
+	return err
+}
+
+func (pio *peerIO) Flush() error {
+	return pio.writer.Flush()
+}
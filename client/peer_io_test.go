@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// repeatReader 不断重复data, 模拟从socket读取并统计读取次数
+type repeatReader struct {
+	data  []byte
+	pos   int
+	reads int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	r.reads++
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+// countingWriter 丢弃数据并统计写入次数
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func encodedPiece(t testing.TB) []byte {
+	var buf bytes.Buffer
+	NewPieceMessage(3, blockLength, bytes.Repeat([]byte{7}, blockLength)).WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func TestPeerIORoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	wire := newPeerIO(&buf)
+	wire.WriteMessage(NewRequestMessage(1, 0, blockLength))
+	wire.WriteMessage(&Message{keepalive: true})
+	block := bytes.Repeat([]byte{9}, blockLength)
+	wire.WritePiece(1, 0, block)
+	if buf.Len() != 0 {
+		t.Fatal("Expected messages to stay buffered until flush")
+	}
+	wire.Flush()
+
+	if msg, err := wire.ReadMessage(); err != nil || msg.typeId != Request {
+		t.Fatal("Expected request, got ", msg, err)
+	}
+	if msg, err := wire.ReadMessage(); err != nil || !msg.IsKeepalive() {
+		t.Fatal("Expected keepalive, got ", msg, err)
+	}
+	msg, err := wire.ReadMessage()
+	if err != nil || msg.typeId != Piece || msg.buffer == nil {
+		t.Fatal("Expected pooled piece message, got ", msg, err)
+	}
+	if !bytes.Equal(msg.payload[8:], block) || BytesToInt32(msg.payload[0:4]) != 1 {
+		t.Error("Unexpected piece payload")
+	}
+	msg.Release()
+	if msg.payload != nil {
+		t.Error("Expected payload to be cleared after release")
+	}
+	if _, err := wire.ReadMessage(); err != io.EOF {
+		t.Error("Expected EOF, got ", err)
+	}
+}
+
+func BenchmarkReadPieceUnbuffered(b *testing.B) {
+	r := &repeatReader{data: encodedPiece(b)}
+	b.SetBytes(blockLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadMessageFrom(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkReadPieceBuffered(b *testing.B) {
+	r := &repeatReader{data: encodedPiece(b)}
+	wire := newPeerIO(struct {
+		io.Reader
+		io.Writer
+	}{r, io.Discard})
+	b.SetBytes(blockLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg, err := wire.ReadMessage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.Release()
+	}
+	b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkWritePieceUnbuffered(b *testing.B) {
+	w := &countingWriter{}
+	block := make([]byte, blockLength)
+	b.SetBytes(blockLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewPieceMessage(1, 0, block).WriteTo(w)
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+// BenchmarkWritePieceBuffered 与Download循环一样每轮写入4个分片后发送
+func BenchmarkWritePieceBuffered(b *testing.B) {
+	w := &countingWriter{}
+	wire := newPeerIO(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), w})
+	block := make([]byte, blockLength)
+	b.SetBytes(blockLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wire.WritePiece(1, 0, block)
+		if i%4 == 3 {
+			wire.Flush()
+		}
+	}
+	wire.Flush()
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteRequestsUnbuffered(b *testing.B) {
+	w := &countingWriter{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewRequestMessage(1, i*blockLength, blockLength).WriteTo(w)
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+// BenchmarkWriteRequestsBuffered 一轮填满默认深度的请求队列后发送
+func BenchmarkWriteRequestsBuffered(b *testing.B) {
+	w := &countingWriter{}
+	wire := newPeerIO(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), w})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wire.WriteMessage(NewRequestMessage(1, i*blockLength, blockLength))
+		if i%defaultRequestQueueDepth == defaultRequestQueueDepth-1 {
+			wire.Flush()
+		}
+	}
+	wire.Flush()
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
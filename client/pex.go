@@ -0,0 +1,289 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pexName         = "ut_pex"
+	pexInterval     = time.Minute
+	pexMaxPeers     = 50 // BEP 11: 每条消息中added和dropped各不超过50个
+	pexMinRecvDelay = 30 * time.Second
+)
+
+// added.f 中的标志位
+const (
+	pexPreferEncryption = 0x01
+	pexSeed             = 0x02
+	pexSupportsUtp      = 0x04
+	pexHolepunch        = 0x08
+	pexReachable        = 0x10
+)
+
+type pexPeer struct {
+	Peer
+	flags byte
+}
+
+type pexMessage struct {
+	added   []pexPeer
+	dropped []Peer
+}
+
+// pexExtension 实现ut_pex (BEP 11)
+type pexExtension struct {
+	client   *Client
+	mu       sync.Mutex
+	sent     map[*Downloader]map[string]pexPeer // 已经告知该peer的连接
+	lastRecv map[*Downloader]time.Time
+}
+
+func newPexExtension(client *Client) *pexExtension {
+	return &pexExtension{
+		client:   client,
+		sent:     make(map[*Downloader]map[string]pexPeer),
+		lastRecv: make(map[*Downloader]time.Time),
+	}
+}
+
+func (pex *pexExtension) Name() string {
+	return pexName
+}
+
+func (pex *pexExtension) OnHandshake(downloader *Downloader, handshake *ExtendedHandshake) {
+	if handshake.M[pexName] == 0 {
+		return
+	}
+	pex.mu.Lock()
+	defer pex.mu.Unlock()
+	if pex.sent[downloader] == nil {
+		pex.sent[downloader] = make(map[string]pexPeer)
+	}
+}
+
+func (pex *pexExtension) HandleMessage(downloader *Downloader, payload []byte) error {
+	now := time.Now()
+	pex.mu.Lock()
+	// 对方发送过于频繁时忽略, 防止刷屏
+	if last, ok := pex.lastRecv[downloader]; ok && now.Sub(last) < pexMinRecvDelay {
+		pex.mu.Unlock()
+		return nil
+	}
+	pex.lastRecv[downloader] = now
+	pex.mu.Unlock()
+
+	msg, err := parsePexMessage(payload)
+	if err != nil {
+		return err
+	}
+	added := msg.added
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+	newPeers := 0
+	seeding := pex.client.seeding()
+	for i := range added {
+		// 做种时不需要连接其他种子
+		if seeding && added[i].flags&pexSeed != 0 {
+			continue
+		}
+		peer := added[i].Peer
+		if pex.client.addPeer(&peer, false) {
+			newPeers++
+		}
+	}
+	log.Printf("downloader %d pex: %d added, %d dropped, %d new", downloader.Id, len(msg.added), len(msg.dropped), newPeers)
+	return nil
+}
+
+// run 每分钟向支持ut_pex的peer发送连接变化
+func (pex *pexExtension) run(cancelChan <-chan struct{}) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancelChan:
+			return
+		case <-ticker.C:
+			pex.sendUpdates()
+		}
+	}
+}
+
+func (pex *pexExtension) sendUpdates() {
+	downloaders := pex.client.activeDownloaders()
+	connected := make(map[string]pexPeer, len(downloaders))
+	active := make(map[*Downloader]bool, len(downloaders))
+	for _, downloader := range downloaders {
+		active[downloader] = true
+		if peer, ok := pexPeerOf(downloader); ok {
+			connected[peerAddr(&peer.Peer)] = peer
+		}
+	}
+
+	pex.mu.Lock()
+	// 清理已断开的连接
+	for downloader := range pex.sent {
+		if !active[downloader] {
+			delete(pex.sent, downloader)
+			delete(pex.lastRecv, downloader)
+		}
+	}
+	updates := make(map[*Downloader]*pexMessage)
+	for downloader, sent := range pex.sent {
+		self := ""
+		if peer, ok := pexPeerOf(downloader); ok {
+			self = peerAddr(&peer.Peer)
+		}
+		msg := &pexMessage{}
+		for addr, peer := range connected {
+			if _, ok := sent[addr]; !ok && addr != self && len(msg.added) < pexMaxPeers {
+				msg.added = append(msg.added, peer)
+				sent[addr] = peer
+			}
+		}
+		for addr, peer := range sent {
+			if _, ok := connected[addr]; !ok && len(msg.dropped) < pexMaxPeers {
+				msg.dropped = append(msg.dropped, peer.Peer)
+				delete(sent, addr)
+			}
+		}
+		if len(msg.added) > 0 || len(msg.dropped) > 0 {
+			updates[downloader] = msg
+		}
+	}
+	pex.mu.Unlock()
+
+	for downloader, msg := range updates {
+		payload, err := msg.encode()
+		if err != nil {
+			log.Println("Error encoding pex message: ", err)
+			continue
+		}
+		if err := downloader.SendExtended(pexName, payload); err != nil {
+			log.Printf("downloader %d error sending pex message: %s", downloader.Id, err)
+		}
+	}
+}
+
+// pexPeerOf 返回可以分享给其他peer的地址
+func pexPeerOf(downloader *Downloader) (pexPeer, bool) {
+	peer := pexPeer{Peer: *downloader.peer, flags: pexReachable}
+	if downloader.inbound {
+		// 被动连接的端口是临时端口, 只有对方在扩展握手中告知了监听端口才能分享
+		handshake := downloader.ExtendedHandshake()
+		if handshake == nil || handshake.P <= 0 {
+			return peer, false
+		}
+		peer.Port = handshake.P
+		peer.flags = 0
+	}
+	return peer, true
+}
+
+func (msg *pexMessage) encode() ([]byte, error) {
+	added, addedFlags := make([]byte, 0), make([]byte, 0)
+	added6, added6Flags := make([]byte, 0), make([]byte, 0)
+	dropped, dropped6 := make([]byte, 0), make([]byte, 0)
+	for _, peer := range msg.added {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			added = appendCompactPeer(added, ip4, peer.Port)
+			addedFlags = append(addedFlags, peer.flags)
+		} else {
+			added6 = appendCompactPeer(added6, ip.To16(), peer.Port)
+			added6Flags = append(added6Flags, peer.flags)
+		}
+	}
+	for _, peer := range msg.dropped {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			dropped = appendCompactPeer(dropped, ip4, peer.Port)
+		} else {
+			dropped6 = appendCompactPeer(dropped6, ip.To16(), peer.Port)
+		}
+	}
+	return Bencode(map[string]interface{}{
+		"added":    added,
+		"added.f":  addedFlags,
+		"added6":   added6,
+		"added6.f": added6Flags,
+		"dropped":  dropped,
+		"dropped6": dropped6,
+	})
+}
+
+func parsePexMessage(payload []byte) (*pexMessage, error) {
+	value, err := DecodeBencode(payload)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("pex message is not a dictionary")
+	}
+	msg := &pexMessage{}
+	for _, family := range []struct {
+		added, flags, dropped string
+		ipLen                 int
+	}{{"added", "added.f", "dropped", 4}, {"added6", "added6.f", "dropped6", 16}} {
+		added, _ := dictString(dict, family.added)
+		flags, _ := dictString(dict, family.flags)
+		peers, err := parseCompactPeers(added, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		for i, peer := range peers {
+			pexPeer := pexPeer{Peer: peer}
+			// added.f 是可选的, 长度不一致时忽略
+			if len(flags) == len(peers) {
+				pexPeer.flags = flags[i]
+			}
+			msg.added = append(msg.added, pexPeer)
+		}
+		dropped, _ := dictString(dict, family.dropped)
+		peers, err = parseCompactPeers(dropped, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		msg.dropped = append(msg.dropped, peers...)
+	}
+	return msg, nil
+}
+
+func parseCompactPeers(data string, ipLen int) ([]Peer, error) {
+	entryLen := ipLen + 2
+	if len(data)%entryLen != 0 {
+		return nil, errors.New("compact peers length error")
+	}
+	peers := make([]Peer, 0, len(data)/entryLen)
+	for i := 0; i < len(data); i += entryLen {
+		port := int(binary.BigEndian.Uint16([]byte(data[i+ipLen : i+entryLen])))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, Peer{IP: net.IP(data[i : i+ipLen]).String(), Port: port})
+	}
+	return peers, nil
+}
+
+func appendCompactPeer(buf []byte, ip net.IP, port int) []byte {
+	buf = append(buf, ip...)
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+func peerAddr(peer *Peer) string {
+	return net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	msg := &pexMessage{
+		added: []pexPeer{
+			{Peer: Peer{IP: "10.0.0.1", Port: 6881}, flags: pexSeed | pexReachable},
+			{Peer: Peer{IP: "2001:db8::1", Port: 51413}, flags: pexSupportsUtp},
+		},
+		dropped: []Peer{{IP: "10.0.0.2", Port: 6882}, {IP: "2001:db8::2", Port: 6883}},
+	}
+	payload, err := msg.encode()
+	if err != nil {
+		t.Fatal("Error encoding pex message: ", err)
+	}
+	decoded, err := parsePexMessage(payload)
+	if err != nil {
+		t.Fatal("Error parsing pex message: ", err)
+	}
+	if len(decoded.added) != 2 || decoded.added[0].Peer != msg.added[0].Peer || decoded.added[0].flags != pexSeed|pexReachable ||
+		decoded.added[1].Peer != msg.added[1].Peer || decoded.added[1].flags != pexSupportsUtp {
+		t.Errorf("Unexpected added peers: %+v", decoded.added)
+	}
+	if len(decoded.dropped) != 2 || decoded.dropped[0] != msg.dropped[0] || decoded.dropped[1] != msg.dropped[1] {
+		t.Errorf("Unexpected dropped peers: %+v", decoded.dropped)
+	}
+}
+
+func TestPexFeedsPeerChanWithLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.DownloaderNum = 4
+	c, err := NewClientWithConfig(testMetaInfo(8, 16384), t.TempDir(), config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	msg := &pexMessage{}
+	for i := 0; i < 60; i++ {
+		msg.added = append(msg.added, pexPeer{Peer: Peer{IP: fmt.Sprintf("10.0.0.%d", i+1), Port: 6881}})
+	}
+	payload, _ := msg.encode()
+	downloader := &Downloader{peer: &Peer{IP: "10.1.1.1", Port: 6881}}
+
+	if err := c.pex.HandleMessage(downloader, payload); err != nil {
+		t.Fatal("Error handling pex message: ", err)
+	}
+	first := make(map[string]bool)
+	for len(c.peerChan) > 0 {
+		first[peerAddr(<-c.peerChan)] = true
+	}
+	if len(first) != 4 {
+		t.Fatal("Expected peerChan to be filled with 4 peers, got ", len(first))
+	}
+
+	// 频繁发送的消息被忽略
+	if err := c.pex.HandleMessage(downloader, payload); err != nil {
+		t.Fatal("Error handling pex message: ", err)
+	}
+	if len(c.peerChan) != 0 {
+		t.Error("Expected pex message within the minimum delay to be ignored")
+	}
+
+	delete(c.pex.lastRecv, downloader)
+	if err := c.pex.HandleMessage(downloader, payload); err != nil {
+		t.Fatal("Error handling pex message: ", err)
+	}
+	for len(c.peerChan) > 0 {
+		addr := peerAddr(<-c.peerChan)
+		if first[addr] {
+			t.Error("Expected already offered peer to be deduplicated: ", addr)
+		}
+	}
+}
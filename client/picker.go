@@ -0,0 +1,250 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// 已有的piece少于该数量时随机选择, 尽快得到可以上传的数据
+const defaultRandomFirstPieces = 4
+
+// PiecePicker 记录每个piece的可用度, 选择下一个要从peer下载的piece
+type PiecePicker interface {
+	AddPeer(bitfield *Bitfield)
+	RemovePeer(bitfield *Bitfield)
+	PeerHave(index int)
+	// Interesting peer拥有的piece中我们还需要的部分
+	Interesting(bitfield *Bitfield) *Bitfield
+	// Wanted piece是否还需要下载
+	Wanted(index int) bool
+	// Pick 选择peer拥有的、尚未下载的piece, 并标记为下载中
+	Pick(bitfield *Bitfield) (int, bool)
+	// Unpicked 是否还有某个peer拥有、需要下载但尚未分配的piece
+	Unpicked() bool
+	// Abort 下载失败, piece可以重新分配
+	Abort(index int)
+	// Done piece已经校验并保存
+	Done(index int)
+}
+
+// StreamingPicker 支持在读取位置之后按顺序下载的picker
+type StreamingPicker interface {
+	PiecePicker
+	// SetStreaming 顺序下载[start, end)中读取位置之后的window个piece, window为0时关闭
+	SetStreaming(start, end, window int)
+	SetCursor(index int)
+}
+
+type pieceState byte
+
+const (
+	pieceMissing pieceState = iota
+	pieceDownloading
+	pieceDone
+)
+
+// RarestFirstPicker 优先下载优先级最高的piece, 相同优先级中选择拥有的peer最少的
+// 开启流式下载时, 读取位置之后窗口内的piece按顺序优先下载
+type RarestFirstPicker struct {
+	mu           sync.Mutex
+	availability []int
+	states       []pieceState
+	priorities   []FilePriority
+	doneNum      int
+	randomFirst  int
+
+	streamStart int
+	streamEnd   int
+	window      int
+	cursor      int
+}
+
+func NewRarestFirstPicker(pieceNum int, randomFirst int) *RarestFirstPicker {
+	priorities := make([]FilePriority, pieceNum)
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	return &RarestFirstPicker{
+		availability: make([]int, pieceNum),
+		states:       make([]pieceState, pieceNum),
+		priorities:   priorities,
+		randomFirst:  randomFirst,
+	}
+}
+
+func (picker *RarestFirstPicker) AddPeer(bitfield *Bitfield) {
+	picker.updateAvailability(bitfield, 1)
+}
+
+func (picker *RarestFirstPicker) RemovePeer(bitfield *Bitfield) {
+	picker.updateAvailability(bitfield, -1)
+}
+
+func (picker *RarestFirstPicker) updateAvailability(bitfield *Bitfield, delta int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for i := range picker.availability {
+		if bitfield.Has(i) {
+			picker.availability[i] += delta
+		}
+	}
+}
+
+func (picker *RarestFirstPicker) PeerHave(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.availability) {
+		picker.availability[index]++
+	}
+}
+
+func (picker *RarestFirstPicker) Interesting(bitfield *Bitfield) *Bitfield {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	interesting := NewBitfield(bitfield.Len())
+	bitfield.ForEach(func(index int) {
+		if picker.wantedLocked(index) {
+			interesting.Set(index)
+		}
+	})
+	return interesting
+}
+
+func (picker *RarestFirstPicker) Wanted(index int) bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	return picker.wantedLocked(index)
+}
+
+func (picker *RarestFirstPicker) wantedLocked(index int) bool {
+	return index >= 0 && index < len(picker.states) && picker.states[index] != pieceDone && picker.priorities[index] != PrioritySkip
+}
+
+func (picker *RarestFirstPicker) Pick(bitfield *Bitfield) (int, bool) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index, ok := picker.pickInWindow(bitfield); ok {
+		return index, true
+	}
+	random := picker.doneNum < picker.randomFirst
+	candidates := make([]int, 0)
+	rarest := 0
+	highest := PriorityLow
+	for i, state := range picker.states {
+		if state != pieceMissing || picker.priorities[i] < highest || !bitfield.Has(i) {
+			continue
+		}
+		if picker.priorities[i] > highest {
+			highest = picker.priorities[i]
+			candidates = candidates[:0]
+		}
+		if !random && len(candidates) > 0 {
+			if picker.availability[i] > rarest {
+				continue
+			} else if picker.availability[i] < rarest {
+				candidates = candidates[:0]
+			}
+		}
+		rarest = picker.availability[i]
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	// 可用度相同时随机选择, 避免所有peer下载同一个piece
+	index := candidates[rand.Intn(len(candidates))]
+	picker.states[index] = pieceDownloading
+	return index, true
+}
+
+func (picker *RarestFirstPicker) Unpicked() bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for i, state := range picker.states {
+		if state == pieceMissing && picker.priorities[i] != PrioritySkip && picker.availability[i] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pickInWindow 按顺序选择窗口内的piece, 调用方需持有锁
+func (picker *RarestFirstPicker) pickInWindow(bitfield *Bitfield) (int, bool) {
+	if picker.window <= 0 {
+		return 0, false
+	}
+	end := picker.cursor + picker.window
+	if end > picker.streamEnd {
+		end = picker.streamEnd
+	}
+	for i := picker.cursor; i < end; i++ {
+		if picker.states[i] == pieceMissing && picker.priorities[i] != PrioritySkip && bitfield.Has(i) {
+			picker.states[i] = pieceDownloading
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (picker *RarestFirstPicker) SetStreaming(start, end, window int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if start < 0 {
+		start = 0
+	}
+	if end > len(picker.states) {
+		end = len(picker.states)
+	}
+	picker.streamStart, picker.streamEnd, picker.window = start, end, window
+	picker.setCursorLocked(start)
+}
+
+func (picker *RarestFirstPicker) SetCursor(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	picker.setCursorLocked(index)
+}
+
+func (picker *RarestFirstPicker) setCursorLocked(index int) {
+	if index < picker.streamStart {
+		index = picker.streamStart
+	}
+	if index > picker.streamEnd {
+		index = picker.streamEnd
+	}
+	picker.cursor = index
+}
+
+func (picker *RarestFirstPicker) Abort(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.states) && picker.states[index] == pieceDownloading {
+		picker.states[index] = pieceMissing
+	}
+}
+
+func (picker *RarestFirstPicker) Done(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.states) && picker.states[index] != pieceDone {
+		picker.states[index] = pieceDone
+		picker.doneNum++
+	}
+}
+
+func (picker *RarestFirstPicker) SetPriority(index int, priority FilePriority) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.priorities) {
+		picker.priorities[index] = priority
+	}
+}
+
+func (picker *RarestFirstPicker) Reset(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.states) && picker.states[index] == pieceDone {
+		picker.states[index] = pieceMissing
+		picker.doneNum--
+	}
+}
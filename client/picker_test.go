@@ -0,0 +1,125 @@
+package client
+
+import "testing"
+
+func TestRarestFirstPicker(t *testing.T) {
+	picker := NewRarestFirstPicker(8, 0)
+	picker.AddPeer(bitfieldOf(0xff))
+	picker.AddPeer(bitfieldOf(0xf0))
+	picker.AddPeer(bitfieldOf(0xc0))
+	picker.PeerHave(5)
+	// 可用度: 0,1 -> 3; 2,3 -> 2; 4,6,7 -> 1; 5 -> 2
+	peer := bitfieldOf(0xff)
+	picked := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		index, ok := picker.Pick(peer)
+		if !ok || (index != 4 && index != 6 && index != 7) {
+			t.Fatal("Expected one of the rarest pieces, got ", index, ok)
+		}
+		picked[index] = true
+	}
+	if len(picked) != 3 {
+		t.Error("Expected pieces in progress not to be picked twice, got ", picked)
+	}
+	if index, _ := picker.Pick(peer); index != 2 && index != 3 && index != 5 {
+		t.Error("Expected next rarest piece, got ", index)
+	}
+
+	picker.Abort(4)
+	if index, _ := picker.Pick(bitfieldOf(0x08)); index != 4 {
+		t.Error("Expected aborted piece to be picked again, got ", index)
+	}
+	if _, ok := picker.Pick(bitfieldOf(0x01)); ok {
+		t.Error("Expected no piece when the peer only has pieces in progress")
+	}
+
+	picker.RemovePeer(bitfieldOf(0xff))
+	picker.Done(0)
+	if index, _ := picker.Pick(bitfieldOf(0xc0)); index != 1 {
+		t.Error("Expected only remaining piece the peer has, got ", index)
+	}
+}
+
+func TestRarestFirstPickerRandomFirst(t *testing.T) {
+	picker := NewRarestFirstPicker(16, 2)
+	picker.AddPeer(bitfieldOf(0xff, 0xff))
+	picker.AddPeer(bitfieldOf(0xff, 0x00))
+	// 随机选择时也会选到非最稀有的piece
+	common := false
+	for i := 0; i < 32 && !common; i++ {
+		index, ok := picker.Pick(bitfieldOf(0xff, 0xff))
+		if !ok {
+			t.Fatal("Expected a piece")
+		}
+		common = index < 8
+		picker.Abort(index)
+	}
+	if !common {
+		t.Error("Expected random first pieces to include common pieces")
+	}
+
+	picker.Done(0)
+	picker.Done(1)
+	for i := 0; i < 8; i++ {
+		index, _ := picker.Pick(bitfieldOf(0xff, 0xff))
+		if index < 8 {
+			t.Error("Expected rarest first after the initial pieces, got ", index)
+		}
+		picker.Abort(index)
+	}
+}
+
+func TestRarestFirstPickerStreaming(t *testing.T) {
+	picker := NewRarestFirstPicker(16, 0)
+	picker.AddPeer(bitfieldOf(0xff, 0xff))
+	picker.AddPeer(bitfieldOf(0x0f, 0xff))
+	picker.SetStreaming(4, 12, 2)
+	for _, expected := range []int{4, 5} {
+		if index, _ := picker.Pick(bitfieldOf(0xff, 0xff)); index != expected {
+			t.Errorf("Expected piece %d in the window, got %d", expected, index)
+		}
+	}
+	// 窗口外按rarest-first
+	if index, _ := picker.Pick(bitfieldOf(0xff, 0xff)); index > 3 {
+		t.Error("Expected rarest piece outside the window, got ", index)
+	}
+
+	picker.SetCursor(10)
+	if index, _ := picker.Pick(bitfieldOf(0xff, 0xff)); index != 10 {
+		t.Error("Expected window to follow the cursor, got ", index)
+	}
+	picker.SetCursor(100)
+	if picker.cursor != 12 {
+		t.Error("Expected cursor to stay inside the stream range, got ", picker.cursor)
+	}
+}
+
+func TestRarestFirstPickerPriority(t *testing.T) {
+	picker := NewRarestFirstPicker(4, 0)
+	picker.AddPeer(bitfieldOf(0xf0))
+	picker.AddPeer(bitfieldOf(0x80))
+	picker.SetPriority(1, PrioritySkip)
+	picker.SetPriority(3, PriorityHigh)
+	if picker.Interesting(bitfieldOf(0x40)).Count() != 0 {
+		t.Error("Expected skipped piece not to be interesting")
+	}
+	// 高优先级优先, 即使不是最稀有的
+	picker.AddPeer(bitfieldOf(0x10))
+	if index, _ := picker.Pick(bitfieldOf(0xf0)); index != 3 {
+		t.Error("Expected high priority piece, got ", index)
+	}
+	if index, _ := picker.Pick(bitfieldOf(0xf0)); index != 2 {
+		t.Error("Expected rarest normal piece, got ", index)
+	}
+	if index, _ := picker.Pick(bitfieldOf(0xf0)); index != 0 {
+		t.Error("Expected remaining normal piece, got ", index)
+	}
+	if _, ok := picker.Pick(bitfieldOf(0xf0)); ok {
+		t.Error("Expected skipped piece not to be picked")
+	}
+	picker.Done(0)
+	picker.Reset(0)
+	if index, _ := picker.Pick(bitfieldOf(0x80)); index != 0 {
+		t.Error("Expected reset piece to be picked again, got ", index)
+	}
+}
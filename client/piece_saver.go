@@ -1,30 +1,38 @@
 package client
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
+// storageFile torrent中的一个文件, 第一次写入时才创建
+type storageFile struct {
+	path   string
+	offset int
+	length int
+	wanted bool
+	file   *os.File
+}
+
 type PieceSaver struct {
-	file             *os.File
+	mu               sync.Mutex
+	files            []*storageFile
 	bitfieldFile     *os.File
 	fixedPieceLength int
 }
 
 func NewPieceSaver(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) (*PieceSaver, error) {
-	filePath := downloadDir + "/" + metaInfo.Info.Name
+	if err := checkFilePaths(&metaInfo.Info); err != nil {
+		return nil, err
+	}
+	rootPath := downloadDir + "/" + metaInfo.Info.Name
 	bitfieldFilePath := bitfieldDir + "/" + metaInfo.Info.Name + ".bitfield"
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// create file
-		file, err := create(filePath)
-		if err != nil {
-			log.Fatal("could not create file: ", filePath, " error: ", err)
-			return nil, err
-		}
-		file.Truncate(int64(metaInfo.Info.Length))
-		file.Close()
-
+	if _, err := os.Stat(rootPath); os.IsNotExist(err) {
 		// delete exist bitfield file
 		if _, err := os.Stat(bitfieldFilePath); err == nil {
 			err := os.Remove(bitfieldFilePath)
@@ -34,11 +42,6 @@ func NewPieceSaver(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) (
 			}
 		}
 	}
-	file, err := os.OpenFile(filePath, os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatal("Error opening file: ", err)
-		return nil, err
-	}
 	if err := os.MkdirAll(bitfieldDir, 0777); err != nil {
 		return nil, err
 	}
@@ -48,29 +51,149 @@ func NewPieceSaver(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) (
 		return nil, err
 	}
 
+	files := make([]*storageFile, 0)
+	for _, file := range torrentFiles(&metaInfo.Info) {
+		path, err := storagePath(downloadDir, file.Path)
+		if err != nil {
+			bifieldFile.Close()
+			return nil, err
+		}
+		files = append(files, &storageFile{
+			path:   path,
+			offset: file.Offset,
+			length: file.Length,
+			wanted: true,
+		})
+	}
 	return &PieceSaver{
-		file:             file,
+		files:            files,
 		bitfieldFile:     bifieldFile,
 		fixedPieceLength: metaInfo.Info.PieceLength,
 	}, nil
 }
 
-func (ps *PieceSaver) SavePiece(saveTask SavePieceTask, bitfield []byte) error {
-	_, err := ps.file.WriteAt(saveTask.Piece, int64(saveTask.PieceIndex*ps.fixedPieceLength))
+// SetFileWanted 不需要的文件不会被创建, 落在其中的数据被丢弃
+func (ps *PieceSaver) SetFileWanted(index int, wanted bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if index >= 0 && index < len(ps.files) {
+		ps.files[index].wanted = wanted
+	}
+}
+
+// openFile 打开文件, mustCreate为true时不存在则创建, 调用方需持有锁
+func (ps *PieceSaver) openFile(file *storageFile, mustCreate bool) (*os.File, error) {
+	if file.file != nil {
+		return file.file, nil
+	}
+	f, err := os.OpenFile(file.path, os.O_RDWR, 0666)
+	if os.IsNotExist(err) && mustCreate {
+		if f, err = create(file.path); err == nil {
+			err = f.Truncate(int64(file.length))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.file = f
+	return f, nil
+}
+
+// spans 对[offset, offset+length)中落在每个文件的部分调用fn
+func (ps *PieceSaver) spans(offset, length int, fn func(file *storageFile, fileOffset, dataOffset, n int) error) error {
+	for _, file := range ps.files {
+		start, end := offset, offset+length
+		if start < file.offset {
+			start = file.offset
+		}
+		if end > file.offset+file.length {
+			end = file.offset + file.length
+		}
+		if start >= end {
+			continue
+		}
+		if err := fn(file, start-file.offset, start-offset, end-start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *PieceSaver) SavePiece(saveTask SavePieceTask, bitfield *Bitfield) error {
+	offset := saveTask.PieceIndex * ps.fixedPieceLength
+	ps.mu.Lock()
+	err := ps.spans(offset, len(saveTask.Piece), func(file *storageFile, fileOffset, dataOffset, n int) error {
+		// 不需要的文件已经存在时仍然写入, 否则丢弃
+		f, err := ps.openFile(file, file.wanted)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(saveTask.Piece[dataOffset:dataOffset+n], int64(fileOffset))
+		return err
+	})
+	ps.mu.Unlock()
 	if err != nil {
 		log.Fatal("Error writing to file: ", err)
 		return err
 	}
-	_, err = ps.bitfieldFile.WriteAt(bitfield, 0)
+	return ps.SaveBitfield(bitfield)
+}
+
+func (ps *PieceSaver) SaveBitfield(bitfield *Bitfield) error {
+	_, err := ps.bitfieldFile.WriteAt(bitfield.Bytes(), 0)
 	return err
 }
 
+// FileExists 文件是否已经在磁盘上创建
+func (ps *PieceSaver) FileExists(index int) bool {
+	if index < 0 || index >= len(ps.files) {
+		return false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.files[index].file != nil {
+		return true
+	}
+	_, err := os.Stat(ps.files[index].path)
+	return err == nil
+}
+
+// ReadBlock 读取piece中的一段, 调用方需保证该piece已经校验并保存
+func (ps *PieceSaver) ReadBlock(index, begin, length int) ([]byte, error) {
+	block := make([]byte, length)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	err := ps.spans(index*ps.fixedPieceLength+begin, length, func(file *storageFile, fileOffset, dataOffset, n int) error {
+		f, err := ps.openFile(file, false)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(block[dataOffset:dataOffset+n], int64(fileOffset))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
 func (ps *PieceSaver) Close() {
-	ps.file.Close()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, file := range ps.files {
+		if file.file != nil {
+			file.file.Close()
+			file.file = nil
+		}
+	}
 	ps.bitfieldFile.Close()
 }
 
-func GetBitfield(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) []byte {
+// GetBitfield 读取保存的下载进度, 旧版本的文件可能多一个字节
+func GetBitfield(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) *Bitfield {
+	pieceNum := len(metaInfo.Info.Pieces)
 	bitfieldFilePath := bitfieldDir + "/" + metaInfo.Info.Name + ".bitfield"
 
 	if _, err := os.Stat(downloadDir + "/" + metaInfo.Info.Name); os.IsNotExist(err) {
@@ -81,13 +204,13 @@ func GetBitfield(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) []b
 				return nil
 			}
 		}
-		return make([]byte, 1+len(metaInfo.Info.Pieces)/8)
+		return NewBitfield(pieceNum)
 	}
 
 	if stat, err := os.Stat(bitfieldFilePath); os.IsNotExist(err) {
-		return make([]byte, 1+len(metaInfo.Info.Pieces)/8)
+		return NewBitfield(pieceNum)
 	} else if stat.Size() == 0 {
-		return make([]byte, 1+len(metaInfo.Info.Pieces)/8)
+		return NewBitfield(pieceNum)
 	}
 	file, err := os.OpenFile(bitfieldFilePath, os.O_RDONLY, 0666)
 	if err != nil {
@@ -95,13 +218,70 @@ func GetBitfield(metaInfo *MetaInfo, downloadDir string, bitfieldDir string) []b
 		return nil
 	}
 	defer file.Close()
-	bitfield := make([]byte, 1+len(metaInfo.Info.Pieces)/8)
-	_, err = file.ReadAt(bitfield, 0)
-	if err != nil {
+	data := make([]byte, (pieceNum+7)/8)
+	n, err := file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
 		log.Fatal("Error reading file: ", err)
 		return nil
 	}
-	return bitfield
+	return loadBitfield(data[:n], pieceNum)
+}
+
+// fileRange 文件在整个torrent中的位置, Path为相对下载目录的路径
+type fileRange struct {
+	Path   string
+	Offset int
+	Length int
+}
+
+// torrentFiles 返回所有文件的位置, 单文件torrent只有一个文件
+func torrentFiles(info *Info) []fileRange {
+	if len(info.Files) == 0 {
+		return []fileRange{{Path: info.Name, Offset: 0, Length: info.Length}}
+	}
+	files := make([]fileRange, 0, len(info.Files))
+	offset := 0
+	for _, file := range info.Files {
+		files = append(files, fileRange{Path: info.Name + "/" + strings.Join(file.Path, "/"), Offset: offset, Length: file.Length})
+		offset += file.Length
+	}
+	return files
+}
+
+// checkFilePaths 名字和路径的每一段都不能为空, "."或"..", 也不能是绝对路径, 避免写到下载目录之外
+func checkFilePaths(info *Info) error {
+	if err := checkPathComponent(info.Name); err != nil {
+		return err
+	}
+	for _, file := range info.Files {
+		if len(file.Path) == 0 {
+			return fmt.Errorf("empty file path")
+		}
+		for _, component := range file.Path {
+			if err := checkPathComponent(component); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkPathComponent(component string) error {
+	if component == "" || component == "." || component == ".." || filepath.IsAbs(component) ||
+		filepath.VolumeName(component) != "" || strings.ContainsAny(component, `/\`) {
+		return fmt.Errorf("invalid path component %q", component)
+	}
+	return nil
+}
+
+// storagePath 文件在磁盘上的路径, 清理后必须仍在下载目录之内
+func storagePath(downloadDir string, path string) (string, error) {
+	p := filepath.Join(downloadDir, filepath.FromSlash(path))
+	rel, err := filepath.Rel(filepath.Clean(downloadDir), p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file path %q is outside the download directory", path)
+	}
+	return p, nil
 }
 
 func create(p string) (*os.File, error) {
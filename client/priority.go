@@ -0,0 +1,218 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// FilePriority 文件的下载优先级, piece的优先级为覆盖的文件中最高的
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (priority FilePriority) String() string {
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Sprintf("priority(%d)", int(priority))
+	}
+	return priorityNames[priority]
+}
+
+func ParseFilePriority(name string) (FilePriority, error) {
+	for i, priorityName := range priorityNames {
+		if name == priorityName {
+			return FilePriority(i), nil
+		}
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority %q", name)
+}
+
+// PriorityPicker 支持按piece设置优先级的picker, 优先级为skip的piece不会被选择
+type PriorityPicker interface {
+	PiecePicker
+	SetPriority(index int, priority FilePriority)
+	// Reset 已完成的piece数据丢失, 需要重新下载
+	Reset(index int)
+}
+
+var errNoPriority = errors.New("piece picker does not support priorities")
+
+// FileStatus 文件的优先级和已下载的字节数
+type FileStatus struct {
+	Path       string
+	Length     int
+	Priority   FilePriority
+	Downloaded int
+}
+
+func (client *Client) GetFiles() []FileStatus {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	files := client.files()
+	statuses := make([]FileStatus, 0, len(files))
+	for i, file := range files {
+		statuses = append(statuses, FileStatus{
+			Path:       file.Path,
+			Length:     file.Length,
+			Priority:   client.priorities[i],
+			Downloaded: client.fileDownloadedLocked(file),
+		})
+	}
+	return statuses
+}
+
+// SetFilePriority 设置文件的优先级, 下载中也可以修改
+// 跳过的文件不会在磁盘上创建, 只有与其他文件共享的piece会被下载
+func (client *Client) SetFilePriority(index int, priority FilePriority) error {
+	file, err := client.file(index)
+	if err != nil {
+		return err
+	}
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", int(priority))
+	}
+	picker, ok := client.picker.(PriorityPicker)
+	if !ok {
+		return errNoPriority
+	}
+	client.mu.Lock()
+	client.priorities[index] = priority
+	start, end := client.pieceRange(file.Offset, file.Length)
+	skipped := make([]int, 0)
+	for i := start; i < end; i++ {
+		piecePriority := client.piecePriorityLocked(i)
+		picker.SetPriority(i, piecePriority)
+		if piecePriority == PrioritySkip {
+			skipped = append(skipped, i)
+		}
+	}
+	if client.storage != nil {
+		client.storage.SetFileWanted(index, priority != PrioritySkip)
+		client.resetMissingFileLocked(index)
+	}
+	client.pieceCond.Broadcast()
+	client.mu.Unlock()
+	// 正在下载的piece不再需要, 取消已发出的请求
+	for _, i := range skipped {
+		client.scheduler.CancelPiece(i)
+	}
+	return nil
+}
+
+// piecePriorityLocked piece的优先级为覆盖的文件中最高的, 调用方需持有锁
+func (client *Client) piecePriorityLocked(index int) FilePriority {
+	pieceStart := index * client.metaInfo.Info.PieceLength
+	pieceEnd := pieceStart + client.pieceLength(index)
+	priority := PrioritySkip
+	for i, file := range client.files() {
+		if file.Offset < pieceEnd && file.Offset+file.Length > pieceStart && client.priorities[i] > priority {
+			priority = client.priorities[i]
+		}
+	}
+	return priority
+}
+
+// resetMissingFileLocked 文件被跳过时丢弃的数据需要重新下载, 调用方需持有锁
+// 需要的文件在磁盘上不存在时, 清除覆盖它的piece
+func (client *Client) resetMissingFileLocked(index int) {
+	picker, ok := client.picker.(PriorityPicker)
+	if !ok || client.priorities[index] == PrioritySkip || client.storage.FileExists(index) {
+		return
+	}
+	file := client.files()[index]
+	start, end := client.pieceRange(file.Offset, file.Length)
+	reset := false
+	for i := start; i < end; i++ {
+		if client.bitField.Has(i) {
+			client.bitField.Clear(i)
+			client.discarded.Clear(i)
+			client.savedNum--
+			picker.Reset(i)
+			reset = true
+		}
+	}
+	if reset {
+		if err := client.storage.SaveBitfield(client.bitField.Snapshot()); err != nil {
+			log.Println("saving bitfield error ", err)
+		}
+	}
+}
+
+// pieceDiscardedLocked piece覆盖的文件在保存后仍不存在时, 落在其中的数据已被丢弃, 调用方需持有锁
+func (client *Client) pieceDiscardedLocked(index int) bool {
+	for i, file := range client.files() {
+		start, end := client.pieceRange(file.Offset, file.Length)
+		if index >= start && index < end && !client.storage.FileExists(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileDownloadedLocked 文件中已保存的字节数, 调用方需持有锁
+func (client *Client) fileDownloadedLocked(file fileRange) int {
+	downloaded := 0
+	start, end := client.pieceRange(file.Offset, file.Length)
+	for i := start; i < end; i++ {
+		if !client.bitField.Has(i) {
+			continue
+		}
+		pieceStart := i * client.metaInfo.Info.PieceLength
+		pieceEnd := pieceStart + client.pieceLength(i)
+		if pieceStart < file.Offset {
+			pieceStart = file.Offset
+		}
+		if pieceEnd > file.Offset+file.Length {
+			pieceEnd = file.Offset + file.Length
+		}
+		downloaded += pieceEnd - pieceStart
+	}
+	return downloaded
+}
+
+// wantedBytes 返回需要的文件中已下载的字节数和总字节数
+func (client *Client) wantedBytes() (int, int) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	downloaded, all := 0, 0
+	for i, file := range client.files() {
+		if client.priorities[i] != PrioritySkip {
+			downloaded += client.fileDownloadedLocked(file)
+			all += file.Length
+		}
+	}
+	return downloaded, all
+}
+
+// wantedCompleteLocked 需要的文件是否都已下载完成, 调用方需持有锁
+func (client *Client) wantedCompleteLocked() bool {
+	for i, file := range client.files() {
+		if client.priorities[i] != PrioritySkip && client.fileDownloadedLocked(file) != file.Length {
+			return false
+		}
+	}
+	return true
+}
+
+// seeding 需要的文件都已下载完成, 只剩上传
+func (client *Client) seeding() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.wantedCompleteLocked()
+}
+
+func (client *Client) hasSkippedLocked() bool {
+	for _, priority := range client.priorities {
+		if priority == PrioritySkip {
+			return true
+		}
+	}
+	return false
+}
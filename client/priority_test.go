@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// piece 0: a + b, piece 1: b, piece 2: b + c
+func testMultiFileMetaInfo() *MetaInfo {
+	metaInfo := testMetaInfo(3, 16384)
+	metaInfo.Info.Files = []File{
+		{Length: 100, Path: []string{"a"}},
+		{Length: 2 * 16384, Path: []string{"dir", "b"}},
+		{Length: 50, Path: []string{"c"}},
+	}
+	metaInfo.Info.Length = 100 + 2*16384 + 50
+	return metaInfo
+}
+
+func TestSkippedFile(t *testing.T) {
+	metaInfo := testMultiFileMetaInfo()
+	dir := t.TempDir()
+	c, err := NewClient(metaInfo, dir, 1)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.storage, err = NewPieceSaver(metaInfo, dir, t.TempDir())
+	if err != nil {
+		t.Fatal("Error opening storage: ", err)
+	}
+	defer c.storage.Close()
+	go c.SavePiece()
+	defer close(c.cancelChan)
+
+	if err := c.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatal("Error setting priority: ", err)
+	}
+	if c.SetFilePriority(3, PriorityHigh) == nil {
+		t.Error("Expected error for unknown file")
+	}
+	if left := c.left(); left != 150 {
+		t.Error("Expected only wanted files to be left, got ", left)
+	}
+	picked := make(map[int]bool)
+	for {
+		index, ok := c.picker.Pick(bitfieldOf(0xe0))
+		if !ok {
+			break
+		}
+		picked[index] = true
+	}
+	if len(picked) != 2 || picked[1] {
+		t.Error("Expected pieces covering wanted files only, got ", picked)
+	}
+
+	content := make([]byte, metaInfo.Info.Length)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	c.saveChan <- SavePieceTask{PieceIndex: 0, Piece: content[:16384]}
+	c.saveChan <- SavePieceTask{PieceIndex: 2, Piece: content[2*16384:]}
+	c.waitPiece(0)
+	c.waitPiece(2)
+
+	if _, err := os.Stat(dir + "/test/dir/b"); !os.IsNotExist(err) {
+		t.Error("Expected skipped file not to be created")
+	}
+	if data, _ := os.ReadFile(dir + "/test/a"); !bytes.Equal(data, content[:100]) {
+		t.Error("Unexpected content of a")
+	}
+	if data, _ := os.ReadFile(dir + "/test/c"); !bytes.Equal(data, content[len(content)-50:]) {
+		t.Error("Unexpected content of c")
+	}
+	files := c.GetFiles()
+	if files[0].Downloaded != 100 || files[1].Priority != PrioritySkip || files[1].Downloaded != 16384 {
+		t.Errorf("Unexpected file status %+v", files)
+	}
+	if c.left() != 0 || !c.seeding() {
+		t.Error("Expected wanted files to be complete")
+	}
+	// 丢弃了部分数据的piece不上传也不通告
+	if c.HavePiece(0) || c.HavePiece(2) || c.advertisedBitfield().Count() != 0 {
+		t.Error("Expected pieces with discarded data not to be served")
+	}
+	if _, err := c.ReadBlock(0, 0, 100); err == nil {
+		t.Error("Expected reading a piece with discarded data to fail")
+	}
+
+	// 跳过的文件被丢弃的数据需要重新下载
+	if err := c.SetFilePriority(1, PriorityHigh); err != nil {
+		t.Fatal("Error setting priority: ", err)
+	}
+	if c.HavePiece(0) || c.HavePiece(2) || c.left() != metaInfo.Info.Length {
+		t.Error("Expected pieces covering the missing file to be downloaded again")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := c.picker.Pick(bitfieldOf(0xe0)); !ok {
+			t.Fatal("Expected all pieces to be picked again")
+		}
+	}
+}
+
+func TestUnsafeFilePaths(t *testing.T) {
+	paths := [][]string{{".."}, {"..", "escape"}, {"dir", "", "a"}, {"."}, {"/etc", "passwd"}, {"a/../../b"}, {}}
+	for _, path := range paths {
+		metaInfo := testMultiFileMetaInfo()
+		metaInfo.Info.Files[1].Path = path
+		if _, err := NewPieceSaver(metaInfo, t.TempDir(), t.TempDir()); err == nil {
+			t.Errorf("Expected path %q to be rejected", path)
+		}
+		if _, err := NewClient(metaInfo, t.TempDir(), 1); err == nil {
+			t.Errorf("Expected client for path %q to be rejected", path)
+		}
+	}
+	metaInfo := testMultiFileMetaInfo()
+	metaInfo.Info.Name = ".."
+	if _, err := NewPieceSaver(metaInfo, t.TempDir(), t.TempDir()); err == nil {
+		t.Error("Expected torrent name '..' to be rejected")
+	}
+}
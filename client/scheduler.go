@@ -0,0 +1,273 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// partialPiece 正在下载的piece, 分片可以来自不同的peer
+type partialPiece struct {
+	task         DownloadPieceTask
+	data         []byte
+	received     []bool
+	receivedNum  int
+	requesters   []map[int]bool // 每个分片 -> 已请求该分片的downloader
+	contributors []string       // 每个分片 -> 提供该分片的peer
+}
+
+func newPartialPiece(task DownloadPieceTask) *partialPiece {
+	blockNum := (task.PieceLength + blockLength - 1) / blockLength
+	piece := &partialPiece{
+		task:         task,
+		data:         make([]byte, task.PieceLength),
+		received:     make([]bool, blockNum),
+		requesters:   make([]map[int]bool, blockNum),
+		contributors: make([]string, blockNum),
+	}
+	for i := range piece.requesters {
+		piece.requesters[i] = make(map[int]bool)
+	}
+	return piece
+}
+
+// block 返回第i个分片的请求
+func (piece *partialPiece) block(i int) blockRequest {
+	begin := i * blockLength
+	length := blockLength
+	if begin+length > piece.task.PieceLength {
+		length = piece.task.PieceLength - begin
+	}
+	return blockRequest{index: piece.task.PieceIndex, begin: begin, length: length}
+}
+
+// blockScheduler 以16KiB的分片为单位把下载分配给peer
+// peer断开时已收到的分片会保留, 所有分片收到后才校验piece
+type blockScheduler struct {
+	mu      sync.Mutex
+	picker  PiecePicker
+	taskFor func(index int) DownloadPieceTask
+	partial map[int]*partialPiece
+	// endgame中分片已由其他peer收到, 通知仍在请求的downloader取消
+	onDuplicate func(downloaderId int, req blockRequest)
+	// peerKey 标识提供分片的peer, downloader断开后id可能被重用
+	peerKey func(downloaderId int) string
+	// onVerified piece校验后通知提供过分片的peer
+	onVerified func(contributors []string, ok bool)
+}
+
+func newBlockScheduler(picker PiecePicker, taskFor func(index int) DownloadPieceTask) *blockScheduler {
+	return &blockScheduler{
+		picker:      picker,
+		taskFor:     taskFor,
+		partial:     make(map[int]*partialPiece),
+		onDuplicate: func(int, blockRequest) {},
+		peerKey:     strconv.Itoa,
+		onVerified:  func([]string, bool) {},
+	}
+}
+
+func (scheduler *blockScheduler) Interesting(bitfield *Bitfield) *Bitfield {
+	return scheduler.picker.Interesting(bitfield)
+}
+
+func (scheduler *blockScheduler) Wanted(index int) bool {
+	return scheduler.picker.Wanted(index)
+}
+
+// RequestBlocks 为peer选择最多n个分片, 优先补全已经开始下载的piece
+func (scheduler *blockScheduler) RequestBlocks(downloaderId int, bitfield *Bitfield, n int) []blockRequest {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	reqs := make([]blockRequest, 0, n)
+	take := func(piece *partialPiece) {
+		for i := range piece.received {
+			if len(reqs) >= n {
+				return
+			}
+			if !piece.received[i] && len(piece.requesters[i]) == 0 {
+				piece.requesters[i][downloaderId] = true
+				reqs = append(reqs, piece.block(i))
+			}
+		}
+	}
+
+	for _, index := range scheduler.sortedPartial() {
+		if bitfield.Has(index) {
+			take(scheduler.partial[index])
+		}
+	}
+	for len(reqs) < n {
+		index, ok := scheduler.picker.Pick(bitfield)
+		if !ok {
+			break
+		}
+		piece := newPartialPiece(scheduler.taskFor(index))
+		scheduler.partial[index] = piece
+		take(piece)
+	}
+	// 其他peer还有未分配的piece时不进入endgame
+	if len(reqs) < n && !scheduler.picker.Unpicked() {
+		reqs = scheduler.endgameBlocks(downloaderId, bitfield, n, reqs)
+	}
+	return reqs
+}
+
+// endgameBlocks 所有分片都已请求后, 向其他peer重复请求未收到的分片, 调用方需持有锁
+func (scheduler *blockScheduler) endgameBlocks(downloaderId int, bitfield *Bitfield, n int, reqs []blockRequest) []blockRequest {
+	type candidate struct {
+		piece *partialPiece
+		block int
+	}
+	candidates := make([]candidate, 0)
+	for _, index := range scheduler.sortedPartial() {
+		piece := scheduler.partial[index]
+		if !bitfield.Has(index) {
+			continue
+		}
+		for i := range piece.received {
+			if piece.received[i] {
+				continue
+			}
+			// 还有未请求的分片时不进入endgame
+			if len(piece.requesters[i]) == 0 {
+				return reqs
+			}
+			if !piece.requesters[i][downloaderId] {
+				candidates = append(candidates, candidate{piece, i})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].piece.requesters[candidates[i].block]) < len(candidates[j].piece.requesters[candidates[j].block])
+	})
+	for _, c := range candidates {
+		if len(reqs) >= n {
+			break
+		}
+		c.piece.requesters[c.block][downloaderId] = true
+		reqs = append(reqs, c.piece.block(c.block))
+	}
+	return reqs
+}
+
+func (scheduler *blockScheduler) sortedPartial() []int {
+	indexes := make([]int, 0, len(scheduler.partial))
+	for index := range scheduler.partial {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// BlockReceived 保存收到的分片, piece完整且校验通过时返回保存任务
+// 校验失败时清空该piece, 之后重新下载
+func (scheduler *blockScheduler) BlockReceived(downloaderId int, req blockRequest, data []byte) (*SavePieceTask, error) {
+	scheduler.mu.Lock()
+	piece, ok := scheduler.partial[req.index]
+	if !ok || req.begin%blockLength != 0 || req.begin/blockLength >= len(piece.received) {
+		scheduler.mu.Unlock()
+		return nil, nil
+	}
+	i := req.begin / blockLength
+	if piece.received[i] || !piece.requesters[i][downloaderId] || piece.block(i) != req || len(data) != req.length {
+		scheduler.mu.Unlock()
+		return nil, nil
+	}
+	copy(piece.data[req.begin:], data)
+	piece.received[i] = true
+	piece.receivedNum++
+	piece.contributors[i] = scheduler.peerKey(downloaderId)
+	duplicates := make([]int, 0)
+	for id := range piece.requesters[i] {
+		if id != downloaderId {
+			duplicates = append(duplicates, id)
+		}
+	}
+	piece.requesters[i] = make(map[int]bool)
+
+	var saveTask *SavePieceTask
+	var err error
+	var contributors []string
+	if piece.receivedNum == len(piece.received) {
+		contributors = append(contributors, piece.contributors...)
+		hash := sha1.Sum(piece.data)
+		if bytes.Equal(hash[:], piece.task.PieceHash[:]) {
+			delete(scheduler.partial, req.index)
+			scheduler.picker.Done(req.index)
+			saveTask = &SavePieceTask{PieceIndex: req.index, Piece: piece.data}
+		} else {
+			err = fmt.Errorf("piece %d hash does not match", req.index)
+			for i := range piece.received {
+				piece.received[i] = false
+			}
+			piece.receivedNum = 0
+			scheduler.dropIfIdle(piece)
+		}
+	}
+	scheduler.mu.Unlock()
+
+	for _, id := range duplicates {
+		scheduler.onDuplicate(id, req)
+	}
+	if contributors != nil {
+		scheduler.onVerified(contributors, err == nil)
+	}
+	return saveTask, err
+}
+
+// AbortBlocks peer被choke、请求超时或断开时, 分片可以重新分配
+func (scheduler *blockScheduler) AbortBlocks(downloaderId int, reqs []blockRequest) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for _, req := range reqs {
+		piece, ok := scheduler.partial[req.index]
+		if !ok || req.begin%blockLength != 0 || req.begin/blockLength >= len(piece.received) {
+			continue
+		}
+		delete(piece.requesters[req.begin/blockLength], downloaderId)
+		scheduler.dropIfIdle(piece)
+	}
+}
+
+// CancelPiece piece不再需要时丢弃已收到的分片, 通知仍在请求的downloader取消
+func (scheduler *blockScheduler) CancelPiece(index int) {
+	scheduler.mu.Lock()
+	piece, ok := scheduler.partial[index]
+	if !ok {
+		scheduler.mu.Unlock()
+		return
+	}
+	delete(scheduler.partial, index)
+	scheduler.picker.Abort(index)
+	requested := make(map[int][]blockRequest)
+	for i, requesters := range piece.requesters {
+		for id := range requesters {
+			requested[id] = append(requested[id], piece.block(i))
+		}
+	}
+	scheduler.mu.Unlock()
+
+	for id, reqs := range requested {
+		for _, req := range reqs {
+			scheduler.onDuplicate(id, req)
+		}
+	}
+}
+
+// dropIfIdle 没有收到任何分片且没有请求的piece交还给picker重新选择, 调用方需持有锁
+func (scheduler *blockScheduler) dropIfIdle(piece *partialPiece) {
+	if piece.receivedNum > 0 {
+		return
+	}
+	for _, requesters := range piece.requesters {
+		if len(requesters) > 0 {
+			return
+		}
+	}
+	delete(scheduler.partial, piece.task.PieceIndex)
+	scheduler.picker.Abort(piece.task.PieceIndex)
+}
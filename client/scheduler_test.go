@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func newTestScheduler(piece []byte) *blockScheduler {
+	task := DownloadPieceTask{PieceIndex: 0, PieceLength: len(piece), PieceHash: sha1.Sum(piece)}
+	return newBlockScheduler(NewRarestFirstPicker(1, 0), func(index int) DownloadPieceTask { return task })
+}
+
+func blockData(piece []byte, req blockRequest) []byte {
+	return piece[req.begin : req.begin+req.length]
+}
+
+func TestBlockSchedulerSharesPieceAcrossPeers(t *testing.T) {
+	piece := bytes.Repeat([]byte{1, 2, 3}, 4*blockLength/3+1)
+	scheduler := newTestScheduler(piece)
+	bitfield := bitfieldOf(0x80)
+
+	first := scheduler.RequestBlocks(1, bitfield, 2)
+	second := scheduler.RequestBlocks(2, bitfield, 3)
+	if len(first) != 2 || len(second) != 3 || second[0].begin != 2*blockLength {
+		t.Fatalf("Expected blocks of one piece to be split over peers, got %+v %+v", first, second)
+	}
+	if last := second[2]; last.length != len(piece)-4*blockLength {
+		t.Error("Expected short last block, got ", last.length)
+	}
+
+	// 第一个peer断开, 已收到的分片保留
+	scheduler.BlockReceived(1, first[0], blockData(piece, first[0]))
+	scheduler.AbortBlocks(1, first[1:])
+	for _, req := range second {
+		if task, _ := scheduler.BlockReceived(2, req, blockData(piece, req)); task != nil {
+			t.Fatal("Expected piece to be incomplete")
+		}
+	}
+	reqs := scheduler.RequestBlocks(2, bitfield, 8)
+	if len(reqs) != 1 || reqs[0] != first[1] {
+		t.Fatalf("Expected only the aborted block to be requested again, got %+v", reqs)
+	}
+	if task, _ := scheduler.BlockReceived(1, reqs[0], blockData(piece, reqs[0])); task != nil {
+		t.Error("Expected block from a peer that did not request it to be ignored")
+	}
+	task, err := scheduler.BlockReceived(2, reqs[0], blockData(piece, reqs[0]))
+	if err != nil || task == nil || !bytes.Equal(task.Piece, piece) {
+		t.Fatal("Expected verified piece, got ", task, err)
+	}
+	if reqs := scheduler.RequestBlocks(3, bitfield, 8); len(reqs) != 0 {
+		t.Error("Expected nothing to request after the piece is done, got ", reqs)
+	}
+}
+
+func TestBlockSchedulerEndgame(t *testing.T) {
+	piece := make([]byte, 2*blockLength)
+	scheduler := newTestScheduler(piece)
+	cancelled := make(map[int][]blockRequest)
+	scheduler.onDuplicate = func(id int, req blockRequest) {
+		cancelled[id] = append(cancelled[id], req)
+	}
+	bitfield := bitfieldOf(0x80)
+
+	slow := scheduler.RequestBlocks(1, bitfield, 8)
+	if len(slow) != 2 {
+		t.Fatal("Expected both blocks, got ", slow)
+	}
+	// 所有分片都已请求, 其他peer重复请求
+	fast := scheduler.RequestBlocks(2, bitfield, 8)
+	if len(fast) != 2 {
+		t.Fatal("Expected endgame requests, got ", fast)
+	}
+	if reqs := scheduler.RequestBlocks(2, bitfield, 8); len(reqs) != 0 {
+		t.Error("Expected no block to be requested twice from the same peer, got ", reqs)
+	}
+	scheduler.BlockReceived(2, fast[0], blockData(piece, fast[0]))
+	task, _ := scheduler.BlockReceived(2, fast[1], blockData(piece, fast[1]))
+	if task == nil {
+		t.Fatal("Expected piece to complete")
+	}
+	if len(cancelled[1]) != 2 || len(cancelled[2]) != 0 {
+		t.Error("Expected duplicate requests of the slow peer to be cancelled, got ", cancelled)
+	}
+}
+
+func TestBlockSchedulerEndgameWaitsForOtherPeers(t *testing.T) {
+	pieces := [][]byte{make([]byte, 2*blockLength), bytes.Repeat([]byte{1}, 2*blockLength)}
+	picker := NewRarestFirstPicker(2, 0)
+	scheduler := newBlockScheduler(picker, func(index int) DownloadPieceTask {
+		return DownloadPieceTask{PieceIndex: index, PieceLength: len(pieces[index]), PieceHash: sha1.Sum(pieces[index])}
+	})
+	slow, other := bitfieldOf(0x80), bitfieldOf(0xc0)
+	picker.AddPeer(slow)
+	picker.AddPeer(other)
+
+	if reqs := scheduler.RequestBlocks(1, slow, 8); len(reqs) != 2 {
+		t.Fatal("Expected both blocks of piece 0, got ", reqs)
+	}
+	// piece 1还没有分配给拥有它的peer, 不重复请求piece 0
+	if reqs := scheduler.RequestBlocks(2, slow, 8); len(reqs) != 0 {
+		t.Error("Expected no duplicate requests before endgame, got ", reqs)
+	}
+	if reqs := scheduler.RequestBlocks(3, other, 2); len(reqs) != 2 || reqs[0].index != 1 {
+		t.Fatal("Expected blocks of piece 1, got ", reqs)
+	}
+	// 所有piece都已分配, 进入endgame
+	if reqs := scheduler.RequestBlocks(2, slow, 8); len(reqs) != 2 || reqs[0].index != 0 {
+		t.Error("Expected endgame requests after every piece is picked, got ", reqs)
+	}
+}
+
+func TestBlockSchedulerHashFailure(t *testing.T) {
+	piece := make([]byte, blockLength)
+	scheduler := newTestScheduler(piece)
+	reqs := scheduler.RequestBlocks(1, bitfieldOf(0x80), 8)
+	task, err := scheduler.BlockReceived(1, reqs[0], bytes.Repeat([]byte{1}, blockLength))
+	if task != nil || err == nil {
+		t.Fatal("Expected hash failure")
+	}
+	reqs = scheduler.RequestBlocks(2, bitfieldOf(0x80), 8)
+	if len(reqs) != 1 {
+		t.Fatal("Expected piece to be downloaded again, got ", reqs)
+	}
+	if task, err := scheduler.BlockReceived(2, reqs[0], piece); task == nil || err != nil {
+		t.Error("Expected piece to verify on retry, got ", err)
+	}
+}
+
+func TestBlockSchedulerReportsContributors(t *testing.T) {
+	piece := make([]byte, 2*blockLength)
+	scheduler := newTestScheduler(piece)
+	var contributors []string
+	var verified bool
+	scheduler.onVerified = func(peers []string, ok bool) {
+		contributors, verified = peers, ok
+	}
+	bitfield := bitfieldOf(0x80)
+	first := scheduler.RequestBlocks(1, bitfield, 1)
+	second := scheduler.RequestBlocks(2, bitfield, 1)
+	scheduler.BlockReceived(1, first[0], bytes.Repeat([]byte{1}, blockLength))
+	if _, err := scheduler.BlockReceived(2, second[0], blockData(piece, second[0])); err == nil {
+		t.Fatal("Expected hash failure")
+	}
+	if verified || len(contributors) != 2 || contributors[0] != "1" || contributors[1] != "2" {
+		t.Error("Expected both peers to be reported, got ", contributors, verified)
+	}
+}
+
+func TestBlockSchedulerCancelPiece(t *testing.T) {
+	piece := make([]byte, 2*blockLength)
+	scheduler := newTestScheduler(piece)
+	cancelled := make(map[int][]blockRequest)
+	scheduler.onDuplicate = func(id int, req blockRequest) {
+		cancelled[id] = append(cancelled[id], req)
+	}
+	bitfield := bitfieldOf(0x80)
+	reqs := scheduler.RequestBlocks(1, bitfield, 2)
+	scheduler.BlockReceived(1, reqs[0], blockData(piece, reqs[0]))
+
+	// 文件被跳过后, 已收到的分片丢弃, 未完成的请求被取消
+	scheduler.CancelPiece(0)
+	if len(scheduler.partial) != 0 {
+		t.Error("Expected partial piece to be dropped")
+	}
+	if len(cancelled[1]) != 1 || cancelled[1][0] != reqs[1] {
+		t.Errorf("Expected outstanding request to be cancelled, got %+v", cancelled)
+	}
+	if task, _ := scheduler.BlockReceived(1, reqs[1], blockData(piece, reqs[1])); task != nil {
+		t.Error("Expected block of a cancelled piece to be ignored")
+	}
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const defaultStreamWindow = 16
+
+var errNotStreaming = errors.New("piece picker does not support streaming")
+
+func (client *Client) files() []fileRange {
+	return torrentFiles(&client.metaInfo.Info)
+}
+
+func (client *Client) file(index int) (fileRange, error) {
+	files := client.files()
+	if index < 0 || index >= len(files) {
+		return fileRange{}, fmt.Errorf("file index %d out of range", index)
+	}
+	return files[index], nil
+}
+
+// pieceRange 返回覆盖[offset, offset+length)的piece范围[start, end)
+func (client *Client) pieceRange(offset, length int) (int, int) {
+	pieceLength := client.metaInfo.Info.PieceLength
+	start := offset / pieceLength
+	end := (offset + length + pieceLength - 1) / pieceLength
+	if length == 0 {
+		end = start
+	}
+	return start, end
+}
+
+// Stream 整个torrent按顺序下载
+func (client *Client) Stream() error {
+	picker, ok := client.picker.(StreamingPicker)
+	if !ok {
+		return errNotStreaming
+	}
+	picker.SetStreaming(0, client.pieceNum, client.streamWindow())
+	return nil
+}
+
+// StreamFile 只对该文件按顺序下载, 其他piece仍然按rarest-first下载
+func (client *Client) StreamFile(index int) error {
+	file, err := client.file(index)
+	if err != nil {
+		return err
+	}
+	picker, ok := client.picker.(StreamingPicker)
+	if !ok {
+		return errNotStreaming
+	}
+	start, end := client.pieceRange(file.Offset, file.Length)
+	picker.SetStreaming(start, end, client.streamWindow())
+	return nil
+}
+
+// SetReadPosition 移动读取位置, offset为在整个torrent中的位置
+func (client *Client) SetReadPosition(offset int) {
+	if picker, ok := client.picker.(StreamingPicker); ok {
+		picker.SetCursor(offset / client.metaInfo.Info.PieceLength)
+	}
+}
+
+func (client *Client) streamWindow() int {
+	if client.config.StreamWindow > 0 {
+		return client.config.StreamWindow
+	}
+	return defaultStreamWindow
+}
+
+// FileReader 按顺序读取文件, 读取时移动读取位置, 数据未下载时等待
+type FileReader struct {
+	client *Client
+	file   fileRange
+	pos    int
+}
+
+// OpenFile 开启该文件的流式下载并返回reader
+func (client *Client) OpenFile(index int) (*FileReader, error) {
+	if err := client.StreamFile(index); err != nil {
+		return nil, err
+	}
+	file, _ := client.file(index)
+	return &FileReader{client: client, file: file}, nil
+}
+
+func (reader *FileReader) Read(p []byte) (int, error) {
+	if reader.pos >= reader.file.Length {
+		return 0, io.EOF
+	}
+	client := reader.client
+	offset := reader.file.Offset + reader.pos
+	pieceLength := client.metaInfo.Info.PieceLength
+	index, begin := offset/pieceLength, offset%pieceLength
+	client.SetReadPosition(offset)
+	if err := client.waitPiece(index); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	if rest := client.pieceLength(index) - begin; n > rest {
+		n = rest
+	}
+	if rest := reader.file.Length - reader.pos; n > rest {
+		n = rest
+	}
+	block, err := client.readSaved(index, begin, n)
+	if err != nil {
+		return 0, err
+	}
+	reader.pos += copy(p, block)
+	return n, nil
+}
+
+func (reader *FileReader) Seek(offset int64, whence int) (int64, error) {
+	pos := int64(reader.pos)
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = int64(reader.file.Length) + offset
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	reader.pos = int(pos)
+	reader.client.SetReadPosition(reader.file.Offset + reader.pos)
+	return pos, nil
+}
+
+// waitPiece 等待piece下载完成, Stop后返回错误
+func (client *Client) waitPiece(index int) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for !client.bitField.Has(index) {
+		select {
+		case <-client.cancelChan:
+			return errors.New("client stopped")
+		default:
+		}
+		client.pieceCond.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFileReaderWaitsForPieces(t *testing.T) {
+	metaInfo := testMetaInfo(4, 16384)
+	metaInfo.Info.Length = 3*16384 + 100
+	dir := t.TempDir()
+	c, err := NewClient(metaInfo, dir, 1)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.storage, err = NewPieceSaver(metaInfo, dir, t.TempDir())
+	if err != nil {
+		t.Fatal("Error opening storage: ", err)
+	}
+	defer c.storage.Close()
+	go c.SavePiece()
+	defer close(c.cancelChan)
+
+	content := make([]byte, metaInfo.Info.Length)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	reader, err := c.OpenFile(0)
+	if err != nil {
+		t.Fatal("Error opening file: ", err)
+	}
+	if _, err := reader.Seek(16384+10, io.SeekStart); err != nil {
+		t.Fatal("Error seeking: ", err)
+	}
+	if picker := c.picker.(*RarestFirstPicker); picker.cursor != 1 {
+		t.Error("Expected seek to move the read cursor, got ", picker.cursor)
+	}
+
+	result := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		result <- data
+	}()
+	// 按逆序保存, reader需要等待前面的piece
+	for i := 3; i >= 1; i-- {
+		end := (i + 1) * 16384
+		if end > len(content) {
+			end = len(content)
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.saveChan <- SavePieceTask{PieceIndex: i, Piece: content[i*16384 : end]}
+	}
+	select {
+	case data := <-result:
+		if !bytes.Equal(data, content[16384+10:]) {
+			t.Error("Unexpected file content")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out reading file")
+	}
+	if c.StreamFile(1) == nil {
+		t.Error("Expected error for unknown file")
+	}
+}
+
+func TestFileReaderNextToSkippedFile(t *testing.T) {
+	metaInfo := testMultiFileMetaInfo()
+	dir := t.TempDir()
+	c, err := NewClient(metaInfo, dir, 1)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.storage, err = NewPieceSaver(metaInfo, dir, t.TempDir())
+	if err != nil {
+		t.Fatal("Error opening storage: ", err)
+	}
+	defer c.storage.Close()
+	go c.SavePiece()
+	defer close(c.cancelChan)
+	if err := c.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatal("Error setting priority: ", err)
+	}
+
+	content := make([]byte, metaInfo.Info.Length)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// piece 0和2与跳过的文件共享, 数据部分被丢弃, 但a和c可以读取
+	c.saveChan <- SavePieceTask{PieceIndex: 0, Piece: content[:16384]}
+	c.saveChan <- SavePieceTask{PieceIndex: 2, Piece: content[2*16384:]}
+	for i, want := range [][]byte{content[:100], nil, content[len(content)-50:]} {
+		if want == nil {
+			continue
+		}
+		reader, err := c.OpenFile(i)
+		if err != nil {
+			t.Fatal("Error opening file: ", err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("Unexpected content of file %d: %v", i, err)
+		}
+	}
+	if c.HavePiece(0) || c.HavePiece(2) {
+		t.Error("Expected pieces with discarded data not to be served")
+	}
+}
@@ -1,14 +1,45 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+const (
+	maxTrackerRedirects = 5
+	trackerRetryBase    = 15 * time.Second
+	trackerRetryMax     = 30 * time.Minute
+)
+
+// TrackerError tracker返回了failure reason
+type TrackerError struct {
+	TrackerUrl string
+	Reason     string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s failure: %s", e.TrackerUrl, e.Reason)
+}
+
+// TrackerStatusError tracker返回了非200状态码且没有failure reason
+type TrackerStatusError struct {
+	TrackerUrl string
+	StatusCode int
+	Status     string
+}
+
+func (e *TrackerStatusError) Error() string {
+	return fmt.Sprintf("tracker %s responded %s", e.TrackerUrl, e.Status)
+}
+
 type TrackerClient struct {
 	httpClient *http.Client
 	trackerUrl string
@@ -26,7 +57,7 @@ type TrackerClient struct {
 
 func NewTrackerClient(trackerUrl string, info_hash string, peer_id string, port int, uploaded int, downloaded int, left int, compact int, numwant int, event string) *TrackerClient {
 	return &TrackerClient{
-		httpClient: &http.Client{},
+		httpClient: newTrackerHttpClient(),
 		trackerUrl: trackerUrl,
 		info_hash:  info_hash,
 		peer_id:    peer_id,
@@ -60,23 +91,92 @@ func (client *TrackerClient) AnnounceWithoutCompact() (*TrackerResponse, error)
 }
 
 // 方便测试
+// failure reason 会以 *TrackerError 返回, 同时返回解析出的响应
 func (client *TrackerClient) AnnounceWithParams(urlParams string) (*TrackerResponse, error) {
-	res, err := client.httpClient.Get(client.trackerUrl + urlParams)
+	req, err := http.NewRequest(http.MethodGet, client.trackerUrl+urlParams, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 显式声明后Transport不会自动解压, 由readTrackerBody处理
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := client.httpClient.Do(req)
 	if err != nil {
 		return nil, err
-	} else if res.StatusCode != 200 {
-		log.Println(res)
-		return nil, errors.New(res.Status)
 	}
 	defer res.Body.Close()
 
+	body, err := readTrackerBody(res)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		// 部分tracker在非200响应中也会返回failure reason
+		if trackerResponse, err := parseTrackerBody(body); err == nil && trackerResponse.FailureReason != "" {
+			return trackerResponse, &TrackerError{TrackerUrl: client.trackerUrl, Reason: trackerResponse.FailureReason}
+		}
+		log.Println(res)
+		return nil, &TrackerStatusError{TrackerUrl: client.trackerUrl, StatusCode: res.StatusCode, Status: res.Status}
+	}
+	trackerResponse, err := parseTrackerBody(body)
+	if err != nil {
+		return nil, err
+	}
+	if trackerResponse.FailureReason != "" {
+		return trackerResponse, &TrackerError{TrackerUrl: client.trackerUrl, Reason: trackerResponse.FailureReason}
+	}
+	return trackerResponse, nil
+}
+
+func newTrackerHttpClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxTrackerRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxTrackerRedirects)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			return nil
+		},
+	}
+}
+
+// readTrackerBody 读取响应, 按Content-Encoding或gzip魔数解压
+func readTrackerBody(res *http.Response) ([]byte, error) {
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
+	if res.Header.Get("Content-Encoding") == "gzip" || bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %s", err)
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+	return body, nil
+}
+
+func parseTrackerBody(body []byte) (*TrackerResponse, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty tracker response")
+	}
 	trackerResponse, err := ParseTrackerResponse(body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("malformed tracker response: %s", err)
 	}
 	return trackerResponse, nil
 }
+
+// trackerRetryDelay 指数退避, 带±25%抖动, 上限trackerRetryMax
+func trackerRetryDelay(failures int) time.Duration {
+	delay := trackerRetryBase
+	for i := 1; i < failures && delay < trackerRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > trackerRetryMax {
+		delay = trackerRetryMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2+1)) - delay/4
+	return delay + jitter
+}
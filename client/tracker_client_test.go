@@ -1,10 +1,15 @@
 package client
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestTrackerClient(t *testing.T) {
@@ -36,3 +41,78 @@ func TestTrackerClient(t *testing.T) {
 		t.Error("Error announcing to tracker: ", err)
 	}
 }
+
+func TestTrackerClientFailureReason(t *testing.T) {
+	server := httptest.NewServer(NewTrackerServer(time.Minute, []string{testInfoHash}))
+	defer server.Close()
+
+	trackerClient := NewTrackerClient(server.URL+"/announce", "bbbbbbbbbbbbbbbbbbbb", "-JB0001-123456789012", 6881, 0, 0, 0, 1, 50, "started")
+	_, err := trackerClient.Announce()
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) {
+		t.Fatal("Expected *TrackerError, got ", err)
+	}
+	if trackerErr.Reason != "torrent not allowed by this tracker" {
+		t.Error("Unexpected failure reason: ", trackerErr.Reason)
+	}
+}
+
+func TestTrackerClientStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	trackerClient := NewTrackerClient(server.URL+"/announce", testInfoHash, "-JB0001-123456789012", 6881, 0, 0, 0, 1, 50, "started")
+	_, err := trackerClient.Announce()
+	var statusErr *TrackerStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected *TrackerStatusError with 503, got ", err)
+	}
+}
+
+func TestTrackerClientGzipRedirectAndWarning(t *testing.T) {
+	body, _ := (&TrackerResponse{WarningMessage: "slow down", Interval: 60, Peers: []Peer{{IP: "10.0.0.1", Port: 6881}}}).Bencode(true, false)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old/announce", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/announce?"+r.URL.RawQuery, http.StatusFound)
+	})
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != testInfoHash {
+			t.Error("Redirect lost the query string")
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		writer.Write(body)
+		writer.Close()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	trackerClient := NewTrackerClient(server.URL+"/old/announce", testInfoHash, "-JB0001-123456789012", 6881, 0, 0, 0, 1, 50, "started")
+	res, err := trackerClient.Announce()
+	if err != nil {
+		t.Fatal("Error announcing to tracker: ", err)
+	}
+	if res.WarningMessage != "slow down" {
+		t.Error("Expected warning message, got ", res.WarningMessage)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].IP != "10.0.0.1" {
+		t.Error("Expected one peer 10.0.0.1, got ", res.Peers)
+	}
+}
+
+func TestTrackerRetryDelay(t *testing.T) {
+	for failures := 1; failures <= 20; failures++ {
+		delay := trackerRetryDelay(failures)
+		if delay < trackerRetryBase*3/4 || delay > trackerRetryMax*5/4 {
+			t.Errorf("Retry delay %s out of range for %d failures", delay, failures)
+		}
+	}
+	if delay := trackerRetryDelay(1); delay > trackerRetryBase*5/4 {
+		t.Error("Expected first retry near the base delay, got ", delay)
+	}
+	if delay := trackerRetryDelay(20); delay < trackerRetryMax*3/4 {
+		t.Error("Expected retries to back off to the maximum delay, got ", delay)
+	}
+}
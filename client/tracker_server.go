@@ -0,0 +1,320 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrackerInterval = 30 * time.Minute
+	defaultTrackerNumwant  = 50
+	maxTrackerNumwant      = 200
+)
+
+type trackerPeer struct {
+	Peer
+	left     int
+	lastSeen time.Time
+}
+
+type trackerTorrent struct {
+	peers      map[string]*trackerPeer // key为peer id
+	downloaded int                     // 完成下载的次数
+}
+
+// TrackerServer 是一个HTTP tracker, 提供 /announce 和 /scrape
+type TrackerServer struct {
+	mu          sync.Mutex
+	torrents    map[string]*trackerTorrent
+	whitelist   map[string]bool // 为nil时接受任意info_hash
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration // 超过该时间未announce的peer会被移除
+	now         func() time.Time
+}
+
+func NewTrackerServer(interval time.Duration, whitelist []string) *TrackerServer {
+	if interval <= 0 {
+		interval = defaultTrackerInterval
+	}
+	server := &TrackerServer{
+		torrents:    make(map[string]*trackerTorrent),
+		Interval:    interval,
+		MinInterval: interval / 2,
+		PeerTTL:     interval * 2,
+		now:         time.Now,
+	}
+	if whitelist != nil {
+		server.whitelist = make(map[string]bool, len(whitelist))
+		for _, infoHash := range whitelist {
+			server.whitelist[infoHash] = true
+		}
+	}
+	return server
+}
+
+// ParseInfoHashList 解析每行一个十六进制info_hash的白名单, 忽略空行和#注释
+func ParseInfoHashList(data string) ([]string, error) {
+	list := make([]string, 0)
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		infoHash, err := hex.DecodeString(line)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("invalid info hash: %s", line)
+		}
+		list = append(list, string(infoHash))
+	}
+	return list, nil
+}
+
+func (server *TrackerServer) ListenAndServe(addr string) error {
+	log.Println("tracker listening on ", addr)
+	return http.ListenAndServe(addr, server)
+}
+
+func (server *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		server.handleAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		server.handleScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *TrackerServer) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	infoHash := query.Get("info_hash")
+	peerId := query.Get("peer_id")
+	if len(infoHash) != 20 {
+		writeTrackerFailure(w, "invalid info_hash")
+		return
+	}
+	if len(peerId) != 20 {
+		writeTrackerFailure(w, "invalid peer_id")
+		return
+	}
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		writeTrackerFailure(w, "invalid port")
+		return
+	}
+	if server.whitelist != nil && !server.whitelist[infoHash] {
+		writeTrackerFailure(w, "torrent not allowed by this tracker")
+		return
+	}
+	left, _ := strconv.Atoi(query.Get("left"))
+	numwant := defaultTrackerNumwant
+	if n, err := strconv.Atoi(query.Get("numwant")); err == nil && n >= 0 {
+		numwant = n
+	}
+	if numwant > maxTrackerNumwant {
+		numwant = maxTrackerNumwant
+	}
+	ip := announceIP(r)
+	event := query.Get("event")
+
+	server.mu.Lock()
+	now := server.now()
+	torrent := server.torrents[infoHash]
+	if torrent == nil {
+		torrent = &trackerTorrent{peers: make(map[string]*trackerPeer)}
+		server.torrents[infoHash] = torrent
+	}
+	server.expirePeers(torrent, now)
+	if event == "stopped" {
+		delete(torrent.peers, peerId)
+	} else {
+		// 第一次announce就是completed时也计入完成次数
+		peer := torrent.peers[peerId]
+		if event == "completed" && (peer == nil || peer.left != 0) {
+			torrent.downloaded++
+		}
+		if peer == nil {
+			peer = &trackerPeer{}
+			torrent.peers[peerId] = peer
+		}
+		peer.PeerId = peerId
+		peer.IP = ip
+		peer.Port = port
+		peer.left = left
+		peer.lastSeen = now
+	}
+	complete, incomplete := torrent.counts()
+	peers := torrent.randomPeers(peerId, numwant)
+	server.mu.Unlock()
+
+	trackerResponse := &TrackerResponse{
+		Interval:    int(server.Interval / time.Second),
+		MinInterval: int(server.MinInterval / time.Second),
+		Complete:    complete,
+		Incomplete:  incomplete,
+		Peers:       peers,
+	}
+	data, err := trackerResponse.Bencode(query.Get("compact") == "1", query.Get("no_peer_id") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+// announceIP 使用连接的来源地址, 只有本机的请求(比如反向代理)可以用ip参数指定地址
+func announceIP(r *http.Request) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if remote := net.ParseIP(ip); remote != nil && remote.IsLoopback() {
+		if param := r.URL.Query().Get("ip"); net.ParseIP(param) != nil {
+			return param
+		}
+	}
+	return ip
+}
+
+func (server *TrackerServer) handleScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+	files := make(map[string]interface{})
+
+	server.mu.Lock()
+	now := server.now()
+	if len(infoHashes) == 0 {
+		for infoHash := range server.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	for _, infoHash := range infoHashes {
+		if server.whitelist != nil && !server.whitelist[infoHash] {
+			continue
+		}
+		torrent := server.torrents[infoHash]
+		if torrent == nil {
+			continue
+		}
+		server.expirePeers(torrent, now)
+		complete, incomplete := torrent.counts()
+		files[infoHash] = map[string]interface{}{
+			"complete":   complete,
+			"downloaded": torrent.downloaded,
+			"incomplete": incomplete,
+		}
+	}
+	server.mu.Unlock()
+
+	data, err := Bencode(map[string]interface{}{"files": files})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+// expirePeers 移除超时的peer, 调用方需持有锁
+func (server *TrackerServer) expirePeers(torrent *trackerTorrent, now time.Time) {
+	for peerId, peer := range torrent.peers {
+		if now.Sub(peer.lastSeen) > server.PeerTTL {
+			delete(torrent.peers, peerId)
+		}
+	}
+}
+
+func (torrent *trackerTorrent) counts() (complete int, incomplete int) {
+	for _, peer := range torrent.peers {
+		if peer.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// randomPeers 随机返回最多numwant个peer, 不包括请求者自己
+func (torrent *trackerTorrent) randomPeers(exclude string, numwant int) []Peer {
+	peers := make([]Peer, 0, len(torrent.peers))
+	for peerId, peer := range torrent.peers {
+		if peerId != exclude {
+			peers = append(peers, peer.Peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > numwant {
+		peers = peers[:numwant]
+	}
+	return peers
+}
+
+// Bencode 将响应编码为 ParseTrackerResponse 可以解析的格式
+// compact时IPv4 peer写入peers, IPv6 peer写入peers6
+func (trackerResponse *TrackerResponse) Bencode(compact bool, noPeerId bool) ([]byte, error) {
+	dict := make(map[string]interface{})
+	if trackerResponse.FailureReason != "" {
+		dict["failure reason"] = trackerResponse.FailureReason
+		return Bencode(dict)
+	}
+	if trackerResponse.WarningMessage != "" {
+		dict["warning message"] = trackerResponse.WarningMessage
+	}
+	dict["interval"] = trackerResponse.Interval
+	if trackerResponse.MinInterval > 0 {
+		dict["min interval"] = trackerResponse.MinInterval
+	}
+	dict["complete"] = trackerResponse.Complete
+	dict["incomplete"] = trackerResponse.Incomplete
+
+	if compact {
+		peers := make([]byte, 0, 6*len(trackerResponse.Peers))
+		peers6 := make([]byte, 0)
+		for _, peer := range trackerResponse.Peers {
+			ip := net.ParseIP(peer.IP)
+			if ip == nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				peers = append(peers, ip4...)
+				peers = append(peers, byte(peer.Port>>8), byte(peer.Port))
+			} else {
+				peers6 = append(peers6, ip.To16()...)
+				peers6 = append(peers6, byte(peer.Port>>8), byte(peer.Port))
+			}
+		}
+		dict["peers"] = peers
+		if len(peers6) > 0 {
+			dict["peers6"] = peers6
+		}
+	} else {
+		peers := make([]interface{}, 0, len(trackerResponse.Peers))
+		for _, peer := range trackerResponse.Peers {
+			peerDict := map[string]interface{}{
+				"ip":   peer.IP,
+				"port": peer.Port,
+			}
+			if !noPeerId {
+				peerDict["peer id"] = peer.PeerId
+			}
+			peers = append(peers, peerDict)
+		}
+		dict["peers"] = peers
+	}
+	return Bencode(dict)
+}
+
+func writeTrackerFailure(w http.ResponseWriter, reason string) {
+	data, _ := (&TrackerResponse{FailureReason: reason}).Bencode(false, false)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
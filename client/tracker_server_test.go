@@ -0,0 +1,136 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testInfoHash = "aaaaaaaaaaaaaaaaaaaa"
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	server := httptest.NewServer(NewTrackerServer(time.Minute, nil))
+	defer server.Close()
+
+	seeder := NewTrackerClient(server.URL+"/announce", testInfoHash, "-JB0001-seeder000001", 6881, 0, 0, 0, 1, 50, "started")
+	res, err := seeder.Announce()
+	if err != nil {
+		t.Fatal("Error announcing to tracker: ", err)
+	}
+	if res.Interval != 60 {
+		t.Error("Expected interval to be 60, got ", res.Interval)
+	}
+	if len(res.Peers) != 0 {
+		t.Error("Expected no peers for the first announce, got ", res.Peers)
+	}
+
+	leecher := NewTrackerClient(server.URL+"/announce", testInfoHash, "-JB0001-leecher00001", 6882, 0, 0, 100, 1, 50, "started")
+	res, err = leecher.Announce()
+	if err != nil {
+		t.Fatal("Error announcing to tracker: ", err)
+	}
+	if res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("Expected complete/incomplete to be 1/1, got %d/%d", res.Complete, res.Incomplete)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].IP != "127.0.0.1" || res.Peers[0].Port != 6881 {
+		t.Error("Expected compact peer 127.0.0.1:6881, got ", res.Peers)
+	}
+
+	res, err = leecher.AnnounceWithoutCompact()
+	if err != nil {
+		t.Fatal("Error announcing to tracker: ", err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].PeerId != "-JB0001-seeder000001" || res.Peers[0].Port != 6881 {
+		t.Error("Expected non-compact peer with peer id, got ", res.Peers)
+	}
+}
+
+func TestTrackerServerWhitelist(t *testing.T) {
+	server := httptest.NewServer(NewTrackerServer(time.Minute, []string{testInfoHash}))
+	defer server.Close()
+
+	allowed := NewTrackerClient(server.URL+"/announce", testInfoHash, "-JB0001-000000000001", 6881, 0, 0, 0, 1, 50, "started")
+	res, err := allowed.Announce()
+	if err != nil || res.FailureReason != "" {
+		t.Error("Expected whitelisted torrent to be accepted, got ", err, res)
+	}
+
+	denied := NewTrackerClient(server.URL+"/announce", "bbbbbbbbbbbbbbbbbbbb", "-JB0001-000000000001", 6881, 0, 0, 0, 1, 50, "started")
+	res, _ = denied.AnnounceWithParams(denied.queryParam())
+	if res == nil || res.FailureReason == "" {
+		t.Error("Expected failure reason for torrent not in whitelist, got ", res)
+	}
+}
+
+func TestTrackerServerScrapeAndExpiry(t *testing.T) {
+	now := time.Now()
+	tracker := NewTrackerServer(time.Minute, nil)
+	tracker.now = func() time.Time { return now }
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	for i, peerId := range []string{"-JB0001-000000000001", "-JB0001-000000000002"} {
+		trackerClient := NewTrackerClient(server.URL+"/announce", testInfoHash, peerId, 6881+i, 0, 0, i, 1, 50, "started")
+		if _, err := trackerClient.Announce(); err != nil {
+			t.Fatal("Error announcing to tracker: ", err)
+		}
+	}
+
+	scrape := func() ScrapeFile {
+		res, err := http.Get(server.URL + "/scrape?info_hash=" + url.QueryEscape(testInfoHash))
+		if err != nil {
+			t.Fatal("Error scraping tracker: ", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		files, err := ParseScrapeResponse(body)
+		if err != nil {
+			t.Fatal("Error parsing scrape response: ", err)
+		}
+		return files[testInfoHash]
+	}
+
+	file := scrape()
+	if file.Complete != 1 || file.Incomplete != 1 {
+		t.Errorf("Expected complete/incomplete to be 1/1, got %d/%d", file.Complete, file.Incomplete)
+	}
+
+	now = now.Add(3 * time.Minute)
+	file = scrape()
+	if file.Complete != 0 || file.Incomplete != 0 {
+		t.Errorf("Expected expired peers to be removed, got %d/%d", file.Complete, file.Incomplete)
+	}
+}
+
+func TestTrackerServerPeerAddress(t *testing.T) {
+	tracker := NewTrackerServer(time.Minute, nil)
+	announce := func(remoteAddr string, peerId string, query string) {
+		params := url.Values{}
+		params.Set("info_hash", testInfoHash)
+		params.Set("peer_id", peerId)
+		params.Set("port", "6881")
+		r := httptest.NewRequest("GET", "/announce?"+params.Encode()+"&"+query, nil)
+		r.RemoteAddr = remoteAddr
+		tracker.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	// 远程的peer不能替别的地址announce
+	announce("203.0.113.5:40000", "-JB0001-000000000001", "ip=198.51.100.7")
+	announce("127.0.0.1:40000", "-JB0001-000000000002", "ip=198.51.100.8")
+	torrent := tracker.torrents[testInfoHash]
+	if ip := torrent.peers["-JB0001-000000000001"].IP; ip != "203.0.113.5" {
+		t.Error("Expected remote address instead of ip parameter, got ", ip)
+	}
+	if ip := torrent.peers["-JB0001-000000000002"].IP; ip != "198.51.100.8" {
+		t.Error("Expected ip parameter from local request, got ", ip)
+	}
+
+	// 第一次announce就是completed
+	announce("203.0.113.9:40000", "-JB0001-000000000003", "event=completed&left=0")
+	announce("203.0.113.9:40000", "-JB0001-000000000003", "event=completed&left=0")
+	if torrent.downloaded != 1 {
+		t.Error("Expected one completed download, got ", torrent.downloaded)
+	}
+}
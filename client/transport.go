@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// TransportPolicy 主动连接时使用TCP还是uTP
+type TransportPolicy int
+
+const (
+	TransportTCP       TransportPolicy = iota // 只使用TCP
+	TransportUTP                              // 只使用uTP
+	TransportPreferUTP                        // 先尝试uTP, 失败后使用TCP
+)
+
+const dialTimeout = 2 * time.Second
+
+var errNoUTP = errors.New("utp socket not available")
+
+// PeerDialer 按传输和加密策略主动连接peer, 返回的连接与TCP连接一样使用
+type PeerDialer struct {
+	Transport  TransportPolicy
+	Encryption EncryptionPolicy
+	UTP        *UTPSocket // 为nil时只能使用TCP
+}
+
+// Dial 连接peer并完成加密握手, prefer时加密握手失败后使用明文重新连接
+func (dialer *PeerDialer) Dial(peer *Peer, infoHash string) (net.Conn, error) {
+	if dialer == nil {
+		return Connect(peer)
+	}
+	conn, err := dialer.dialTransport(peer)
+	if err != nil || dialer.Encryption == EncryptionDisabled {
+		return conn, err
+	}
+	provide := uint32(cryptoRC4)
+	if dialer.Encryption == EncryptionPrefer {
+		provide |= cryptoPlaintext
+	}
+	conn.SetDeadline(time.Now().Add(handShakeTimeout))
+	encrypted, err := mseInitiate(conn, infoHash, provide)
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return encrypted, nil
+	}
+	conn.Close()
+	if dialer.Encryption == EncryptionRequire {
+		return nil, err
+	}
+	log.Println("encrypted handshake with ", peerAddr(peer), " failed, retry in plaintext: ", err)
+	return dialer.dialTransport(peer)
+}
+
+func (dialer *PeerDialer) dialTransport(peer *Peer) (net.Conn, error) {
+	if dialer.Transport == TransportTCP {
+		return Connect(peer)
+	}
+	if dialer.UTP == nil {
+		if dialer.Transport == TransportUTP {
+			return nil, errNoUTP
+		}
+		return Connect(peer)
+	}
+	conn, err := dialer.UTP.Dial(fmt.Sprintf("[%s]:%d", peer.IP, peer.Port), dialTimeout)
+	if err != nil && dialer.Transport == TransportPreferUTP {
+		log.Println("utp connection to ", peerAddr(peer), " failed, retry over tcp: ", err)
+		return Connect(peer)
+	}
+	return conn, err
+}
+
+// remoteHostPort 返回TCP或uTP连接的对方地址
+func remoteHostPort(conn net.Conn) (string, int) {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String(), addr.Port
+	case *net.UDPAddr:
+		return addr.IP.String(), addr.Port
+	}
+	return conn.RemoteAddr().String(), 0
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/binary"
+	"log"
+)
+
+// maxRequestLength 超过该长度的请求被忽略
+const maxRequestLength = 128 * 1024
+
+// pieceReader 提供做种所需的数据, 由Client实现
+type pieceReader interface {
+	HavePiece(index int) bool
+	ReadBlock(index, begin, length int) ([]byte, error)
+}
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, protocolErrorf(Request, "request payload length %d", len(payload))
+	}
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+// handleRequest 把对方的请求加入队列, 由Download循环逐个发送
+// 不处理的请求在fast extension中回复Reject Request
+func (downloader *Downloader) handleRequest(msg *Message) error {
+	req, err := parseBlockRequest(msg.payload)
+	if err != nil {
+		return err
+	}
+	if req.index >= downloader.pieceNum {
+		return protocolErrorf(msg.typeId, "piece index %d out of range", req.index)
+	}
+	if downloader.storage == nil || (downloader.state.am_choking && !downloader.allowedFastSent[req.index]) {
+		return downloader.sendReject(req)
+	}
+	if req.length <= 0 || req.length > maxRequestLength {
+		log.Printf("downloader %d: request length %d too large", downloader.Id, req.length)
+		return downloader.sendReject(req)
+	}
+	if !downloader.storage.HavePiece(req.index) {
+		log.Printf("downloader %d: peer requested piece %d we do not have", downloader.Id, req.index)
+		return downloader.sendReject(req)
+	}
+	// 队列长度不超过扩展握手中声明的reqq
+	if len(downloader.uploads) >= defaultReqq {
+		log.Printf("downloader %d: too many pending requests", downloader.Id)
+		return downloader.sendReject(req)
+	}
+	downloader.uploads = append(downloader.uploads, req)
+	return nil
+}
+
+// handleCancel 删除队列中尚未发送的请求, fast extension中回复Reject Request
+func (downloader *Downloader) handleCancel(msg *Message) error {
+	req, err := parseBlockRequest(msg.payload)
+	if err != nil {
+		return err
+	}
+	for i, upload := range downloader.uploads {
+		if upload == req {
+			downloader.uploads = append(downloader.uploads[:i], downloader.uploads[i+1:]...)
+			return downloader.sendReject(req)
+		}
+	}
+	return nil
+}
+
+// serveRequest 发送队列中的第一个请求, 读取失败时拒绝请求, 不支持fast extension时断开连接
+func (downloader *Downloader) serveRequest() error {
+	req := downloader.uploads[0]
+	downloader.uploads = downloader.uploads[1:]
+	block, err := downloader.storage.ReadBlock(req.index, req.begin, req.length)
+	if err != nil {
+		log.Printf("downloader %d error reading piece %d: %s", downloader.Id, req.index, err)
+		if !downloader.fast {
+			return err
+		}
+		return downloader.sendReject(req)
+	}
+	// 连续的分片合并发送, 队列清空后由Download循环发送
+	downloader.writeMu.Lock()
+	err = downloader.wire.WritePiece(req.index, req.begin, block)
+	downloader.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	downloader.uploaded.Add(int64(len(block)))
+	return nil
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// memPieces 内存中的pieceReader, 每个piece长度为16KiB
+type memPieces map[int][]byte
+
+func (pieces memPieces) HavePiece(index int) bool {
+	_, ok := pieces[index]
+	return ok
+}
+
+func (pieces memPieces) ReadBlock(index, begin, length int) ([]byte, error) {
+	piece, ok := pieces[index]
+	if !ok || begin+length > len(piece) {
+		return nil, errors.New("block out of range")
+	}
+	return piece[begin : begin+length], nil
+}
+
+func newSeedingDownloader(storage pieceReader) (*Downloader, net.Conn) {
+	local, remote := net.Pipe()
+	downloader := &Downloader{
+		conn:      local,
+		wire:      newPeerIO(local),
+		state:     &State{am_choking: true, peer_choking: true},
+		bitfield:  NewBitfield(8),
+		pieceNum:  8,
+		peer:      &Peer{IP: "127.0.0.1", Port: 6881},
+		storage:   storage,
+		chokeChan: make(chan bool, 1),
+		haveReady: make(chan struct{}, 1),
+	}
+	return downloader, remote
+}
+
+func readMessageTimeout(t *testing.T, conn net.Conn) *Message {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := ReadMessageFrom(conn)
+	if err != nil {
+		t.Fatal("Error reading message: ", err)
+	}
+	return msg
+}
+
+func TestDownloaderServesRequests(t *testing.T) {
+	piece := bytes.Repeat([]byte{1, 2, 3, 4}, 4096)
+	downloader, remote := newSeedingDownloader(memPieces{0: piece})
+	defer remote.Close()
+
+	source := newTestPieceSource(1)
+	close(source.finished)
+	cancelChan := make(chan struct{})
+	defer close(cancelChan)
+	go downloader.Download(source, make(chan SavePieceTask), cancelChan)
+
+	NewMessage(Interested, nil).WriteTo(remote)
+	downloader.SetChoking(false)
+	if msg := readMessageTimeout(t, remote); msg.typeId != Unchoke {
+		t.Fatal("Expected unchoke from choker, got ", msg.typeId)
+	}
+
+	// 没有的piece和过长的请求被忽略
+	NewRequestMessage(1, 0, 16384).WriteTo(remote)
+	NewRequestMessage(0, 0, maxRequestLength+1).WriteTo(remote)
+	NewRequestMessage(0, 1024, 2048).WriteTo(remote)
+	msg := readMessageTimeout(t, remote)
+	if msg.typeId != Piece {
+		t.Fatal("Expected piece message, got ", msg.typeId)
+	}
+	if BytesToInt32(msg.payload[0:4]) != 0 || BytesToInt32(msg.payload[4:8]) != 1024 ||
+		!bytes.Equal(msg.payload[8:], piece[1024:3072]) {
+		t.Error("Unexpected piece payload")
+	}
+	// 计数在写入完成后更新
+	for i := 0; i < 100 && downloader.uploaded.Load() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if downloader.uploaded.Load() != 2048 {
+		t.Error("Expected 2048 bytes uploaded, got ", downloader.uploaded.Load())
+	}
+}
+
+func TestDownloaderCancelRequest(t *testing.T) {
+	downloader, remote := newSeedingDownloader(memPieces{0: make([]byte, 16384)})
+	defer remote.Close()
+	downloader.state.am_choking = false
+	downloader.handleRequest(NewRequestMessage(0, 0, 8192))
+	downloader.handleRequest(NewRequestMessage(0, 8192, 8192))
+	downloader.handleCancel(NewCancelMessage(0, 0, 8192))
+	if len(downloader.uploads) != 1 || downloader.uploads[0].begin != 8192 {
+		t.Errorf("Unexpected upload queue: %+v", downloader.uploads)
+	}
+
+	downloader.state.am_choking = true
+	downloader.handleRequest(NewRequestMessage(0, 0, 8192))
+	if len(downloader.uploads) != 1 {
+		t.Error("Expected requests from choked peer to be ignored")
+	}
+}
+
+func TestDownloaderLimitsUploads(t *testing.T) {
+	downloader, remote := newSeedingDownloader(memPieces{0: make([]byte, 16384)})
+	defer remote.Close()
+	downloader.state.am_choking = false
+	for i := 0; i <= defaultReqq; i++ {
+		downloader.handleRequest(NewRequestMessage(0, 0, 1024))
+	}
+	if len(downloader.uploads) != defaultReqq {
+		t.Errorf("Expected at most %d queued requests, got %d", defaultReqq, len(downloader.uploads))
+	}
+
+	// 读取失败时没有fast extension无法拒绝, 断开连接
+	downloader.uploads = []blockRequest{{index: 1, begin: 0, length: 1024}}
+	if err := downloader.serveRequest(); err == nil {
+		t.Error("Expected error when the block cannot be read")
+	}
+}
+
+func TestClientReadBlock(t *testing.T) {
+	metaInfo := testMetaInfo(2, 16384)
+	metaInfo.Info.Length = 16384 + 100
+	dir := t.TempDir()
+	c, err := NewClient(metaInfo, dir, 1)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	c.storage, err = NewPieceSaver(metaInfo, dir, t.TempDir())
+	if err != nil {
+		t.Fatal("Error opening storage: ", err)
+	}
+	defer c.storage.Close()
+
+	last := bytes.Repeat([]byte{7}, 100)
+	c.storage.SavePiece(SavePieceTask{PieceIndex: 1, Piece: last}, bitfieldOf(0x40))
+	if _, err := c.ReadBlock(1, 0, 100); err == nil {
+		t.Error("Expected piece not in bitfield to be unreadable")
+	}
+	c.bitField.Set(1)
+	if block, err := c.ReadBlock(1, 50, 50); err != nil || !bytes.Equal(block, last[50:]) {
+		t.Error("Unexpected block: ", block, err)
+	}
+	if _, err := c.ReadBlock(1, 50, 51); err == nil {
+		t.Error("Expected block past the end of the last piece to be rejected")
+	}
+	if c.HavePiece(2) || c.HavePiece(-1) {
+		t.Error("Expected out of range pieces to be missing")
+	}
+}
@@ -0,0 +1,762 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP (BEP 29) 包类型
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+
+	utpVersion    = 1
+	utpHeaderSize = 20
+	// 每个包的数据不超过该长度, 避免IP分片
+	utpMaxPayload     = 1380
+	utpRecvBuffer     = 1024 * 1024
+	utpTickInterval   = 50 * time.Millisecond
+	utpInitialTimeout = time.Second
+	utpMinTimeout     = 500 * time.Millisecond
+	utpMaxTimeout     = 30 * time.Second
+	utpMaxTimeouts    = 8   // 连续超时次数超过该值时断开
+	utpMaxOutOfOrder  = 512 // 最多缓存的乱序包数
+	utpAcceptBacklog  = 64
+
+	// LEDBAT: 排队延迟目标100ms, 每个RTT窗口最多增加3000字节
+	ledbatTarget       = 100000 // 微秒
+	ledbatMaxIncrease  = 3000
+	ledbatMinWindow    = utpMaxPayload
+	ledbatInitialWin   = 3 * utpMaxPayload
+	ledbatHistorySlot  = time.Minute
+	ledbatHistorySlots = 2
+)
+
+var (
+	errUTPReset   = errors.New("utp: connection reset by peer")
+	errUTPTimeout = errors.New("utp: connection timed out")
+)
+
+type utpHeader struct {
+	typ           byte
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+func (header *utpHeader) encode(payload []byte) []byte {
+	packet := make([]byte, utpHeaderSize+len(payload))
+	packet[0] = header.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(packet[2:4], header.connId)
+	binary.BigEndian.PutUint32(packet[4:8], header.timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], header.timestampDiff)
+	binary.BigEndian.PutUint32(packet[12:16], header.wndSize)
+	binary.BigEndian.PutUint16(packet[16:18], header.seqNr)
+	binary.BigEndian.PutUint16(packet[18:20], header.ackNr)
+	copy(packet[utpHeaderSize:], payload)
+	return packet
+}
+
+// decodeUTPPacket 解析包头并跳过扩展, 返回包头和数据
+func decodeUTPPacket(packet []byte) (*utpHeader, []byte, error) {
+	if len(packet) < utpHeaderSize {
+		return nil, nil, fmt.Errorf("utp: packet length %d too short", len(packet))
+	}
+	if packet[0]&0x0f != utpVersion || packet[0]>>4 > utpSyn {
+		return nil, nil, fmt.Errorf("utp: unknown packet type %#x", packet[0])
+	}
+	header := &utpHeader{
+		typ:           packet[0] >> 4,
+		connId:        binary.BigEndian.Uint16(packet[2:4]),
+		timestamp:     binary.BigEndian.Uint32(packet[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(packet[8:12]),
+		wndSize:       binary.BigEndian.Uint32(packet[12:16]),
+		seqNr:         binary.BigEndian.Uint16(packet[16:18]),
+		ackNr:         binary.BigEndian.Uint16(packet[18:20]),
+	}
+	offset := utpHeaderSize
+	for extension := packet[1]; extension != 0; {
+		if offset+2 > len(packet) || offset+2+int(packet[offset+1]) > len(packet) {
+			return nil, nil, errors.New("utp: invalid extension")
+		}
+		extension = packet[offset]
+		offset += 2 + int(packet[offset+1])
+	}
+	return header, packet[offset:], nil
+}
+
+func utpMicroseconds() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess 序号会回绕, 按差值的符号比较
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type utpConnKey struct {
+	addr string
+	id   uint16 // 本地的recv_id
+}
+
+// UTPSocket 在一个UDP socket上复用多个uTP连接, 同时作为net.Listener接受连接
+type UTPSocket struct {
+	conn       net.PacketConn
+	mu         sync.Mutex
+	conns      map[utpConnKey]*utpConn
+	acceptChan chan *utpConn
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func ListenUTP(addr string) (*UTPSocket, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newUTPSocket(conn), nil
+}
+
+func newUTPSocket(conn net.PacketConn) *UTPSocket {
+	socket := &UTPSocket{
+		conn:       conn,
+		conns:      make(map[utpConnKey]*utpConn),
+		acceptChan: make(chan *utpConn, utpAcceptBacklog),
+		closed:     make(chan struct{}),
+	}
+	go socket.readLoop()
+	go socket.tickLoop()
+	return socket
+}
+
+func (socket *UTPSocket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+func (socket *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.acceptChan:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭socket, 所有连接随之断开
+func (socket *UTPSocket) Close() error {
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		socket.conn.Close()
+		socket.mu.Lock()
+		conns := make([]*utpConn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mu.Unlock()
+		for _, conn := range conns {
+			conn.fail(net.ErrClosed)
+		}
+	})
+	return nil
+}
+
+// Dial 建立uTP连接, 对方回复SYN之前阻塞
+func (socket *UTPSocket) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	socket.mu.Lock()
+	var id uint16
+	for {
+		id = uint16(rand.Intn(0x10000))
+		if _, ok := socket.conns[utpConnKey{remote.String(), id}]; !ok {
+			break
+		}
+	}
+	conn := newUTPConn(socket, remote, id, id+1)
+	socket.conns[conn.key()] = conn
+	socket.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, conn.broadcast)
+	defer timer.Stop()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.seqNr = 1
+	conn.sendLocked(utpSyn, nil)
+	for !conn.connected && conn.err == nil {
+		if err := conn.waitLocked(deadline); err != nil {
+			conn.err = err
+			break
+		}
+	}
+	if !conn.connected {
+		socket.remove(conn)
+		return nil, conn.err
+	}
+	return conn, nil
+}
+
+func (socket *UTPSocket) remove(conn *utpConn) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	if socket.conns[conn.key()] == conn {
+		delete(socket.conns, conn.key())
+	}
+}
+
+func (socket *UTPSocket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-socket.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		header, payload, err := decodeUTPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		payload = append([]byte(nil), payload...)
+		if header.typ == utpSyn {
+			socket.handleSyn(addr, header)
+			continue
+		}
+		socket.mu.Lock()
+		conn := socket.conns[utpConnKey{addr.String(), header.connId}]
+		socket.mu.Unlock()
+		if conn != nil {
+			conn.handlePacket(header, payload)
+		}
+	}
+}
+
+// handleSyn 对方主动连接, recv_id为SYN中的connection_id + 1
+func (socket *UTPSocket) handleSyn(addr net.Addr, header *utpHeader) {
+	remote, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	key := utpConnKey{remote.String(), header.connId + 1}
+	socket.mu.Lock()
+	conn, exists := socket.conns[key]
+	if !exists {
+		conn = newUTPConn(socket, remote, header.connId+1, header.connId)
+		conn.connected = true
+		conn.seqNr = uint16(rand.Intn(0x10000))
+		conn.ackNr = header.seqNr
+		socket.conns[key] = conn
+	}
+	socket.mu.Unlock()
+
+	conn.mu.Lock()
+	conn.replyMicro = utpMicroseconds() - header.timestamp
+	conn.peerWindow = header.wndSize
+	// 重复的SYN说明回复丢失, 重新发送
+	conn.sendLocked(utpState, nil)
+	conn.mu.Unlock()
+	if exists {
+		return
+	}
+	select {
+	case socket.acceptChan <- conn:
+	default:
+		socket.remove(conn)
+	}
+}
+
+func (socket *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-socket.closed:
+			return
+		case now := <-ticker.C:
+			socket.mu.Lock()
+			conns := make([]*utpConn, 0, len(socket.conns))
+			for _, conn := range socket.conns {
+				conns = append(conns, conn)
+			}
+			socket.mu.Unlock()
+			for _, conn := range conns {
+				conn.tick(now)
+			}
+		}
+	}
+}
+
+// utpPacket 已发送尚未确认的包
+type utpPacket struct {
+	typ           byte
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// utpConn 一个uTP连接, 实现net.Conn
+type utpConn struct {
+	socket *UTPSocket
+	remote *net.UDPAddr
+	recvId uint16
+	sendId uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	connected bool
+	closed    bool  // 本地已经Close
+	eof       bool  // 对方的FIN之前的数据都已收到
+	err       error // 连接已经断开
+
+	seqNr      uint16 // 下一个发送的序号
+	ackNr      uint16 // 已按顺序收到的最后一个序号
+	inflight   []*utpPacket
+	curWindow  int // 已发送未确认的字节数
+	peerWindow uint32
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16]*utpPacket
+	finSeq     uint16
+	finRecv    bool
+
+	replyMicro uint32 // 回复给对方的timestamp_difference
+	maxWindow  float64
+	delays     delayHistory
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+	timeouts   int
+	dupAcks    int
+	// 丢包恢复期间每个部分确认都重传下一个未确认的包, 直到recoverSeq被确认
+	recovering bool
+	recoverSeq uint16
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUTPConn(socket *UTPSocket, remote *net.UDPAddr, recvId, sendId uint16) *utpConn {
+	conn := &utpConn{
+		socket:     socket,
+		remote:     remote,
+		recvId:     recvId,
+		sendId:     sendId,
+		peerWindow: utpRecvBuffer,
+		outOfOrder: make(map[uint16]*utpPacket),
+		maxWindow:  ledbatInitialWin,
+		timeout:    utpInitialTimeout,
+	}
+	conn.cond = sync.NewCond(&conn.mu)
+	return conn
+}
+
+func (conn *utpConn) key() utpConnKey {
+	return utpConnKey{conn.remote.String(), conn.recvId}
+}
+
+func (conn *utpConn) broadcast() {
+	conn.mu.Lock()
+	conn.cond.Broadcast()
+	conn.mu.Unlock()
+}
+
+// waitLocked 等待状态变化, 超过deadline时返回错误, 调用方需持有锁
+func (conn *utpConn) waitLocked(deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	conn.cond.Wait()
+	return nil
+}
+
+func (conn *utpConn) fail(err error) {
+	conn.mu.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.cond.Broadcast()
+	conn.mu.Unlock()
+	conn.socket.remove(conn)
+}
+
+// advertisedWindow 接收缓冲区的剩余空间, 调用方需持有锁
+func (conn *utpConn) advertisedWindow() uint32 {
+	if free := utpRecvBuffer - conn.readBuf.Len(); free > 0 {
+		return uint32(free)
+	}
+	return 0
+}
+
+// sendLocked 发送一个包, 数据包, SYN和FIN占用序号并等待确认, 调用方需持有锁
+func (conn *utpConn) sendLocked(typ byte, payload []byte) {
+	if typ == utpState {
+		conn.transmit(typ, conn.seqNr, nil)
+		return
+	}
+	packet := &utpPacket{typ: typ, seqNr: conn.seqNr, payload: payload}
+	conn.seqNr++
+	conn.inflight = append(conn.inflight, packet)
+	conn.curWindow += len(payload)
+	conn.retransmit(packet)
+}
+
+func (conn *utpConn) retransmit(packet *utpPacket) {
+	packet.sentAt = time.Now()
+	packet.transmissions++
+	conn.transmit(packet.typ, packet.seqNr, packet.payload)
+}
+
+func (conn *utpConn) transmit(typ byte, seqNr uint16, payload []byte) {
+	header := utpHeader{
+		typ:           typ,
+		connId:        conn.sendId,
+		timestamp:     utpMicroseconds(),
+		timestampDiff: conn.replyMicro,
+		wndSize:       conn.advertisedWindow(),
+		seqNr:         seqNr,
+		ackNr:         conn.ackNr,
+	}
+	if typ == utpSyn {
+		header.connId = conn.recvId
+	}
+	conn.socket.conn.WriteTo(header.encode(payload), conn.remote)
+}
+
+func (conn *utpConn) handlePacket(header *utpHeader, payload []byte) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	defer conn.cond.Broadcast()
+	if header.typ == utpReset {
+		conn.err = errUTPReset
+		conn.socket.remove(conn)
+		return
+	}
+	conn.replyMicro = utpMicroseconds() - header.timestamp
+	conn.peerWindow = header.wndSize
+	if !conn.connected {
+		if header.typ != utpState {
+			return
+		}
+		// 对方回复的seq_nr是它将要发送的第一个序号
+		conn.connected = true
+		conn.ackNr = header.seqNr - 1
+	}
+	conn.handleAck(header, len(payload) == 0 && header.typ == utpState)
+
+	switch header.typ {
+	case utpData:
+		conn.receive(header.seqNr, payload)
+		conn.transmit(utpState, conn.seqNr, nil)
+	case utpFin:
+		conn.finRecv = true
+		conn.finSeq = header.seqNr
+		conn.deliverInOrder()
+		conn.transmit(utpState, conn.seqNr, nil)
+	}
+}
+
+// handleAck 移除已确认的包, 更新RTT和LEDBAT窗口, 调用方需持有锁
+func (conn *utpConn) handleAck(header *utpHeader, pureAck bool) {
+	now := time.Now()
+	acked := 0
+	for len(conn.inflight) > 0 && !seqLess(header.ackNr, conn.inflight[0].seqNr) {
+		packet := conn.inflight[0]
+		conn.inflight = conn.inflight[1:]
+		acked += len(packet.payload)
+		conn.curWindow -= len(packet.payload)
+		// 只用ack_nr对应的包估计RTT, 重传过的包和填补空洞后一起确认的包都不准确
+		if packet.seqNr == header.ackNr && packet.transmissions == 1 && !conn.recovering {
+			conn.updateRTT(now.Sub(packet.sentAt))
+		}
+	}
+	if acked > 0 {
+		conn.dupAcks = 0
+		conn.timeouts = 0
+		if header.timestampDiff != 0 {
+			conn.maxWindow = ledbatWindow(conn.maxWindow, conn.delays.add(now, header.timestampDiff), acked)
+		}
+	}
+	if len(conn.inflight) == 0 {
+		conn.dupAcks = 0
+		conn.recovering = false
+		return
+	}
+	if acked > 0 {
+		if conn.recovering {
+			if seqLess(header.ackNr, conn.recoverSeq) {
+				conn.retransmit(conn.inflight[0])
+			} else {
+				conn.recovering = false
+			}
+		}
+		return
+	}
+	// 对方的数据包也携带ack_nr, 只有纯确认才算重复确认
+	if !pureAck {
+		return
+	}
+	// 3个重复的确认视为丢包, 快速重传并减小窗口
+	conn.dupAcks++
+	if conn.dupAcks == 3 && !conn.recovering {
+		conn.maxWindow /= 2
+		if conn.maxWindow < ledbatMinWindow {
+			conn.maxWindow = ledbatMinWindow
+		}
+		conn.startRecoveryLocked()
+	}
+}
+
+// startRecoveryLocked 重传最早的未确认包, 调用方需持有锁
+func (conn *utpConn) startRecoveryLocked() {
+	conn.recovering = true
+	conn.recoverSeq = conn.seqNr - 1
+	conn.retransmit(conn.inflight[0])
+}
+
+func (conn *utpConn) updateRTT(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVar = sample / 2
+	} else {
+		delta := conn.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttVar += (delta - conn.rttVar) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+	conn.timeout = conn.rtt + 4*conn.rttVar
+	if conn.timeout < utpMinTimeout {
+		conn.timeout = utpMinTimeout
+	}
+}
+
+// receive 按顺序交付数据, 乱序的包先缓存, 调用方需持有锁
+func (conn *utpConn) receive(seqNr uint16, payload []byte) {
+	distance := seqNr - conn.ackNr
+	if distance == 0 || distance >= 0x8000 {
+		return // 重复的包
+	}
+	if distance > utpMaxOutOfOrder || conn.readBuf.Len()+len(payload) > utpRecvBuffer {
+		return // 超出接收窗口, 等待重传
+	}
+	conn.outOfOrder[seqNr] = &utpPacket{seqNr: seqNr, payload: payload}
+	conn.deliverInOrder()
+}
+
+// deliverInOrder 把连续的包移到读缓冲区, 调用方需持有锁
+func (conn *utpConn) deliverInOrder() {
+	for {
+		next := conn.ackNr + 1
+		if conn.finRecv && next == conn.finSeq {
+			conn.ackNr = next
+			conn.eof = true
+			return
+		}
+		packet, ok := conn.outOfOrder[next]
+		if !ok {
+			return
+		}
+		delete(conn.outOfOrder, next)
+		conn.readBuf.Write(packet.payload)
+		conn.ackNr = next
+	}
+}
+
+// tick 检查重传超时, 本地关闭且FIN被确认后从socket中移除
+func (conn *utpConn) tick(now time.Time) {
+	conn.mu.Lock()
+	if conn.err != nil || (conn.closed && len(conn.inflight) == 0) {
+		conn.mu.Unlock()
+		conn.socket.remove(conn)
+		return
+	}
+	if len(conn.inflight) == 0 || now.Sub(conn.inflight[0].sentAt) < conn.timeout {
+		conn.mu.Unlock()
+		return
+	}
+	conn.timeouts++
+	if conn.timeouts > utpMaxTimeouts {
+		conn.mu.Unlock()
+		conn.fail(errUTPTimeout)
+		return
+	}
+	// 超时时窗口减到最小, 重传最早的包
+	conn.maxWindow = ledbatMinWindow
+	conn.timeout *= 2
+	if conn.timeout > utpMaxTimeout {
+		conn.timeout = utpMaxTimeout
+	}
+	conn.startRecoveryLocked()
+	conn.mu.Unlock()
+}
+
+func (conn *utpConn) Read(p []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for conn.readBuf.Len() == 0 {
+		switch {
+		case conn.closed:
+			return 0, net.ErrClosed
+		case conn.eof:
+			return 0, io.EOF
+		case conn.err != nil:
+			return 0, conn.err
+		}
+		if err := conn.waitLocked(conn.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	before := conn.advertisedWindow()
+	n, _ := conn.readBuf.Read(p)
+	// 接收窗口重新打开时通知对方
+	if before < utpMaxPayload && conn.advertisedWindow() >= utpMaxPayload {
+		conn.transmit(utpState, conn.seqNr, nil)
+	}
+	return n, nil
+}
+
+// Write 发送窗口为LEDBAT窗口和对方接收窗口中较小的一个, 窗口满时阻塞
+func (conn *utpConn) Write(p []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		if conn.closed {
+			return written, net.ErrClosed
+		}
+		if conn.err != nil {
+			return written, conn.err
+		}
+		n := len(p) - written
+		if n > utpMaxPayload {
+			n = utpMaxPayload
+		}
+		window := int(conn.maxWindow)
+		if int(conn.peerWindow) < window {
+			window = int(conn.peerWindow)
+		}
+		if conn.curWindow > 0 && conn.curWindow+n > window {
+			if err := conn.waitLocked(conn.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		conn.sendLocked(utpData, append([]byte(nil), p[written:written+n]...))
+		written += n
+	}
+	return written, nil
+}
+
+// Close 发送FIN, 已发送的数据和FIN在后台继续重传直到被确认
+func (conn *utpConn) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	if conn.connected && conn.err == nil {
+		conn.sendLocked(utpFin, nil)
+	}
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *utpConn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *utpConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *utpConn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *utpConn) SetReadDeadline(t time.Time) error {
+	conn.mu.Lock()
+	conn.readDeadline = t
+	conn.mu.Unlock()
+	conn.wakeAt(t)
+	return nil
+}
+
+func (conn *utpConn) SetWriteDeadline(t time.Time) error {
+	conn.mu.Lock()
+	conn.writeDeadline = t
+	conn.mu.Unlock()
+	conn.wakeAt(t)
+	return nil
+}
+
+// wakeAt 在deadline时唤醒等待的Read和Write
+func (conn *utpConn) wakeAt(t time.Time) {
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), conn.broadcast)
+	}
+}
+
+// delayHistory 记录最近两分钟的最小单向延迟作为基准延迟
+type delayHistory struct {
+	slotStart time.Time
+	minimums  []uint32
+}
+
+// add 加入一个延迟样本, 返回相对基准延迟的排队延迟
+func (history *delayHistory) add(now time.Time, delay uint32) uint32 {
+	if len(history.minimums) == 0 || now.Sub(history.slotStart) >= ledbatHistorySlot {
+		history.slotStart = now
+		history.minimums = append(history.minimums, delay)
+		if len(history.minimums) > ledbatHistorySlots {
+			history.minimums = history.minimums[1:]
+		}
+	} else if last := len(history.minimums) - 1; delay < history.minimums[last] {
+		history.minimums[last] = delay
+	}
+	base := history.minimums[0]
+	for _, minimum := range history.minimums {
+		if minimum < base {
+			base = minimum
+		}
+	}
+	return delay - base
+}
+
+// ledbatWindow 排队延迟低于目标时增大窗口, 高于目标时减小窗口
+func ledbatWindow(maxWindow float64, queuingDelay uint32, acked int) float64 {
+	offTarget := float64(ledbatTarget-int64(queuingDelay)) / ledbatTarget
+	windowFactor := float64(acked) / maxWindow
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	maxWindow += ledbatMaxIncrease * offTarget * windowFactor
+	if maxWindow < ledbatMinWindow {
+		maxWindow = ledbatMinWindow
+	}
+	return maxWindow
+}
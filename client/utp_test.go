@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn 每发送every个包丢弃一个, 用于测试重传
+type lossyPacketConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	every int
+	sent  int
+}
+
+func (conn *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.mu.Lock()
+	conn.sent++
+	drop := conn.sent%conn.every == 0
+	conn.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return conn.PacketConn.WriteTo(p, addr)
+}
+
+func newTestUTPSocket(t *testing.T, dropEvery int) *UTPSocket {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening udp: ", err)
+	}
+	if dropEvery > 0 {
+		packetConn = &lossyPacketConn{PacketConn: packetConn, every: dropEvery}
+	}
+	socket := newUTPSocket(packetConn)
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+// utpPair 在两个socket之间建立连接, 返回主动和被动的一端
+func utpPair(t *testing.T, a *UTPSocket, b *UTPSocket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept()
+		if err != nil {
+			t.Error("Error accepting utp connection: ", err)
+		}
+		accepted <- conn
+	}()
+	conn, err := a.Dial(b.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal("Error dialing utp: ", err)
+	}
+	return conn, <-accepted
+}
+
+// transfer 双向同时发送数据并检查收到的内容, 之后关闭连接检查EOF
+func transfer(t *testing.T, a net.Conn, b net.Conn, size int) {
+	dataA := make([]byte, size)
+	dataB := make([]byte, size)
+	rand.Read(dataA)
+	rand.Read(dataB)
+	a.SetDeadline(time.Now().Add(20 * time.Second))
+	b.SetDeadline(time.Now().Add(20 * time.Second))
+
+	var wg sync.WaitGroup
+	send := func(conn net.Conn, data []byte) {
+		defer wg.Done()
+		if _, err := conn.Write(data); err != nil {
+			t.Error("Error writing: ", err)
+		}
+	}
+	wg.Add(2)
+	go send(a, dataA)
+	go send(b, dataB)
+	receivedA := make([]byte, size)
+	receivedB := make([]byte, size)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := io.ReadFull(b, receivedA); err != nil {
+			t.Error("Error reading on b: ", err)
+		}
+	}()
+	if _, err := io.ReadFull(a, receivedB); err != nil {
+		t.Fatal("Error reading on a: ", err)
+	}
+	wg.Wait()
+	if !bytes.Equal(receivedA, dataA) || !bytes.Equal(receivedB, dataB) {
+		t.Fatal("Data corrupted in transfer")
+	}
+
+	a.Close()
+	if n, err := b.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Error("Expected EOF after close, got ", n, err)
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	a, b := utpPair(t, newTestUTPSocket(t, 0), newTestUTPSocket(t, 0))
+	defer b.Close()
+	if _, ok := a.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Error("Expected udp remote address, got ", a.RemoteAddr())
+	}
+	transfer(t, a, b, 1024*1024)
+}
+
+func TestUTPRetransmit(t *testing.T) {
+	a, b := utpPair(t, newTestUTPSocket(t, 20), newTestUTPSocket(t, 23))
+	defer b.Close()
+	transfer(t, a, b, 256*1024)
+}
+
+func TestUTPDialTimeout(t *testing.T) {
+	socket := newTestUTPSocket(t, 0)
+	// 对方没有运行uTP, SYN不会被回复
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening udp: ", err)
+	}
+	defer silent.Close()
+	if _, err := socket.Dial(silent.LocalAddr().String(), 200*time.Millisecond); err == nil {
+		t.Error("Expected dial to time out")
+	}
+}
+
+func TestLedbatWindow(t *testing.T) {
+	window := float64(10 * utpMaxPayload)
+	if grown := ledbatWindow(window, 0, int(window)); grown != window+ledbatMaxIncrease {
+		t.Error("Expected window to grow by max increase without queuing delay, got ", grown)
+	}
+	if shrunk := ledbatWindow(window, 2*ledbatTarget, int(window)); shrunk >= window {
+		t.Error("Expected window to shrink above target delay, got ", shrunk)
+	}
+	if same := ledbatWindow(window, ledbatTarget, utpMaxPayload); same != window {
+		t.Error("Expected window unchanged at target delay, got ", same)
+	}
+	if min := ledbatWindow(ledbatMinWindow, 10*ledbatTarget, utpMaxPayload); min != ledbatMinWindow {
+		t.Error("Expected window not below minimum, got ", min)
+	}
+
+	var history delayHistory
+	now := time.Now()
+	history.add(now, 5000)
+	if queuing := history.add(now.Add(time.Second), 8000); queuing != 3000 {
+		t.Error("Expected queuing delay relative to base delay, got ", queuing)
+	}
+	history.add(now.Add(ledbatHistorySlot), 9000)
+	history.add(now.Add(2*ledbatHistorySlot), 9000)
+	// 最早的基准延迟已经过期
+	if queuing := history.add(now.Add(2*ledbatHistorySlot+time.Second), 9500); queuing != 500 {
+		t.Error("Expected expired base delay to be dropped, got ", queuing)
+	}
+}
+
+func TestListenerAcceptsUTPPeer(t *testing.T) {
+	c := newListeningClient(t, 10)
+	socket, err := ListenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening utp: ", err)
+	}
+	go c.listener.ServeUTP(socket)
+
+	dialer := &PeerDialer{Transport: TransportUTP, Encryption: EncryptionPrefer, UTP: newTestUTPSocket(t, 0)}
+	addr := socket.Addr().(*net.UDPAddr)
+	peer := &Peer{IP: "127.0.0.1", Port: addr.Port}
+	conn, err := dialer.Dial(peer, c.metaInfo.InfoHash)
+	if err != nil {
+		t.Fatal("Error connecting over utp: ", err)
+	}
+	defer conn.Close()
+	if _, err := HandShake(peer, handShakeMsg(c.metaInfo, "-FK0001-000000000001"), conn); err != nil {
+		t.Fatal("Error in handshake over utp: ", err)
+	}
+	NewMessage(BitfieldMessage, []byte{0}).WriteTo(conn)
+	if !waitDownloaders(c, 1) {
+		t.Fatal("Expected one inbound downloader")
+	}
+	local := dialer.UTP.Addr().(*net.UDPAddr)
+	if downloader := c.activeDownloaders()[0]; downloader.peer.IP != "127.0.0.1" || downloader.peer.Port != local.Port {
+		t.Errorf("Unexpected inbound peer: %+v", downloader.peer)
+	}
+}
+
+func TestUTPAndDHTOnDefaultPorts(t *testing.T) {
+	config := DefaultConfig()
+	config.Transport = TransportPreferUTP
+	config.DHTBootstrapNodes = nil
+	config.DHTStateFile = ""
+	config.BanListFile = ""
+	c, err := NewClientWithConfig(testMetaInfo(8, 16384), t.TempDir(), config)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	if err := c.listen(); err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+	defer c.listener.Close()
+	if c.dialer.UTP == nil {
+		t.Fatal("Expected utp socket on the peer port")
+	}
+	defer c.dialer.UTP.Close()
+	go c.FetchPeersFromDHT(c.cancelChan)
+	defer close(c.cancelChan)
+
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		dht := c.dht
+		c.mu.Unlock()
+		if dht != nil {
+			if dht.Addr().Port == c.dialer.UTP.Addr().(*net.UDPAddr).Port {
+				t.Error("Expected dht and utp to use different ports")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected dht to start next to utp")
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/wujuw/jBittorrent/client"
 	"io"
 	"log"
 	"os"
-	"sort"
 	"strconv"
+	"time"
 )
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "tracker" {
+		runTracker(os.Args[2:])
+		return
+	}
 	if len(os.Args) != 3 {
 		fmt.Println("Usage:", os.Args[0], " <torrent file>", "<destination directory>")
+		fmt.Println("      ", os.Args[0], " tracker [-addr :6969] [-interval 30m] [-whitelist <file>]")
 		os.Exit(1)
 	}
 	file, err := os.Open(os.Args[1])
@@ -46,16 +52,41 @@ func main() {
 		switch command {
 		case "process":
 			info := c.GetDownloadProcess()
-			fmt.Println(fmt.Sprintf("downloaded: %s / %s, %s, download speed: %s", info["downloaded"], info["all"], info["percent"], info["speed"]))
+			fmt.Println(fmt.Sprintf("downloaded: %s / %s, %s, download speed: %s, protocol errors: %s", info["downloaded"], info["all"], info["percent"], info["speed"], info["protocol_errors"]))
 		case "peers":
-			peers := c.GetPeers()
-			keys := make([]int, 0, len(peers))
-			for key := range peers {
-				keys = append(keys, key)
+			for _, status := range c.GetPeerStatus() {
+				choked := "unchoked"
+				if status.Choked {
+					choked = "choked"
+				}
+				fmt.Println(fmt.Sprintf("downloader %s connected peer: [%s]:%s (%s), %s, down: %.0fB/S, up: %.0fB/S, trust: %d", strconv.Itoa(status.Id),
+					status.Peer.IP, strconv.Itoa(status.Peer.Port), status.Client, choked, status.DownloadRate, status.UploadRate, status.Trust))
+			}
+		case "trackers":
+			for _, status := range c.GetTrackerStatus() {
+				line := fmt.Sprintf("%s peers: %d", status.Url, status.Peers)
+				if status.LastError != "" {
+					line += fmt.Sprintf(", error: %s (failures: %d, retry at %s)", status.LastError, status.Failures, status.NextAnnounce.Format(time.Kitchen))
+				}
+				if status.Warning != "" {
+					line += ", warning: " + status.Warning
+				}
+				fmt.Println(line)
+			}
+		case "files":
+			for i, file := range c.GetFiles() {
+				fmt.Println(fmt.Sprintf("%d: %s, %d / %d bytes, priority: %s", i, file.Path, file.Downloaded, file.Length, file.Priority))
 			}
-			sort.Ints(keys)
-			for _, id := range keys {
-				fmt.Println(fmt.Sprintf("downloader %s connected peer: [%s]:%s", strconv.Itoa(id), peers[id].IP, strconv.Itoa(peers[id].Port)))
+		case "priority":
+			var index int
+			var name string
+			fmt.Scan(&index, &name)
+			priority, err := client.ParseFilePriority(name)
+			if err == nil {
+				err = c.SetFilePriority(index, priority)
+			}
+			if err != nil {
+				fmt.Println("Error setting priority:", err)
 			}
 		case "exit":
 			c.Stop()
@@ -64,7 +95,37 @@ func main() {
 			fmt.Println("support command: ")
 			fmt.Println("process: show the download process")
 			fmt.Println("peers: show the connected peers")
+			fmt.Println("trackers: show tracker status, errors and warnings")
+			fmt.Println("files: show the files and their priorities")
+			fmt.Println("priority <file> <skip|low|normal|high>: set the priority of a file")
 			fmt.Println("exit: stop the download")
 		}
 	}
 }
+
+func runTracker(args []string) {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := flags.String("addr", ":6969", "listen address")
+	interval := flags.Duration("interval", 30*time.Minute, "announce interval")
+	whitelistPath := flags.String("whitelist", "", "file with one hex info hash per line")
+	flags.Parse(args)
+
+	var whitelist []string
+	if *whitelistPath != "" {
+		data, err := os.ReadFile(*whitelistPath)
+		if err != nil {
+			fmt.Println("Error reading whitelist:", err)
+			os.Exit(1)
+		}
+		whitelist, err = client.ParseInfoHashList(string(data))
+		if err != nil {
+			fmt.Println("Error parsing whitelist:", err)
+			os.Exit(1)
+		}
+	}
+	server := client.NewTrackerServer(*interval, whitelist)
+	if err := server.ListenAndServe(*addr); err != nil {
+		fmt.Println("Error running tracker:", err)
+		os.Exit(1)
+	}
+}